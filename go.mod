@@ -5,11 +5,17 @@ go 1.23.0
 toolchain go1.23.8
 
 require (
-	github.com/gabriel-vasile/mimetype v1.3.1
+	github.com/BurntSushi/toml v1.4.0
+	github.com/ProtonMail/go-crypto v1.1.6
 	github.com/mholt/archives v0.1.3
 	github.com/schollz/progressbar/v3 v3.13.1
 	github.com/stretchr/testify v1.10.0
+	github.com/ulikunitz/xz v0.5.14
 	github.com/urfave/cli/v3 v3.3.8
+	golang.org/x/crypto v0.36.0
+	golang.org/x/net v0.38.0
+	gopkg.in/yaml.v3 v3.0.1
+	howett.net/plist v1.0.1
 )
 
 require (
@@ -18,6 +24,7 @@ require (
 	github.com/bodgit/plumbing v1.3.0 // indirect
 	github.com/bodgit/sevenzip v1.6.0 // indirect
 	github.com/bodgit/windows v1.0.1 // indirect
+	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dsnet/compress v0.0.2-0.20230904184137-39efe44ab707 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
@@ -35,11 +42,8 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rivo/uniseg v0.4.4 // indirect
 	github.com/sorairolake/lzip-go v0.3.5 // indirect
-	github.com/ulikunitz/xz v0.5.14 // indirect
 	go4.org v0.0.0-20230225012048-214862532bf5 // indirect
-	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/term v0.30.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
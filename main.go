@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"crhuber/kelp/pkg/bundle"
 	"crhuber/kelp/pkg/config"
 	"crhuber/kelp/pkg/install"
+	"crhuber/kelp/pkg/output"
+	"crhuber/kelp/pkg/shim"
 	"crhuber/kelp/pkg/types"
 	"crhuber/kelp/pkg/utils"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/urfave/cli/v3"
 )
@@ -23,8 +28,7 @@ var (
 func main() {
 
 	// default config
-	var home, _ = os.UserHomeDir()
-	var KelpConf = filepath.Join(home, "/.kelp/kelp.json")
+	var KelpConf = config.DefaultPath()
 
 	if types.GetCapabilities() == nil {
 		fmt.Println("Sorry, your OS is not yet supported.")
@@ -42,6 +46,100 @@ func main() {
 				Usage:   "path to kelp config file",
 				Sources: cli.EnvVars("KELP_CONFIG"),
 			},
+			&cli.StringFlag{
+				Name:    "bin-dir",
+				Usage:   "directory binaries are installed to",
+				Sources: cli.EnvVars("KELP_BIN_DIR"),
+			},
+			&cli.StringFlag{
+				Name:    "cache-dir",
+				Usage:   "directory downloads are cached in",
+				Sources: cli.EnvVars("KELP_CACHE_DIR"),
+			},
+			&cli.IntFlag{
+				Name:    "parallelism",
+				Aliases: []string{"j"},
+				Usage:   "number of packages bulk commands work on at once",
+				Sources: cli.EnvVars("KELP_PARALLELISM"),
+			},
+			&cli.StringFlag{
+				Name:    "channel",
+				Usage:   "default release channel: latest or prerelease",
+				Sources: cli.EnvVars("KELP_DEFAULT_CHANNEL"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "prefer",
+				Usage:   "rank release assets containing this text higher, ie musl",
+				Sources: cli.EnvVars("KELP_ASSET_PREFERENCES"),
+			},
+			&cli.StringFlag{
+				Name:    "proxy",
+				Usage:   "proxy url used for all requests",
+				Sources: cli.EnvVars("KELP_PROXY"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "no-proxy",
+				Usage:   "host, domain or CIDR range reached without the proxy",
+				Sources: cli.EnvVars("KELP_NO_PROXY"),
+			},
+			&cli.StringFlag{
+				Name:    "ca-bundle",
+				Usage:   "PEM file of extra CA certificates to trust",
+				Sources: cli.EnvVars("KELP_CA_BUNDLE"),
+			},
+			&cli.StringFlag{
+				Name:    "client-cert",
+				Usage:   "PEM file of a client certificate for mutual TLS",
+				Sources: cli.EnvVars("KELP_CLIENT_CERT"),
+			},
+			&cli.StringFlag{
+				Name:    "client-key",
+				Usage:   "PEM file of the client certificate's key, if not in the certificate file",
+				Sources: cli.EnvVars("KELP_CLIENT_KEY"),
+			},
+			&cli.StringFlag{
+				Name:    "timeout",
+				Usage:   "give up on a server that doesn't respond or stalls for this long, ie 30s or 2m",
+				Sources: cli.EnvVars("KELP_TIMEOUT"),
+			},
+			&cli.StringFlag{
+				Name:      "output",
+				Aliases:   []string{"o"},
+				Value:     output.Table,
+				Usage:     "output format of list, get, doctor and outdated: table, json or yaml",
+				Sources:   cli.EnvVars("KELP_OUTPUT"),
+				Validator: output.Validate,
+			},
+			&cli.StringFlag{
+				Name:    "metadata-ttl",
+				Usage:   "how long latest release lookups are cached, ie 15m",
+				Sources: cli.EnvVars("KELP_METADATA_TTL"),
+			},
+			&cli.StringFlag{
+				Name:    "trusted-root",
+				Usage:   "sigstore trusted_root.json keyless cosign signatures are checked against",
+				Sources: cli.EnvVars("KELP_TRUSTED_ROOT"),
+			},
+			&cli.BoolFlag{
+				Name:    "offline",
+				Usage:   "install from the cache only without touching the network",
+				Sources: cli.EnvVars("KELP_OFFLINE"),
+			},
+			&cli.BoolFlag{
+				Name:    "shims",
+				Usage:   "install shims that run the version pinned for the current directory",
+				Sources: cli.EnvVars("KELP_SHIMS"),
+			},
+			&cli.BoolFlag{
+				Name:    "auto-install",
+				Usage:   "let shims install missing pinned versions",
+				Sources: cli.EnvVars("KELP_AUTO_INSTALL"),
+			},
+			&cli.BoolFlag{
+				Name:    "scripts",
+				Usage:   "install executable scripts from release archives as well as binaries",
+				Sources: cli.EnvVars("KELP_SCRIPTS"),
+			},
 		},
 		Commands: []*cli.Command{
 			{
@@ -51,8 +149,7 @@ func main() {
 					&cli.StringFlag{
 						Name:    "release",
 						Aliases: []string{"r"},
-						Value:   "latest",
-						Usage:   "release for package",
+						Usage:   "release for package (default: the configured channel)",
 					},
 					&cli.BoolFlag{
 						Name:    "install",
@@ -61,7 +158,7 @@ func main() {
 						Usage:   "also install package",
 					},
 				},
-				Action: func(_ context.Context, cmd *cli.Command) error {
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 
 					project := cmd.Args().First()
 					ownerRepo := strings.Split(project, "/")
@@ -70,39 +167,51 @@ func main() {
 
 					}
 
+					// load config
+					kc, err := loadConfig(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+
 					// resolve release version
 					releaseFlag := cmd.String("release")
+					if releaseFlag == "" {
+						releaseFlag = config.Active.DefaultChannel
+					}
 					var actualRelease string
-					if releaseFlag == "latest" {
-						// Get the actual latest release version from GitHub
-						latestRelease, err := utils.GetGithubRelease(ownerRepo[0], ownerRepo[1], "latest")
+					if releaseFlag == config.ChannelLatest || releaseFlag == config.ChannelPrerelease {
+						// Get the actual release version for the channel from GitHub
+						latestRelease, err := config.Releases.Get(ctx, config.HTTPClient, ownerRepo[0], ownerRepo[1], releaseFlag)
 						if err != nil {
-							return fmt.Errorf("failed to get latest release for %s/%s: %s", ownerRepo[0], ownerRepo[1], err)
+							return fmt.Errorf("failed to get %s release for %s/%s: %s", releaseFlag, ownerRepo[0], ownerRepo[1], err)
 						}
 						actualRelease = latestRelease.TagName
 					} else {
 						actualRelease = releaseFlag
 					}
 
-					// load config
-					kc, err := config.Load(cmd.String("config"))
-					if err != nil {
-						return fmt.Errorf("%s", err)
+					if kp, err := kc.GetPackage(project); err == nil && kp.Layer != config.LocalLayer {
+						fmt.Printf("Overriding package from %s.\n", kp.Layer)
 					}
-
 					err = kc.AddPackage(ownerRepo[0], ownerRepo[1], actualRelease)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
+					fmt.Println("Config added!")
 					// save config
 					err = kc.Save()
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
+					fmt.Println("Config saved.")
 
 					// auto install
 					if cmd.Bool("install") {
-						err = install.Install(ownerRepo[0], ownerRepo[1], actualRelease)
+						installer, err := newInstaller(os.Stdout, kc)
+						if err != nil {
+							return err
+						}
+						err = installer.Install(ctx, ownerRepo[0], ownerRepo[1], actualRelease)
 						if err != nil {
 							return err
 						}
@@ -114,14 +223,14 @@ func main() {
 			{
 				Name:  "browse",
 				Usage: "browse to project github page",
-				Action: func(_ context.Context, cmd *cli.Command) error {
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 					project := cmd.Args().First()
 					if project == "" {
 						return errors.New("project argument required")
 					}
 
 					// load config
-					kc, err := config.Load(cmd.String("config"))
+					kc, err := loadConfig(ctx, cmd)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
@@ -130,28 +239,246 @@ func main() {
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
-					config.Browse(p.Owner, p.Repo)
-					return nil
+					fmt.Printf("Opening https://github.com/%s/%s\n", p.Owner, p.Repo)
+					return config.Browse(p.Owner, p.Repo)
+				},
+			},
+			{
+				Name:  "bundle",
+				Usage: "carry packages to machines without internet access",
+				Commands: []*cli.Command{
+					{
+						Name:      "create",
+						Usage:     "download every package in the config for each platform into a bundle",
+						ArgsUsage: "<out.tar>",
+						Flags: []cli.Flag{
+							&cli.StringSliceFlag{
+								Name:  "platform",
+								Usage: "os/arch to bundle assets for, ie linux/amd64,darwin/arm64 (default: this machine)",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							dest := cmd.Args().First()
+							if dest == "" {
+								return errors.New("bundle path argument required")
+							}
+							platforms := []*types.Capabilities{}
+							for _, p := range cmd.StringSlice("platform") {
+								platform, err := types.ParsePlatform(p)
+								if err != nil {
+									return err
+								}
+								platforms = append(platforms, platform)
+							}
+							if len(platforms) == 0 {
+								platforms = append(platforms, types.GetCapabilities())
+							}
+
+							// load config
+							kc, err := loadConfig(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("%s", err)
+							}
+							sources := []bundle.Source{}
+							for _, kp := range kc.AllPackages() {
+								sources = append(sources, bundle.Source{Owner: kp.Owner, Repo: kp.Repo, Release: kp.Release})
+							}
+							installer, err := newInstaller(os.Stdout, kc)
+							if err != nil {
+								return err
+							}
+
+							// write next to the destination so a failed bundle never replaces a good one
+							tmp := dest + ".part"
+							out, err := os.Create(tmp)
+							if err != nil {
+								return err
+							}
+							m, err := bundle.Create(ctx, installer, platforms, sources, out)
+							if closeErr := out.Close(); err == nil {
+								err = closeErr
+							}
+							if err != nil {
+								os.Remove(tmp)
+								return err
+							}
+							err = os.Rename(tmp, dest)
+							if err != nil {
+								return err
+							}
+							fmt.Printf("📦 Bundled %d packages for %s into %s\n", len(m.Packages), strings.Join(m.Platforms, ", "), dest)
+							return nil
+						},
+					},
+					{
+						Name:      "install",
+						Usage:     "install the packages in a bundle without touching the network",
+						ArgsUsage: "<bundle.tar>",
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							src := cmd.Args().First()
+							if src == "" {
+								return errors.New("bundle path argument required")
+							}
+							kc, err := applySettings(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("%s", err)
+							}
+							f, err := os.Open(src)
+							if err != nil {
+								return err
+							}
+							defer f.Close()
+							installer, err := newInstaller(os.Stdout, kc)
+							if err != nil {
+								return err
+							}
+							m, err := bundle.Install(ctx, installer, f)
+							if err != nil {
+								return err
+							}
+							fmt.Printf("📦 Installed %d packages from %s\n", len(m.Packages), src)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "manage the kelp config file",
+				Commands: []*cli.Command{
+					{
+						Name:      "convert",
+						Usage:     "convert the config to json, yaml or toml, picked by file extension",
+						ArgsUsage: "<path>",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:    "force",
+								Aliases: []string{"f"},
+								Usage:   "overwrite the destination if it exists",
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							dest := cmd.Args().First()
+							if dest == "" {
+								return errors.New("destination path argument required")
+							}
+							if utils.FileExists(dest) && !cmd.Bool("force") {
+								return fmt.Errorf("%s already exists, use --force to overwrite it", dest)
+							}
+
+							// load config
+							kc, err := loadConfig(ctx, cmd)
+							if err != nil {
+								return fmt.Errorf("%s", err)
+							}
+							err = kc.Convert(dest)
+							if err != nil {
+								return fmt.Errorf("%s", err)
+							}
+							fmt.Printf("Converted %s to %s. Point kelp at it with --config or KELP_CONFIG.\n", kc.Path, dest)
+							return nil
+						},
+					},
 				},
 			},
 			{
 				Name:  "doctor",
 				Usage: "checks if packages are installed properly",
-				Action: func(_ context.Context, cmd *cli.Command) error {
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 					// load config
-					kc, err := config.Load(cmd.String("config"))
+					kc, err := loadConfig(ctx, cmd)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
-					kc.Doctor()
-					return nil
+					return output.Write(os.Stdout, cmd.String("output"), kc.Doctor())
+
+				},
+			},
+			{
+				Name:      "download",
+				Usage:     "download the release asset of a package to the cache without installing it",
+				ArgsUsage: "<package>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:      "platform",
+						Usage:     "os/arch to download the asset for, ie linux/amd64 (default: this machine)",
+						Validator: validatePlatform,
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					project := cmd.Args().First()
+					if project == "" {
+						return errors.New("project argument required")
+					}
 
+					// load config
+					kc, err := loadConfig(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					kp, err := kc.GetPackage(project)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					installer, err := newInstaller(os.Stderr, kc)
+					if err != nil {
+						return err
+					}
+					if cmd.IsSet("platform") {
+						installer.Platform, _ = types.ParsePlatform(cmd.String("platform"))
+					}
+					download, err := installer.Download(ctx, kp.Owner, kp.Repo, kp.Release)
+					if err != nil {
+						return err
+					}
+					// print only the path so scripts can pick it up
+					fmt.Println(download.Path)
+					return nil
+				},
+			},
+			{
+				Name:            "exec",
+				Usage:           "run a tool at the version pinned by the project manifest",
+				ArgsUsage:       "<tool> [args...]",
+				SkipFlagParsing: true,
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					tool := cmd.Args().First()
+					if tool == "" {
+						return errors.New("tool argument required")
+					}
+					kc, err := applySettings(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					wd, err := os.Getwd()
+					if err != nil {
+						return err
+					}
+					binary, err := config.ResolveBinary(tool, wd, kc)
+					var missing *config.NotInstalledError
+					if errors.As(err, &missing) && config.Active.UseAutoInstall() {
+						// keep stdout for the tool itself
+						installer, err := newInstaller(os.Stderr, kc, missing.Package)
+						if err != nil {
+							return err
+						}
+						kp := missing.Package
+						err = installer.InstallVersion(ctx, kp.Owner, kp.Repo, kp.Release)
+						if err != nil {
+							return err
+						}
+						binary, err = config.ResolveBinary(tool, wd, kc)
+					}
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					return syscall.Exec(binary, cmd.Args().Slice(), os.Environ())
 				},
 			},
 			{
 				Name:  "get",
 				Usage: "get package details",
-				Action: func(_ context.Context, cmd *cli.Command) error {
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 
 					project := cmd.Args().First()
 					if project == "" {
@@ -159,7 +486,7 @@ func main() {
 					}
 
 					// load config
-					kc, err := config.Load(cmd.String("config"))
+					kc, err := loadConfig(ctx, cmd)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
@@ -169,45 +496,133 @@ func main() {
 						return fmt.Errorf("%s", err)
 					}
 
-					fmt.Printf("[%s/%s]\n", p.Owner, p.Repo)
-					fmt.Printf("Release: %s\n", p.Release)
-					fmt.Printf("Description: %s\n", p.Description)
-					fmt.Printf("Url: https://github.com/%s/%s\n", p.Owner, p.Repo)
-					fmt.Printf("Binary: %s\n", p.Binary)
-					fmt.Printf("Updated At: %s\n", p.UpdatedAt)
-					return nil
+					return output.Write(os.Stdout, cmd.String("output"), p.Details())
 				},
 			},
 			{
 				Name:  "init",
 				Usage: "initialize kelp",
-				Action: func(_ context.Context, cmd *cli.Command) error {
-					err := config.Initialize(cmd.String("config"))
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "shell",
+						Usage: "add kelp shellenv to the startup file of your shell",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					_, err := applySettings(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					created, err := config.Initialize(cmd.String("config"))
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
+					if created {
+						fmt.Println("Created Kelp config file.")
+					} else {
+						fmt.Println("Skipping Kelp config file creation since one alredy exists...")
+					}
+					fmt.Println("🌱 Kelp Initialized!")
+					shell := config.DetectShell()
+					kelp, err := os.Executable()
+					if err != nil {
+						kelp = "kelp"
+					}
+					if !cmd.Bool("shell") {
+						fmt.Printf("🗒  Add Kelp to your path by running kelp init --shell, or adding this to your shell's startup file:\n%s\n", config.EvalLine(shell, kelp))
+						return nil
+					}
+					rc, added, err := config.AddToShell(shell, kelp)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					if added {
+						fmt.Printf("🐚 Added kelp to %s, open a new shell to use it.\n", rc)
+					} else {
+						fmt.Printf("🐚 %s already sets up kelp.\n", rc)
+					}
 					return nil
 				},
 			},
 			{
 				Name:  "inspect",
 				Usage: "inspect kelp bin directory",
-				Action: func(_ context.Context, _ *cli.Command) error {
-					config.Inspect()
-					return nil
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					_, err := applySettings(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					return config.Inspect()
 				},
 			},
 			{
 				Name:  "install",
-				Usage: "install kelp package",
-				Action: func(_ context.Context, cmd *cli.Command) error {
+				Usage: "install kelp package, or every package pinned by the project manifest",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:      "platform",
+						Usage:     "os/arch to install binaries for, ie linux/amd64. Needs --bin-dir when not this machine",
+						Validator: validatePlatform,
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 					project := cmd.Args().First()
+
+					// inside a project, install its pinned versions
+					pc, err := config.CurrentProject()
+					if err != nil && !errors.Is(err, config.ErrNoProject) {
+						return fmt.Errorf("%s", err)
+					}
+					if pc != nil {
+						kc, err := applySettings(ctx, cmd)
+						if err != nil {
+							return fmt.Errorf("%s", err)
+						}
+						var packages []config.KelpPackage
+						if project == "" {
+							packages = pc.Packages
+						} else if kp, err := pc.GetPackage(project); err == nil {
+							packages = append(packages, kp)
+						}
+						// each version not yet in the store or the release cache
+						// needs a github lookup
+						calls := 0
+						for _, kp := range packages {
+							if !strings.HasPrefix(kp.Release, "http") && !utils.DirExists(config.StorePath(kp.Owner, kp.Repo, kp.Release)) && !config.Releases.Fresh(kp.Owner, kp.Repo, kp.Release) {
+								calls++
+							}
+						}
+						err = utils.CheckGithubBudget(ctx, config.HTTPClient, calls)
+						if err != nil {
+							return fmt.Errorf("%s", err)
+						}
+						installer, foreign, err := platformInstaller(cmd, os.Stdout, kc, pc.Packages...)
+						if err != nil {
+							return err
+						}
+						// binaries for another platform can't go in the store this
+						// machine runs tools from
+						installVersion := installer.InstallVersion
+						if foreign {
+							installVersion = installer.Install
+						}
+						for _, kp := range packages {
+							err = installVersion(ctx, kp.Owner, kp.Repo, kp.Release)
+							if err != nil {
+								return err
+							}
+						}
+						if len(packages) > 0 {
+							return nil
+						}
+					}
+
 					if project == "" {
 						return errors.New("project argument required")
 					}
 
 					// load config
-					kc, err := config.Load(cmd.String("config"))
+					kc, err := loadConfig(ctx, cmd)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
@@ -215,7 +630,11 @@ func main() {
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
-					err = install.Install(kp.Owner, kp.Repo, kp.Release)
+					installer, _, err := platformInstaller(cmd, os.Stdout, kc)
+					if err != nil {
+						return err
+					}
+					err = installer.Install(ctx, kp.Owner, kp.Repo, kp.Release)
 					if err != nil {
 						return err
 					}
@@ -227,28 +646,43 @@ func main() {
 				Name:    "list",
 				Aliases: []string{"ls"},
 				Usage:   "list kelp packages",
-				Action: func(_ context.Context, cmd *cli.Command) error {
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 					// load config
-					kc, err := config.Load(cmd.String("config"))
+					kc, err := loadConfig(ctx, cmd)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
-					kc.List()
-					return nil
+					return output.Write(os.Stdout, cmd.String("output"), kc.List())
+				},
+			},
+			{
+				Name:  "outdated",
+				Usage: "list packages with a newer release",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					// load config
+					kc, err := loadConfig(ctx, cmd)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					report, err := kc.Outdated(ctx)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					return output.Write(os.Stdout, cmd.String("output"), report)
 				},
 			},
 			{
 				Name:    "remove",
 				Aliases: []string{"rm"},
 				Usage:   "remove a package from config and disk",
-				Action: func(_ context.Context, cmd *cli.Command) error {
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 					project := cmd.Args().First()
 					if project == "" {
 						return errors.New("project argument required")
 					}
 
 					// load config
-					kc, err := config.Load(cmd.String("config"))
+					kc, err := loadConfig(ctx, cmd)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
@@ -258,16 +692,18 @@ func main() {
 					}
 
 					// remove from config
-					err = kc.RemovePackage(kp.Repo)
+					err = kc.RemovePackage(kp.Owner + "/" + kp.Repo)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
+					fmt.Printf("Package %s removed\n", project)
 
 					// save config
 					err = kc.Save()
 					if err != nil {
 						return fmt.Errorf("error saving: %s", err)
 					}
+					fmt.Println("Config saved.")
 					return nil
 				},
 			},
@@ -294,31 +730,58 @@ func main() {
 						Usage:   "alias of binary",
 					},
 				},
-				Action: func(_ context.Context, cmd *cli.Command) error {
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 					project := cmd.Args().First()
 					if project == "" {
 						return errors.New("project argument required")
 					}
 
 					// load config
-					kc, err := config.Load(cmd.String("config"))
+					kc, err := loadConfig(ctx, cmd)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
 
+					if kp, err := kc.GetPackage(project); err == nil && kp.Layer != config.LocalLayer {
+						fmt.Printf("Overriding package from %s.\n", kp.Layer)
+					}
 					err = kc.SetPackage(project, cmd.String("release"), cmd.String("description"), cmd.String("binary"))
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
+					fmt.Println("Config set!")
 					// save config
 					err = kc.Save()
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
+					fmt.Println("Config saved.")
 
 					return nil
 				},
 			},
+			{
+				Name:      "shellenv",
+				Usage:     "print the shell code that puts kelp binaries, man pages and completions in your environment",
+				ArgsUsage: "[bash|zsh|fish|powershell]",
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					// every new shell runs this, so it must not wait on the network
+					err := applyLocalSettings(cmd)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					shell := cmd.Args().First()
+					if shell == "" {
+						shell = config.DetectShell()
+					}
+					env, err := config.ShellEnv(shell)
+					if err != nil {
+						return fmt.Errorf("%s", err)
+					}
+					fmt.Print(env)
+					return nil
+				},
+			},
 			{
 				Name:  "update",
 				Usage: "update kelp package in config",
@@ -330,14 +793,14 @@ func main() {
 						Usage:   "also install package",
 					},
 				},
-				Action: func(_ context.Context, cmd *cli.Command) error {
+				Action: func(ctx context.Context, cmd *cli.Command) error {
 					project := cmd.Args().First()
 					if project == "" {
 						return errors.New("project argument required")
 					}
 
 					// load config
-					kc, err := config.Load(cmd.String("config"))
+					kc, err := loadConfig(ctx, cmd)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
@@ -351,7 +814,7 @@ func main() {
 						return errors.New("update functionality not supported for http packages")
 					}
 
-					ghr, err := utils.GetGithubRelease(kp.Owner, kp.Repo, "latest")
+					ghr, err := config.Releases.Get(ctx, config.HTTPClient, kp.Owner, kp.Repo, config.Active.DefaultChannel)
 					if err != nil {
 						return fmt.Errorf("%s", err)
 					}
@@ -370,20 +833,26 @@ func main() {
 					// Taking input from user
 					fmt.Scanln(&confirmation)
 					if confirmation == "y" || confirmation == "yes" {
-						err = kc.SetPackage(kp.Repo, ghr.TagName, "", "")
+						err = kc.SetPackage(kp.Owner+"/"+kp.Repo, ghr.TagName, "", "")
 						if err != nil {
 							return fmt.Errorf("%s", err)
 						}
+						fmt.Println("Config set!")
 						// save config
 						err = kc.Save()
 						if err != nil {
 							return fmt.Errorf("%s", err)
 						}
+						fmt.Println("Config saved.")
 					}
 
 					// auto install
 					if cmd.Bool("install") {
-						err = install.Install(kp.Owner, kp.Repo, ghr.TagName)
+						installer, err := newInstaller(os.Stdout, kc)
+						if err != nil {
+							return err
+						}
+						err = installer.Install(ctx, kp.Owner, kp.Repo, ghr.TagName)
 						if err != nil {
 							return err
 						}
@@ -395,7 +864,188 @@ func main() {
 		},
 	}
 
-	if err := app.Run(context.Background(), os.Args); err != nil {
+	// Ctrl-C cancels the running command, partial downloads are kept to resume
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := app.Run(ctx, os.Args); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// flagSettings collects the global settings overridden on the command line or
+// through KELP_* environment variables.
+func flagSettings(cmd *cli.Command) config.Settings {
+	s := config.Settings{}
+	if cmd.IsSet("bin-dir") {
+		s.BinDir = cmd.String("bin-dir")
+	}
+	if cmd.IsSet("cache-dir") {
+		s.CacheDir = cmd.String("cache-dir")
+	}
+	if cmd.IsSet("parallelism") {
+		s.Parallelism = cmd.Int("parallelism")
+	}
+	if cmd.IsSet("channel") {
+		s.DefaultChannel = cmd.String("channel")
+	}
+	if cmd.IsSet("prefer") {
+		s.AssetPreferences = cmd.StringSlice("prefer")
+	}
+	if cmd.IsSet("proxy") {
+		s.Proxy = cmd.String("proxy")
+	}
+	if cmd.IsSet("no-proxy") {
+		s.NoProxy = cmd.StringSlice("no-proxy")
+	}
+	if cmd.IsSet("ca-bundle") {
+		s.CABundle = cmd.String("ca-bundle")
+	}
+	if cmd.IsSet("client-cert") {
+		s.ClientCert = cmd.String("client-cert")
+	}
+	if cmd.IsSet("client-key") {
+		s.ClientKey = cmd.String("client-key")
+	}
+	if cmd.IsSet("timeout") {
+		s.Timeout = cmd.String("timeout")
+	}
+	if cmd.IsSet("metadata-ttl") {
+		s.MetadataTTL = cmd.String("metadata-ttl")
+	}
+	if cmd.IsSet("trusted-root") {
+		s.TrustedRoot = cmd.String("trusted-root")
+	}
+	if cmd.IsSet("offline") {
+		offline := cmd.Bool("offline")
+		s.Offline = &offline
+	}
+	if cmd.IsSet("shims") {
+		shims := cmd.Bool("shims")
+		s.Shims = &shims
+	}
+	if cmd.IsSet("auto-install") {
+		autoInstall := cmd.Bool("auto-install")
+		s.AutoInstall = &autoInstall
+	}
+	if cmd.IsSet("scripts") {
+		scripts := cmd.Bool("scripts")
+		s.Scripts = &scripts
+	}
+	return s
+}
+
+// loadConfig loads the kelp config with its includes and applies its
+// settings, overridden by global flags and KELP_* environment variables.
+func loadConfig(ctx context.Context, cmd *cli.Command) (*config.KelpConfig, error) {
+	kc, err := config.Load(cmd.String("config"))
+	if err != nil {
+		return nil, err
+	}
+	// apply the user's own settings first so includes are fetched through
+	// the configured proxy
+	err = config.Apply(kc.Settings.Merge(flagSettings(cmd)))
+	if err != nil {
+		return nil, err
+	}
+	err = kc.LoadIncludes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range kc.Warnings {
+		fmt.Fprintf(os.Stderr, "⚠️  %s\n", warning)
+	}
+	err = config.Apply(kc.EffectiveSettings().Merge(flagSettings(cmd)))
+	if err != nil {
+		return nil, err
+	}
+	return kc, nil
+}
+
+// applySettings applies settings for commands that also work before a config
+// file exists. It returns the config when there is one.
+func applySettings(ctx context.Context, cmd *cli.Command) (*config.KelpConfig, error) {
+	if utils.FileExists(cmd.String("config")) {
+		return loadConfig(ctx, cmd)
+	}
+	return nil, config.Apply(flagSettings(cmd))
+}
+
+// applyLocalSettings applies the settings of the user's own config, flags
+// and environment without loading includes, for commands that must not
+// touch the network.
+func applyLocalSettings(cmd *cli.Command) error {
+	s := flagSettings(cmd)
+	if utils.FileExists(cmd.String("config")) {
+		kc, err := config.Load(cmd.String("config"))
+		if err != nil {
+			return err
+		}
+		s = kc.Settings.Merge(s)
+	}
+	return config.Apply(s)
+}
+
+// validatePlatform checks a --platform flag is a supported os/arch.
+func validatePlatform(platform string) error {
+	_, err := types.ParsePlatform(platform)
+	return err
+}
+
+// platformInstaller returns an installer for the platform given with
+// --platform and reports whether that is another machine than this one.
+// Binaries for another machine are installed straight into the bin dir, which
+// must be given explicitly so they don't shadow this machine's tools.
+func platformInstaller(cmd *cli.Command, out io.Writer, kc *config.KelpConfig, extra ...config.KelpPackage) (*install.Installer, bool, error) {
+	installer, err := newInstaller(out, kc, extra...)
+	if err != nil || !cmd.IsSet("platform") {
+		return installer, false, err
+	}
+	platform, err := types.ParsePlatform(cmd.String("platform"))
+	if err != nil {
+		return nil, false, err
+	}
+	if platform.String() == types.GetCapabilities().String() {
+		return installer, false, nil
+	}
+	if !cmd.IsSet("bin-dir") {
+		return nil, false, fmt.Errorf("installing %s binaries into %s would shadow this machine's tools, pass --bin-dir", platform, config.KelpBin)
+	}
+	installer.Platform = platform
+	// shims, man pages and completions are for this machine
+	installer.ShimTarget = ""
+	installer.ShareDir = ""
+	return installer, true, nil
+}
+
+// newInstaller returns an installer for the active settings that reports its
+// progress to out. Releases are checked against the trust of the packages in
+// kc, which is nil without a config file, and extra, such as project pins.
+func newInstaller(out io.Writer, kc *config.KelpConfig, extra ...config.KelpPackage) (*install.Installer, error) {
+	packages := extra
+	if kc != nil {
+		packages = append(kc.AllPackages(), extra...)
+	}
+	installer := &install.Installer{
+		BinDir:           config.KelpBin,
+		CacheDir:         config.KelpCache,
+		StoreDir:         config.KelpStore,
+		ShareDir:         config.KelpShare,
+		Client:           config.HTTPClient,
+		Releases:         config.Releases,
+		Offline:          config.Active.IsOffline(),
+		Trust:            config.Trust(packages),
+		TrustedRoot:      config.Active.TrustedRoot,
+		VerifyDir:        config.KelpVerified,
+		Events:           &install.Console{Out: out},
+		AssetPreferences: config.Active.AssetPreferences,
+		Scripts:          config.Active.UseScripts(),
+	}
+	if config.Active.UseShims() {
+		target, err := shim.Executable()
+		if err != nil {
+			return nil, err
+		}
+		installer.ShimTarget = target
+	}
+	return installer, nil
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Credential authenticates requests to a single host, either with a bearer
+// token or with a username and password.
+type Credential struct {
+	Host     string
+	Token    string
+	Username string
+	Password string
+	// Source is where the credential was found.
+	Source string
+}
+
+// apply adds the credential to req.
+func (c Credential) apply(req *http.Request) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+		return
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+}
+
+// Store holds credentials by host. Credentials are only ever sent to the
+// host they were given for.
+type Store struct {
+	hosts map[string]Credential
+}
+
+// Load reads credentials from, in order of precedence, the GITHUB_TOKEN
+// environment variable for github.com, the kelp credentials file at path,
+// the gh CLI's hosts file and ~/.netrc. Only a malformed kelp credentials
+// file is an error, the others are skipped when they can't be read.
+func Load(path string) (*Store, error) {
+	s := &Store{hosts: map[string]Credential{}}
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		s.add(Credential{Host: "github.com", Token: token, Source: "GITHUB_TOKEN"})
+	}
+	err := s.loadKelp(path)
+	if err != nil {
+		return nil, err
+	}
+	s.loadGH(ghHostsPath())
+	s.loadNetrc(netrcPath())
+	return s, nil
+}
+
+// add keeps the first credential found for a host.
+func (s *Store) add(c Credential) {
+	c.Host = strings.ToLower(c.Host)
+	if _, ok := s.hosts[c.Host]; !ok {
+		s.hosts[c.Host] = c
+	}
+}
+
+// Lookup returns the credential for host. Credentials for a github host,
+// such as github.com, also cover its api at api.github.com.
+func (s *Store) Lookup(host string) (Credential, bool) {
+	if s == nil {
+		return Credential{}, false
+	}
+	host = strings.ToLower(host)
+	if c, ok := s.hosts[host]; ok {
+		return c, true
+	}
+	if parent, ok := strings.CutPrefix(host, "api."); ok {
+		c, ok := s.hosts[parent]
+		return c, ok
+	}
+	return Credential{}, false
+}
+
+// Transport returns a RoundTripper adding the credential for each request's
+// host. Every redirect passes through it again, so a token never follows a
+// redirect to another host.
+func (s *Store) Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{store: s, base: base}
+}
+
+type transport struct {
+	store *Store
+	base  http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, ok := t.store.Lookup(req.URL.Hostname())
+	// never send credentials in the clear or override ones already set
+	if !ok || req.URL.Scheme != "https" || req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	c.apply(req)
+	return t.base.RoundTrip(req)
+}
+
+// loadKelp reads the kelp credentials file. Each line holds a host followed
+// by either a token or a username and password, and # starts a comment.
+func (s *Store) loadKelp(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		switch len(fields) {
+		case 0:
+			continue
+		case 2:
+			s.add(Credential{Host: fields[0], Token: fields[1], Source: path})
+		case 3:
+			s.add(Credential{Host: fields[0], Username: fields[1], Password: fields[2], Source: path})
+		default:
+			return fmt.Errorf("%s: line %d: expected a host and a token, or a host, username and password", path, line)
+		}
+	}
+	return scanner.Err()
+}
+
+func ghHostsPath() string {
+	if dir := os.Getenv("GH_CONFIG_DIR"); dir != "" {
+		return filepath.Join(dir, "hosts.yml")
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "gh", "hosts.yml")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "gh", "hosts.yml")
+}
+
+// loadGH reads the tokens gh keeps in its hosts file. Tokens gh stores in
+// the system keyring are not available.
+func (s *Store) loadGH(path string) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	hosts := map[string]struct {
+		OAuthToken string `yaml:"oauth_token"`
+	}{}
+	if yaml.Unmarshal(bs, &hosts) != nil {
+		return
+	}
+	for host, h := range hosts {
+		if h.OAuthToken != "" {
+			s.add(Credential{Host: host, Token: h.OAuthToken, Source: path})
+		}
+	}
+}
+
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".netrc")
+}
+
+// loadNetrc reads machine entries from a netrc file. The default entry is
+// ignored as it would send the same password to every host.
+func (s *Store) loadNetrc(path string) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var c *Credential
+	done := func() {
+		if c != nil && c.Host != "" {
+			s.add(*c)
+		}
+		c = nil
+	}
+	fields := strings.Fields(string(bs))
+	for i := 0; i < len(fields); i++ {
+		value := ""
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		switch fields[i] {
+		case "machine":
+			done()
+			c = &Credential{Host: value, Source: path}
+			i++
+		case "default":
+			done()
+			c = &Credential{}
+		case "login":
+			if c != nil {
+				c.Username = value
+			}
+			i++
+		case "password":
+			if c != nil {
+				c.Password = value
+			}
+			i++
+		case "account":
+			i++
+		case "macdef":
+			// macros run until a blank line, which Fields has lost, so stop
+			done()
+			return
+		}
+	}
+	done()
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+}
+
+func TestLoad(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("NETRC", "")
+	t.Setenv("GH_CONFIG_DIR", "")
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GITHUB_TOKEN", "env-token")
+
+	kelp := filepath.Join(home, ".kelp", "credentials")
+	writeFile(t, kelp, "# private mirror\nmirror.corp.example.com alice s3cret\nghe.corp.example.com kelp-token # enterprise\n")
+	writeFile(t, filepath.Join(home, ".config", "gh", "hosts.yml"), "github.com:\n    user: alice\n    oauth_token: gh-token\nghe.corp.example.com:\n    oauth_token: gh-ghe-token\n")
+	writeFile(t, filepath.Join(home, ".netrc"), "machine files.example.com login bob password hunter2\ndefault login anonymous password leak\n")
+
+	s, err := Load(kelp)
+	require.NoError(t, err)
+
+	c, ok := s.Lookup("api.github.com")
+	require.True(t, ok)
+	require.Equal(t, "env-token", c.Token)
+
+	c, ok = s.Lookup("GHE.corp.example.com")
+	require.True(t, ok)
+	require.Equal(t, "kelp-token", c.Token)
+
+	c, ok = s.Lookup("mirror.corp.example.com")
+	require.True(t, ok)
+	require.Equal(t, "alice", c.Username)
+	require.Equal(t, "s3cret", c.Password)
+
+	c, ok = s.Lookup("files.example.com")
+	require.True(t, ok)
+	require.Equal(t, "hunter2", c.Password)
+
+	// the netrc default entry is never used
+	_, ok = s.Lookup("objects.githubusercontent.com")
+	require.False(t, ok)
+
+	writeFile(t, kelp, "just-a-host\n")
+	_, err = Load(kelp)
+	require.ErrorContains(t, err, "line 1")
+}
+
+func TestTransportScopesCredentials(t *testing.T) {
+	seen := map[string]string{}
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen["other"] = r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+	_, otherPort, err := net.SplitHostPort(other.Listener.Addr().String())
+	require.NoError(t, err)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen["server"] = r.Header.Get("Authorization")
+		// redirect to another host, as github does for release assets
+		http.Redirect(w, r, "https://example.com:"+otherPort+"/asset", http.StatusFound)
+	}))
+	defer server.Close()
+
+	base := server.Client().Transport.(*http.Transport).Clone()
+	// example.com resolves to the other server, whose certificate covers it
+	base.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(addr); host == "example.com" {
+			addr = other.Listener.Addr().String()
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	s := &Store{hosts: map[string]Credential{}}
+	s.add(Credential{Host: "127.0.0.1", Token: "secret"})
+	client := &http.Client{Transport: s.Transport(base)}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "Bearer secret", seen["server"])
+	require.Empty(t, seen["other"])
+}
@@ -0,0 +1,275 @@
+package bundle
+
+import (
+	"archive/tar"
+	"context"
+	"crhuber/kelp/pkg/install"
+	"crhuber/kelp/pkg/types"
+	"crhuber/kelp/pkg/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestName is the file at the start of a bundle describing its contents.
+const ManifestName = "kelp-bundle.json"
+
+// Version is the bundle format this kelp writes.
+const Version = 1
+
+// Manifest describes the packages in a bundle.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Platforms the bundle has assets for, as os/arch.
+	Platforms []string  `json:"platforms"`
+	Packages  []Package `json:"packages"`
+}
+
+// Package is a bundled package.
+type Package struct {
+	Owner string `json:"owner"`
+	Repo  string `json:"repo"`
+	// Release is the tag the package resolved to, or the url it is
+	// installed from.
+	Release string `json:"release"`
+	// Assets maps each platform to the file in the bundle holding the
+	// package's asset for it.
+	Assets map[string]string `json:"assets"`
+	// Signatures are the files in the bundle holding the signatures of the
+	// assets, the checksum files they sign and their attestations. They are
+	// restored to the same place in the cache so bundled releases are
+	// verified as usual.
+	Signatures []string `json:"signatures,omitempty"`
+	// Metadata is the github release, so installing from the bundle makes
+	// no api calls. It is nil for packages installed from a url.
+	Metadata *types.GithubRelease `json:"metadata,omitempty"`
+}
+
+// Source is a package to put in a bundle.
+type Source struct {
+	Owner   string
+	Repo    string
+	Release string
+}
+
+// Create resolves every package for each platform, downloads the assets
+// through installer and writes them to w as a tar, preceded by a manifest.
+func Create(ctx context.Context, installer *install.Installer, platforms []*types.Capabilities, sources []Source, w io.Writer) (Manifest, error) {
+	m := Manifest{Version: Version, CreatedAt: time.Now().UTC()}
+	for _, p := range platforms {
+		m.Platforms = append(m.Platforms, p.String())
+	}
+
+	// bundle names of assets and where they were downloaded to
+	files := map[string]string{}
+	for _, src := range sources {
+		pkg := Package{Owner: src.Owner, Repo: src.Repo, Release: src.Release, Assets: map[string]string{}}
+		for _, platform := range platforms {
+			target := *installer
+			target.Platform = platform
+			download, err := target.Download(ctx, src.Owner, src.Repo, src.Release)
+			if err != nil {
+				return m, fmt.Errorf("%s/%s for %s: %w", src.Owner, src.Repo, platform, err)
+			}
+			if download.Release != nil {
+				// bundle the tag so every platform gets the same release
+				pkg.Release = download.Release.TagName
+				pkg.Metadata = download.Release
+			}
+			name := path.Join("assets", src.Owner, src.Repo, filepath.Base(download.Path))
+			pkg.Assets[platform.String()] = name
+			files[name] = download.Path
+			kept := []string{download.Attestations}
+			for _, sig := range download.Signatures {
+				kept = append(kept, sig.Path, sig.Signed)
+			}
+			for _, p := range kept {
+				rel, err := filepath.Rel(installer.CacheDir, p)
+				// only those downloaded for the package's trust
+				if p == "" || p == download.Path || err != nil || !utils.FileExists(p) {
+					continue
+				}
+				name := filepath.ToSlash(rel)
+				if _, ok := files[name]; !ok {
+					pkg.Signatures = append(pkg.Signatures, name)
+					files[name] = p
+				}
+			}
+		}
+		m.Packages = append(m.Packages, pkg)
+	}
+
+	tw := tar.NewWriter(w)
+	bs, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return m, err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: ManifestName, Mode: 0644, Size: int64(len(bs)), ModTime: m.CreatedAt})
+	if err != nil {
+		return m, err
+	}
+	if _, err := tw.Write(bs); err != nil {
+		return m, err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := addFile(tw, name, files[name])
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, tw.Close()
+}
+
+func addFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Install installs every package in the bundle read from r for the
+// installer's platform. The assets and release metadata are added to the
+// cache and installed from there without touching the network.
+func Install(ctx context.Context, installer *install.Installer, r io.Reader) (Manifest, error) {
+	if installer.Releases == nil {
+		return Manifest{}, errors.New("installing a bundle needs a release cache")
+	}
+	platform := installer.Platform
+	if platform == nil {
+		platform = types.GetCapabilities()
+	}
+
+	tr := tar.NewReader(r)
+	m, err := readManifest(tr)
+	if err != nil {
+		return m, err
+	}
+
+	// files needed for this platform by their name in the bundle, and where
+	// they go in the cache
+	wanted := map[string]string{}
+	for _, pkg := range m.Packages {
+		name, ok := pkg.Assets[platform.String()]
+		if !ok {
+			return m, fmt.Errorf("bundle has no %s asset for %s/%s, it was created for %s", platform, pkg.Owner, pkg.Repo, strings.Join(m.Platforms, ", "))
+		}
+		// only the base name is used so entries can't escape the cache
+		wanted[name] = filepath.Join(installer.CacheDir, path.Base(name))
+		for _, name := range pkg.Signatures {
+			rel := filepath.FromSlash(name)
+			if !strings.HasPrefix(name, "signatures/") || !filepath.IsLocal(rel) {
+				return m, fmt.Errorf("bundle has an invalid signature path %s", name)
+			}
+			wanted[name] = filepath.Join(installer.CacheDir, rel)
+		}
+	}
+	found := map[string]bool{}
+
+	err = os.MkdirAll(installer.CacheDir, 0755)
+	if err != nil {
+		return m, err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, fmt.Errorf("could not read bundle: %w", err)
+		}
+		dest, ok := wanted[hdr.Name]
+		if !ok {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return m, err
+		}
+		err = writeCached(dest, tr)
+		if err != nil {
+			return m, err
+		}
+		found[hdr.Name] = true
+	}
+	for name := range wanted {
+		if !found[name] {
+			return m, fmt.Errorf("bundle is missing %s", name)
+		}
+	}
+
+	offline := *installer
+	offline.Offline = true
+	for _, pkg := range m.Packages {
+		if pkg.Metadata != nil {
+			installer.Releases.Put(pkg.Owner, pkg.Repo, pkg.Release, *pkg.Metadata)
+		}
+		err := offline.Install(ctx, pkg.Owner, pkg.Repo, pkg.Release)
+		if err != nil {
+			return m, fmt.Errorf("%s/%s: %w", pkg.Owner, pkg.Repo, err)
+		}
+	}
+	return m, nil
+}
+
+func readManifest(tr *tar.Reader) (Manifest, error) {
+	m := Manifest{}
+	hdr, err := tr.Next()
+	if err != nil {
+		return m, fmt.Errorf("could not read bundle: %w", err)
+	}
+	if hdr.Name != ManifestName {
+		return m, fmt.Errorf("not a kelp bundle, it does not start with %s", ManifestName)
+	}
+	err = json.NewDecoder(tr).Decode(&m)
+	if err != nil {
+		return m, fmt.Errorf("invalid bundle manifest: %w", err)
+	}
+	if m.Version > Version {
+		return m, fmt.Errorf("bundle version %d is newer than this kelp supports (%d), upgrade kelp", m.Version, Version)
+	}
+	return m, nil
+}
+
+// writeCached writes r to path, replacing any earlier copy only once it is
+// complete.
+func writeCached(path string, r io.Reader) error {
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,83 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crhuber/kelp/pkg/install"
+	"crhuber/kelp/pkg/install/installtest"
+	"crhuber/kelp/pkg/types"
+	"crhuber/kelp/pkg/utils"
+	"debug/elf"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundle(t *testing.T) {
+	if !types.IsLinux() || runtime.GOARCH != "amd64" {
+		t.Skip("fixture binary is a linux amd64 executable")
+	}
+	exe := installtest.ELF(elf.EM_X86_64)
+	host := "tool_linux_" + runtime.GOARCH
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/download/") {
+			w.Write(exe)
+			return
+		}
+		asset := `{"name": %q, "size": %d, "url": "http://%s/download/%[1]s", "browser_download_url": "https://example.com/%[1]s"}`
+		fmt.Fprintf(w, `{"tag_name": "v1.0", "assets": [%s, %s]}`,
+			fmt.Sprintf(asset, host, len(exe), r.Host),
+			fmt.Sprintf(asset, "tool_darwin_arm64", len(exe), r.Host))
+	}))
+	defer server.Close()
+	defer func(api string) { utils.GithubAPI = api }(utils.GithubAPI)
+	utils.GithubAPI = server.URL
+
+	darwin, err := types.ParsePlatform("darwin/arm64")
+	require.NoError(t, err)
+	online := &install.Installer{CacheDir: t.TempDir(), Client: server.Client(), Releases: &utils.ReleaseCache{Dir: t.TempDir()}}
+	var buf bytes.Buffer
+	m, err := Create(context.Background(), online, []*types.Capabilities{types.GetCapabilities(), darwin}, []Source{{Owner: "foo", Repo: "tool", Release: "latest"}}, &buf)
+	require.NoError(t, err)
+	require.Equal(t, "v1.0", m.Packages[0].Release)
+	require.Equal(t, map[string]string{
+		"linux/" + runtime.GOARCH: "assets/foo/tool/" + host,
+		"darwin/arm64":            "assets/foo/tool/tool_darwin_arm64",
+	}, m.Packages[0].Assets)
+
+	// install on a machine that has never seen the package or the network
+	offline := &install.Installer{
+		BinDir:   t.TempDir(),
+		CacheDir: t.TempDir(),
+		Client:   utils.OfflineClient(),
+		Releases: &utils.ReleaseCache{Dir: t.TempDir()},
+	}
+	bs := buf.Bytes()
+	_, err = Install(context.Background(), offline, bytes.NewReader(bs))
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(offline.BinDir, host))
+	require.NoFileExists(t, filepath.Join(offline.CacheDir, "tool_darwin_arm64"))
+
+	// a platform that wasn't bundled fails clearly
+	offline.Platform, err = types.ParsePlatform("linux/riscv64")
+	require.NoError(t, err)
+	_, err = Install(context.Background(), offline, bytes.NewReader(bs))
+	require.ErrorContains(t, err, "no linux/riscv64 asset for foo/tool")
+}
+
+func TestInstallRejectsOtherArchives(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "README", Mode: 0644}))
+	require.NoError(t, tw.Close())
+	installer := &install.Installer{Releases: &utils.ReleaseCache{Dir: t.TempDir()}}
+	_, err := Install(context.Background(), installer, &buf)
+	require.ErrorContains(t, err, "not a kelp bundle")
+}
@@ -1,19 +1,19 @@
 package config
 
 import (
+	"bytes"
+	"context"
 	"crhuber/kelp/pkg/types"
 	"crhuber/kelp/pkg/utils"
+	"crhuber/kelp/pkg/verify"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"sort"
 	"strings"
-	"text/tabwriter"
 	"time"
 )
 
@@ -23,17 +23,68 @@ var KelpDir = filepath.Join(home, "/.kelp/")
 var KelpBin = filepath.Join(home, "/.kelp/bin/")
 var KelpCache = filepath.Join(home, "/.kelp/cache/")
 
+// KelpShare holds the man pages and shell completions of installed packages.
+var KelpShare = filepath.Join(home, "/.kelp/share/")
+
+// KelpVerified records the signature check of every installed release.
+var KelpVerified = filepath.Join(home, "/.kelp/verified/")
+
+// CurrentVersion is the config schema version written by Save.
+const CurrentVersion = 2
+
 type KelpConfig struct {
-	Path     string `json:"-"`
-	Packages []KelpPackage
+	Path     string        `json:"-" yaml:"-" toml:"-"`
+	Version  int           `json:"version" yaml:"version" toml:"version"`
+	Settings Settings      `json:"settings" yaml:"settings" toml:"settings"`
+	Include  []string      `json:"include,omitempty" yaml:"include,omitempty" toml:"include,omitempty"`
+	Packages []KelpPackage `json:"packages" yaml:"packages" toml:"packages"`
+
+	// Warnings are problems loading includes that did not stop kelp
+	Warnings []string `json:"-" yaml:"-" toml:"-"`
+
+	// layers are the included configs, lowest precedence first
+	layers []*KelpConfig
 }
+
 type KelpPackage struct {
-	Owner       string    `json:"Owner"`
-	Repo        string    `json:"Repo"`
-	Release     string    `json:"Release"`
-	UpdatedAt   time.Time `json:"UpdatedAt"`
-	Description string    `json:"Description"`
-	Binary      string    `json:"Binary"`
+	Owner       string    `json:"Owner" yaml:"Owner" toml:"Owner"`
+	Repo        string    `json:"Repo" yaml:"Repo" toml:"Repo"`
+	Release     string    `json:"Release" yaml:"Release" toml:"Release"`
+	UpdatedAt   time.Time `json:"UpdatedAt" yaml:"UpdatedAt" toml:"UpdatedAt"`
+	Description string    `json:"Description" yaml:"Description" toml:"Description"`
+	Binary      string    `json:"Binary" yaml:"Binary" toml:"Binary"`
+	// Trust is what the package's release signatures must verify against.
+	// Releases are installed without checking them when nil.
+	Trust *verify.Trust `json:"Trust,omitempty" yaml:"Trust,omitempty" toml:"Trust,omitempty"`
+	// Layer is the config the package was loaded from
+	Layer string `json:"-" yaml:"-" toml:"-"`
+}
+
+// matches reports whether name refers to the package, either as repo or
+// owner/repo.
+func (kp KelpPackage) matches(name string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) > 1 {
+		return kp.Owner == parts[0] && kp.Repo == parts[1]
+	}
+	return kp.Repo == name
+}
+
+// Trust returns the trust of every package that has one by owner/repo,
+// resolving key files relative to the home directory. Later packages win.
+func Trust(packages []KelpPackage) map[string]verify.Trust {
+	trust := map[string]verify.Trust{}
+	for _, kp := range packages {
+		if kp.Trust == nil {
+			continue
+		}
+		t := *kp.Trust
+		t.Minisign = expandHome(t.Minisign)
+		t.GPG = expandHome(t.GPG)
+		t.CosignKey = expandHome(t.CosignKey)
+		trust[kp.Owner+"/"+kp.Repo] = t
+	}
+	return trust
 }
 
 func (kc *KelpConfig) Pop(index int) []KelpPackage {
@@ -41,22 +92,11 @@ func (kc *KelpConfig) Pop(index int) []KelpPackage {
 }
 
 func (kc *KelpConfig) GetPackage(repo string) (KelpPackage, error) {
-	parts := strings.Split(repo, "/")
-	// Check if there is an owner part since some projects have the same repo name
-	// like cli
-	if len(parts) > 1 {
-		// If there is an owner, get the more specific project first
-		for _, kp := range kc.Packages {
-			if kp.Owner == parts[0] && kp.Repo == parts[1] {
-				return kp, nil
-			}
-		}
-	} else {
-		for _, kp := range kc.Packages {
-
-			if kp.Repo == repo {
-				return kp, nil
-			}
+	// Packages are matched by owner/repo when an owner is given since some
+	// projects have the same repo name like cli
+	for _, kp := range kc.AllPackages() {
+		if kp.matches(repo) {
+			return kp, nil
 		}
 	}
 	err := errors.New("package not found in config, try adding it first")
@@ -64,35 +104,139 @@ func (kc *KelpConfig) GetPackage(repo string) (KelpPackage, error) {
 	return kp, err
 }
 
+// migrations upgrade a config document one schema version at a time.
+// migrations[i] turns a version i+1 document into a version i+2 document.
+var migrations = []func([]byte) ([]byte, error){
+	migrateV1,
+}
+
+// migrateV1 wraps the original bare package array in a versioned object.
+func migrateV1(bs []byte) ([]byte, error) {
+	var packages []json.RawMessage
+	if err := json.Unmarshal(bs, &packages); err != nil {
+		return nil, err
+	}
+	if packages == nil {
+		packages = []json.RawMessage{}
+	}
+	return json.Marshal(map[string]any{
+		"version":  2,
+		"settings": Settings{},
+		"packages": packages,
+	})
+}
+
 func Load(path string) (*KelpConfig, error) {
-	bs, _ := os.ReadFile(path)
-	kc := KelpConfig{}
-	err := json.Unmarshal(bs, &kc.Packages)
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("config file %s not found, run kelp init to create it", path)
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	kc, err := decode(FormatFor(path), bs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
 	kc.Path = path
+	return kc, nil
+}
+
+// decode parses a config document of any known schema version, migrating it
+// to CurrentVersion in memory. The file on disk is upgraded on the next Save.
+func decode(f Format, bs []byte) (*KelpConfig, error) {
+	if len(bytes.TrimSpace(bs)) == 0 {
+		return nil, errors.New("config file is empty")
+	}
+
+	version, err := f.probeVersion(bs)
+	if err != nil {
+		return nil, positionError(bs, err)
+	}
+	if version < 1 {
+		return nil, fmt.Errorf("unsupported config version %d", version)
+	}
+	if version > CurrentVersion {
+		return nil, fmt.Errorf("config version %d is newer than the supported version %d, upgrade kelp", version, CurrentVersion)
+	}
+
+	if version < CurrentVersion {
+		// migrations operate on JSON documents
+		if f.Name != JSON.Name {
+			bs, err = f.toJSON(bs)
+			if err != nil {
+				return nil, err
+			}
+			f = JSON
+		}
+		for ; version < CurrentVersion; version++ {
+			migrated, err := migrations[version-1](bs)
+			if err != nil {
+				return nil, positionError(bs, err)
+			}
+			bs = migrated
+		}
+	}
+
+	kc := KelpConfig{}
+	if err := f.unmarshal(bs, &kc); err != nil {
+		return nil, positionError(bs, err)
+	}
 	return &kc, nil
 }
 
+// positionError prefixes JSON decoding errors with the line and column of the
+// offending byte so malformed configs can be fixed by hand. YAML and TOML
+// errors already carry their position.
+func positionError(bs []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+	// offset counts the bytes read up to and including the offending one
+	line, col := 1, 1
+	for _, b := range bs[:max(min(int(offset)-1, len(bs)), 0)] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Errorf("line %d, column %d: %w", line, col, err)
+}
+
 func (kc *KelpConfig) Save() error {
-	bs, _ := json.MarshalIndent(kc.Packages, "", " ")
-	err := os.WriteFile(kc.Path, bs, 0600)
+	kc.Version = CurrentVersion
+	bs, err := FormatFor(kc.Path).marshal(kc)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(kc.Path, bs, 0600)
 	if err != nil {
 		return err
 	}
-	fmt.Println("Config saved.")
 	return nil
 }
 
 func (kc *KelpConfig) RemovePackage(repo string) error {
 	for i, kp := range kc.Packages {
-		if kp.Repo == repo {
+		if kp.matches(repo) {
 			kc.Packages = kc.Pop(i)
-			fmt.Printf("Package %s removed\n", repo)
 			return nil
 		}
 	}
+	// included configs are shared and never written to
+	if kp, err := kc.GetPackage(repo); err == nil {
+		return fmt.Errorf("package %s comes from %s, remove it there", repo, kp.Layer)
+	}
 	return errors.New("package not found in config")
 }
 
@@ -103,7 +247,6 @@ func (kc *KelpConfig) AddPackage(owner, repo, release string) error {
 			return fmt.Errorf("package already exists in config")
 		}
 	}
-
 	// append a new item
 	kp := KelpPackage{
 		Owner:     owner,
@@ -112,15 +255,14 @@ func (kc *KelpConfig) AddPackage(owner, repo, release string) error {
 		UpdatedAt: time.Now(),
 	}
 	kc.Packages = append(kc.Packages, kp)
-	fmt.Println("Config added!")
 
 	return nil
 }
 
-func (kc *KelpConfig) UpdatePackage(repo string) (string, error) {
+func (kc *KelpConfig) UpdatePackage(ctx context.Context, repo string) (string, error) {
 	for _, p := range kc.Packages {
 		if p.Repo == repo {
-			ghr, err := utils.GetGithubRelease(p.Owner, p.Repo, "latest")
+			ghr, err := Releases.Get(ctx, HTTPClient, p.Owner, p.Repo, "latest")
 			if err != nil {
 				return "", err
 			}
@@ -131,8 +273,19 @@ func (kc *KelpConfig) UpdatePackage(repo string) (string, error) {
 }
 
 func (kc *KelpConfig) SetPackage(repo, release, description, binary string) error {
+	// packages from included configs are copied into the user's own config
+	// before being changed
+	kp, err := kc.GetPackage(repo)
+	if err != nil {
+		return err
+	}
+	if kp.Layer != LocalLayer {
+		kp.Layer = ""
+		kc.Packages = append(kc.Packages, kp)
+	}
+
 	for i, p := range kc.Packages {
-		if p.Repo == repo {
+		if p.matches(repo) {
 			if release != "" {
 				kc.Packages[i].Release = release
 				kc.Packages[i].UpdatedAt = time.Now()
@@ -143,76 +296,30 @@ func (kc *KelpConfig) SetPackage(repo, release, description, binary string) erro
 			if binary != "" {
 				kc.Packages[i].Binary = binary
 			}
-			fmt.Println("Config set!")
 			return nil
 		}
 	}
 	return nil
 }
 
-func (kc *KelpConfig) List() {
-	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
-
-	// sort by date
-	sort.Slice(kc.Packages, func(i, j int) bool {
-		return kc.Packages[i].UpdatedAt.Before(kc.Packages[j].UpdatedAt)
-	})
-
-	for _, pkg := range kc.Packages {
-
-		// Format the timestamp in a more human-friendly way
-		humanFriendlyTimestamp := pkg.UpdatedAt.Format("Jan 2 2006")
-		if humanFriendlyTimestamp == "Jan 1 0001" {
-			humanFriendlyTimestamp = ""
-		}
-		release := ""
-		if strings.HasPrefix(pkg.Release, "http") {
-			// Define the regex pattern to extract version numbers
-			pattern := `[/v-]([\d.]+)`
-			// Compile the regex pattern
-			re := regexp.MustCompile(pattern)
-			match := re.FindStringSubmatch(pkg.Release)
-			if len(match) > 1 {
-				release = fmt.Sprintf("%s (https)", match[1])
-			} else {
-				release = "unknown (https)"
+// Initialize creates the kelp directories and, unless one already exists, a
+// config at path. It reports whether the config was created.
+func Initialize(path string) (bool, error) {
+	for _, dir := range []string{KelpDir, KelpCache, KelpBin} {
+		if !utils.DirExists(dir) {
+			err := os.MkdirAll(dir, 0777)
+			if err != nil {
+				return false, err
 			}
-		} else {
-			release = pkg.Release
 		}
-
-		fmt.Fprintf(w, "\n%s/%s\t%s\t%s", pkg.Owner, pkg.Repo, release, humanFriendlyTimestamp)
 	}
-	w.Flush()
-}
 
-func Initialize(path string) error {
-	if !utils.DirExists(KelpDir) {
-		fmt.Println("Creating Kelp dir...")
-		err := os.Mkdir(KelpDir, 0777)
-		if err != nil {
-			return err
-		}
-	}
-
-	if !utils.DirExists(KelpCache) {
-		fmt.Println("Creating Kelp cache...")
-		err := os.Mkdir(KelpCache, 0777)
-		if err != nil {
-			return err
-		}
-	}
-
-	if !utils.DirExists(KelpBin) {
-		fmt.Println("Creating Kelp bin...")
-		err := os.Mkdir(KelpBin, 0777)
-		if err != nil {
-			return err
-		}
+	if utils.FileExists(path) {
+		return false, nil
 	}
 
 	// create empty config
-	kc := KelpConfig{}
+	kc := KelpConfig{Version: CurrentVersion}
 	kc.Path = path
 
 	var kp KelpPackage
@@ -223,77 +330,30 @@ func Initialize(path string) error {
 	kp.Description = "Simple homebrew alternative"
 	kc.Packages = append(kc.Packages, kp)
 
-	if !utils.FileExists(path) {
-		fmt.Println("Creating Kelp config file...")
-		err := kc.Save()
-		if err != nil {
-			return err
-		}
-	} else {
-		fmt.Println("Skipping Kelp config file creation since one alredy exists...")
-	}
-
-	fmt.Println("🌱 Kelp Initialized!")
-	fmt.Printf("🗒  Add Kelp to your path by running: \nexport PATH=%s:$PATH >> ~/.bash_profile\n", KelpBin)
-	return nil
-}
-
-func Inspect() {
-	var err error
-	switch types.GetOS() {
-	case types.Darwin:
-		err = exec.Command("open", KelpDir).Start()
-	case types.Linux:
-		err = exec.Command("xdg-open", KelpDir).Start()
-	default:
-		err = fmt.Errorf("unsupported platform")
-	}
+	err := kc.Save()
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
+	return true, nil
 }
 
-func Browse(owner, repo string) {
-	var err error
-	url := fmt.Sprintf("https://github.com/%s/%s", owner, repo)
-	fmt.Printf("Opening %s\n", url)
-
+// open opens a path or url with the desktop's default application.
+func open(target string) error {
 	switch types.GetOS() {
 	case types.Darwin:
-		err = exec.Command("open", url).Start()
+		return exec.Command("open", target).Start()
 	case types.Linux:
-		err = exec.Command("xdg-open", url).Start()
-	default:
-		err = fmt.Errorf("unsupported platform")
-	}
-	if err != nil {
-		log.Fatal(err)
+		return exec.Command("xdg-open", target).Start()
 	}
+	return fmt.Errorf("unsupported platform")
 }
 
-func (kc *KelpConfig) Doctor() {
-	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
-	for _, p := range kc.Packages {
-		// check alias first
-		var binary string
-		if p.Binary != "" {
-			binary = p.Binary
-		} else {
-			binary = p.Repo
-		}
+// Inspect opens the kelp directory in the file browser.
+func Inspect() error {
+	return open(KelpDir)
+}
 
-		status := ""
-		path, err := utils.CommandExists(binary)
-		if err != nil {
-			status = "❌ Binary not found"
-		} else {
-			if strings.HasPrefix(path, KelpBin) {
-				status = "✅ Installed"
-			} else {
-				status = "⛔️ Installed outside kelp"
-			}
-		}
-		fmt.Fprintf(w, "\n%s\t%s", binary, status)
-	}
-	w.Flush()
+// Browse opens the github page of a project.
+func Browse(owner, repo string) error {
+	return open(fmt.Sprintf("https://github.com/%s/%s", owner, repo))
 }
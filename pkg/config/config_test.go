@@ -0,0 +1,367 @@
+package config
+
+import (
+	"context"
+	"crhuber/kelp/pkg/shim"
+	"crhuber/kelp/pkg/utils"
+	"crhuber/kelp/pkg/verify"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kelp.json")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestLoadMigratesV1(t *testing.T) {
+	path := writeConfig(t, `[
+ {"Owner": "ogham", "Repo": "exa", "Release": "v0.10.1", "Binary": "exa"}
+]`)
+	kc, err := Load(path)
+	require.NoError(t, err)
+	require.Equal(t, CurrentVersion, kc.Version)
+	require.Len(t, kc.Packages, 1)
+	require.Equal(t, "ogham", kc.Packages[0].Owner)
+	require.Equal(t, "v0.10.1", kc.Packages[0].Release)
+
+	// saving upgrades the file on disk
+	require.NoError(t, kc.Save())
+	kc, err = Load(path)
+	require.NoError(t, err)
+	require.Equal(t, "exa", kc.Packages[0].Repo)
+	bs, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(bs), `"version": 2`)
+}
+
+func TestLoadV2(t *testing.T) {
+	path := writeConfig(t, `{"version": 2, "settings": {}, "packages": [{"Owner": "cli", "Repo": "cli", "Release": "latest"}]}`)
+	kc, err := Load(path)
+	require.NoError(t, err)
+	require.Len(t, kc.Packages, 1)
+	require.Equal(t, "cli", kc.Packages[0].Owner)
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorContains(t, err, "run kelp init")
+
+	path := writeConfig(t, "{\n \"version\": 2,\n \"packages\": [\n  {\"Owner\": \"a\",}\n ]\n}")
+	_, err = Load(path)
+	require.ErrorContains(t, err, "line 4, column 17")
+
+	path = writeConfig(t, `{"version": 2, "packages": {}}`)
+	_, err = Load(path)
+	require.ErrorContains(t, err, "line 1, column 28")
+
+	path = writeConfig(t, `{"version": 99, "packages": []}`)
+	_, err = Load(path)
+	require.ErrorContains(t, err, "newer than the supported version")
+
+	for _, version := range []string{"0", "-1"} {
+		path = writeConfig(t, `{"version": `+version+`, "packages": []}`)
+		_, err = Load(path)
+		require.ErrorContains(t, err, "unsupported config version "+version)
+	}
+
+	path = writeConfig(t, `{"packages": []}`)
+	_, err = Load(path)
+	require.ErrorContains(t, err, "version")
+
+	path = writeConfig(t, "")
+	_, err = Load(path)
+	require.ErrorContains(t, err, "empty")
+}
+
+func TestApplySettings(t *testing.T) {
+	defer func() { require.NoError(t, Apply(Settings{})) }()
+
+	path := writeConfig(t, `{"version": 2, "settings": {"binDir": "~/.local/bin", "parallelism": 2}, "packages": []}`)
+	kc, err := Load(path)
+	require.NoError(t, err)
+
+	require.NoError(t, Apply(kc.Settings.Merge(Settings{Parallelism: 8})))
+	require.Equal(t, filepath.Join(home, ".local/bin"), KelpBin)
+	require.Equal(t, filepath.Join(KelpDir, "cache"), KelpCache)
+	require.Equal(t, filepath.Join(home, ".local/store"), KelpStore)
+	require.Equal(t, filepath.Join(home, ".local/share"), KelpShare)
+	require.Equal(t, filepath.Join(home, ".local/verified"), KelpVerified)
+	require.Equal(t, 8, Active.Parallelism)
+	require.Equal(t, ChannelLatest, Active.DefaultChannel)
+
+	require.ErrorContains(t, Apply(Settings{DefaultChannel: "nightly"}), "unknown default channel")
+	require.ErrorContains(t, Apply(Settings{Parallelism: -1}), "parallelism")
+	require.ErrorContains(t, Apply(Settings{Timeout: "soon"}), "invalid timeout")
+	require.NoError(t, Apply(Settings{Timeout: "2m"}))
+	require.Equal(t, 2*time.Minute, Active.TimeoutDuration())
+	require.Equal(t, filepath.Join(KelpDir, "store"), KelpStore)
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	path := writeConfig(t, `{"version": 2, "settings": {"binDir": "~/.local/bin", "assetPreferences": ["musl"]}, "packages": [{"Owner": "ogham", "Repo": "exa", "Release": "v0.10.1", "UpdatedAt": "2024-05-01T10:00:00Z", "Binary": "exa"}]}`)
+	kc, err := Load(path)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	current := kc
+	for _, name := range []string{"kelp.yaml", "kelp.toml", "kelp.json"} {
+		dest := filepath.Join(dir, name)
+		require.NoError(t, current.Convert(dest))
+		converted, err := Load(dest)
+		require.NoError(t, err)
+		require.Equal(t, kc.Settings, converted.Settings)
+		require.Len(t, converted.Packages, 1)
+		require.Equal(t, kc.Packages[0].Release, converted.Packages[0].Release)
+		require.True(t, kc.Packages[0].UpdatedAt.Equal(converted.Packages[0].UpdatedAt))
+		current = converted
+	}
+}
+
+func TestLoadYAMLErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kelp.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("version: 2\npackages:\n  - Owner: [\n"), 0600))
+	_, err := Load(path)
+	require.ErrorContains(t, err, "line")
+}
+
+func TestLayers(t *testing.T) {
+	defer func() { require.NoError(t, Apply(Settings{})) }()
+
+	remote := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("version: 2\nsettings:\n  parallelism: 3\n  binDir: /tmp/elsewhere\n  caBundle: /tmp/ca.pem\npackages:\n  - Owner: cli\n    Repo: cli\n    Release: v2.0.0\n"))
+	}))
+	defer remote.Close()
+	require.NoError(t, Apply(Settings{CacheDir: t.TempDir()}))
+	HTTPClient = remote.Client()
+
+	dir := t.TempDir()
+	team := filepath.Join(dir, "team", "kelp.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(team), 0755))
+	require.NoError(t, os.WriteFile(team, []byte(`{"version": 2, "settings": {"parallelism": 2, "assetPreferences": ["musl"]}, "include": ["`+remote.URL+`/kelp.yaml"], "packages": [
+  {"Owner": "ogham", "Repo": "exa", "Release": "v0.9.0"},
+  {"Owner": "sharkdp", "Repo": "bat", "Release": "v0.24.0"}
+]}`), 0600))
+	personal := filepath.Join(dir, "kelp.json")
+	require.NoError(t, os.WriteFile(personal, []byte(`{"version": 2, "settings": {"parallelism": 1}, "include": ["team/kelp.json"], "packages": [
+  {"Owner": "ogham", "Repo": "exa", "Release": "v0.10.1"}
+]}`), 0600))
+
+	kc, err := Load(personal)
+	require.NoError(t, err)
+	require.NoError(t, kc.LoadIncludes(context.Background()))
+
+	layers := map[string]string{}
+	for _, kp := range kc.AllPackages() {
+		layers[kp.Repo] = kp.Layer
+	}
+	require.Equal(t, map[string]string{"cli": remote.URL + "/kelp.yaml", "exa": LocalLayer, "bat": team}, layers)
+
+	exa, err := kc.GetPackage("exa")
+	require.NoError(t, err)
+	require.Equal(t, "v0.10.1", exa.Release)
+
+	settings := kc.EffectiveSettings()
+	require.Equal(t, 1, settings.Parallelism)
+	require.Equal(t, []string{"musl"}, settings.AssetPreferences)
+	// includes can't move the bin dir or change what is trusted
+	require.Empty(t, settings.BinDir)
+	require.Empty(t, settings.CABundle)
+	require.Equal(t, []string{remote.URL + "/kelp.yaml has settings only your own config can set, they are ignored"}, kc.Warnings)
+
+	// changes only ever land in the personal config
+	require.ErrorContains(t, kc.RemovePackage("bat"), "remove it there")
+	require.NoError(t, kc.SetPackage("sharkdp/bat", "v0.25.0", "", ""))
+	require.Len(t, kc.Packages, 2)
+	bat, err := kc.GetPackage("bat")
+	require.NoError(t, err)
+	require.Equal(t, LocalLayer, bat.Layer)
+	require.Equal(t, "v0.25.0", bat.Release)
+	require.NoError(t, kc.RemovePackage("bat"))
+	bat, err = kc.GetPackage("bat")
+	require.NoError(t, err)
+	require.Equal(t, "v0.24.0", bat.Release)
+
+	// remote includes must be fetched over https
+	insecure := writeConfig(t, `{"version": 2, "include": ["http://example.com/kelp.json"]}`)
+	kc, err = Load(insecure)
+	require.NoError(t, err)
+	require.EqualError(t, kc.LoadIncludes(context.Background()), "could not include http://example.com/kelp.json: remote includes must use https")
+}
+
+func TestOutdated(t *testing.T) {
+	defer func() { require.NoError(t, Apply(Settings{})) }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/releases/latest") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"tag_name": "v2.0", "assets": []}`))
+	}))
+	defer server.Close()
+	defer func(api string) { utils.GithubAPI = api }(utils.GithubAPI)
+	utils.GithubAPI = server.URL
+	dir := t.TempDir()
+	require.NoError(t, Apply(Settings{BinDir: filepath.Join(dir, "bin"), CacheDir: filepath.Join(dir, "cache")}))
+	HTTPClient = server.Client()
+
+	for repo, tag := range map[string]string{"current": "v2.0", "stale": "v1.0"} {
+		require.NoError(t, verify.Save(KelpVerified, "a", repo, ChannelLatest, verify.Result{Release: tag}))
+	}
+	kc := &KelpConfig{Version: CurrentVersion, Packages: []KelpPackage{
+		{Owner: "a", Repo: "pinned", Release: "v1.0"},
+		{Owner: "a", Repo: "newest", Release: "v2.0"},
+		{Owner: "a", Repo: "current", Release: ChannelLatest},
+		{Owner: "a", Repo: "stale", Release: ChannelLatest},
+		{Owner: "a", Repo: "uninstalled", Release: ChannelLatest},
+	}}
+	report, err := kc.Outdated(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []OutdatedEntry{
+		{Owner: "a", Repo: "pinned", Release: "v1.0", Latest: "v2.0", Outdated: true},
+		{Owner: "a", Repo: "newest", Release: "v2.0", Latest: "v2.0"},
+		{Owner: "a", Repo: "current", Release: ChannelLatest, Installed: "v2.0", Latest: "v2.0"},
+		{Owner: "a", Repo: "stale", Release: ChannelLatest, Installed: "v1.0", Latest: "v2.0", Outdated: true},
+		{Owner: "a", Repo: "uninstalled", Release: ChannelLatest, Latest: "v2.0", Tracking: true},
+	}, report.Packages)
+}
+
+func TestResolveBinary(t *testing.T) {
+	defer func(store string) { KelpStore = store }(KelpStore)
+	defer func() { require.NoError(t, Apply(Settings{})) }()
+	KelpStore = t.TempDir()
+	require.NoError(t, Apply(Settings{BinDir: t.TempDir()}))
+
+	root := t.TempDir()
+	nested := filepath.Join(root, "src", "cmd")
+	require.NoError(t, os.MkdirAll(nested, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".kelp.yaml"), []byte("version: 2\npackages:\n  - Owner: BurntSushi\n    Repo: ripgrep\n    Release: 14.1.0\n    Binary: rg\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(KelpBin, "jq"), []byte("#!/bin/sh\n"), 0755))
+
+	path, ok := FindProject(nested)
+	require.True(t, ok)
+	require.Equal(t, filepath.Join(root, ".kelp.yaml"), path)
+
+	// pinned but not installed
+	_, err := ResolveBinary("rg", nested, nil)
+	require.ErrorContains(t, err, "run kelp install")
+
+	store := StorePath("BurntSushi", "ripgrep", "14.1.0")
+	require.NoError(t, os.MkdirAll(store, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(store, "rg"), []byte("#!/bin/sh\n"), 0755))
+	binary, err := ResolveBinary("ripgrep", nested, nil)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(store, "rg"), binary)
+
+	// tools the project doesn't pin come from the kelp bin
+	binary, err = ResolveBinary("jq", nested, nil)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(KelpBin, "jq"), binary)
+	_, err = ResolveBinary("fd", nested, nil)
+	require.ErrorContains(t, err, "not installed")
+
+	// with shims, global packages resolve through the global config
+	shims := true
+	require.NoError(t, Apply(Settings{BinDir: KelpBin, Shims: &shims}))
+	require.NoError(t, shim.Write(KelpBin, "bat", "/usr/local/bin/kelp"))
+	kc := &KelpConfig{Packages: []KelpPackage{{Owner: "sharkdp", Repo: "bat", Release: "v0.24.0"}}}
+	_, err = ResolveBinary("bat", nested, nil)
+	require.ErrorContains(t, err, "bat is not installed")
+	var missing *NotInstalledError
+	_, err = ResolveBinary("bat", nested, kc)
+	require.ErrorAs(t, err, &missing)
+	require.Equal(t, "v0.24.0", missing.Package.Release)
+	store = StorePath("sharkdp", "bat", "v0.24.0")
+	require.NoError(t, os.MkdirAll(store, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(store, "bat"), []byte("#!/bin/sh\n"), 0755))
+	binary, err = ResolveBinary("bat", nested, kc)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(store, "bat"), binary)
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".kelp.yaml"), []byte("version: 2\npackages:\n  - Owner: BurntSushi\n    Repo: ripgrep\n    Release: latest\n"), 0600))
+	_, err = ResolveBinary("rg", nested, nil)
+	require.ErrorContains(t, err, "must pin an exact release")
+}
+
+func TestShellEnv(t *testing.T) {
+	defer func(bin, share string) { KelpBin, KelpShare = bin, share }(KelpBin, KelpShare)
+	KelpBin, KelpShare = "/home/o'neil/.kelp/bin", "/home/o'neil/.kelp/share"
+
+	env, err := ShellEnv("zsh")
+	require.NoError(t, err)
+	require.Contains(t, env, `export PATH='/home/o'\''neil/.kelp/bin':"$PATH"`)
+	require.Contains(t, env, `export MANPATH='/home/o'\''neil/.kelp/share/man':"${MANPATH:-}"`)
+	require.True(t, strings.HasSuffix(env, `completions='/home/o'\''neil/.kelp/share/zsh/site-functions'
+if (( ! ${fpath[(Ie)$completions]} )); then
+  fpath=("$completions" $fpath)
+  if (( $+functions[compdef] )); then
+    autoload -Uz compinit && compinit
+  fi
+fi
+unset completions
+`), env)
+	env, err = ShellEnv("bash")
+	require.NoError(t, err)
+	require.Contains(t, env, `'/home/o'\''neil/.kelp/share/bash-completion'/*`)
+	env, err = ShellEnv("fish")
+	require.NoError(t, err)
+	require.Contains(t, env, `set -g fish_complete_path '/home/o\'neil/.kelp/share/fish' $fish_complete_path`)
+	env, err = ShellEnv("powershell")
+	require.NoError(t, err)
+	require.Contains(t, env, `$env:PATH = '/home/o''neil/.kelp/bin'`)
+	_, err = ShellEnv("tcsh")
+	require.EqualError(t, err, `unknown shell "tcsh", use one of bash, zsh, fish, powershell`)
+}
+
+func TestAddToShell(t *testing.T) {
+	defer func(h string) { home = h }(home)
+	home = t.TempDir()
+	t.Setenv("ZDOTDIR", "")
+	rc := filepath.Join(home, ".zshrc")
+	require.NoError(t, os.WriteFile(rc, []byte("alias ll='ls -l'"), 0644))
+
+	path, added, err := AddToShell("zsh", "/usr/local/bin/kelp")
+	require.NoError(t, err)
+	require.Equal(t, rc, path)
+	require.True(t, added)
+	// the line is only added once
+	_, added, err = AddToShell("zsh", "/usr/local/bin/kelp")
+	require.NoError(t, err)
+	require.False(t, added)
+	bs, err := os.ReadFile(rc)
+	require.NoError(t, err)
+	require.Equal(t, "alias ll='ls -l'\n\n# added by kelp init\neval \"$('/usr/local/bin/kelp' shellenv zsh)\"\n", string(bs))
+
+	path, added, err = AddToShell("fish", "/usr/local/bin/kelp")
+	require.NoError(t, err)
+	require.True(t, added)
+	bs, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "# added by kelp init\n'/usr/local/bin/kelp' shellenv fish | source\n", string(bs))
+}
+
+func TestPathWarnings(t *testing.T) {
+	defer func(bin string) { KelpBin = bin }(KelpBin)
+	KelpBin = t.TempDir()
+	system := t.TempDir()
+	for _, dir := range []string{KelpBin, system} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "tool"), []byte("#!/bin/sh\n"), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(KelpBin, "other"), []byte("#!/bin/sh\n"), 0755))
+
+	list := func(dirs ...string) string { return strings.Join(dirs, string(os.PathListSeparator)) }
+	require.Equal(t, []string{KelpBin + " is not on your PATH, run kelp init --shell"}, PathWarnings(list(system)))
+	require.Empty(t, PathWarnings(list(KelpBin, system)))
+	require.Empty(t, PathWarnings(list(KelpBin+"/", system)))
+	require.Equal(t, []string{"tool in " + system + " shadows the one in " + KelpBin + ", put " + KelpBin + " earlier on your PATH"}, PathWarnings(list(system, KelpBin)))
+}
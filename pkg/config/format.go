@@ -0,0 +1,131 @@
+package config
+
+import (
+	"bytes"
+	"crhuber/kelp/pkg/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format encodes and decodes config documents of one file type. Every format
+// shares the same schema.
+type Format struct {
+	Name       string
+	Extensions []string
+	marshal    func(any) ([]byte, error)
+	unmarshal  func([]byte, any) error
+}
+
+var (
+	JSON = Format{
+		Name:       "json",
+		Extensions: []string{".json"},
+		marshal: func(v any) ([]byte, error) {
+			return json.MarshalIndent(v, "", " ")
+		},
+		unmarshal: json.Unmarshal,
+	}
+	YAML = Format{
+		Name:       "yaml",
+		Extensions: []string{".yaml", ".yml"},
+		marshal: func(v any) ([]byte, error) {
+			var buf bytes.Buffer
+			enc := yaml.NewEncoder(&buf)
+			enc.SetIndent(2)
+			if err := enc.Encode(v); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), enc.Close()
+		},
+		unmarshal: yaml.Unmarshal,
+	}
+	TOML = Format{
+		Name:       "toml",
+		Extensions: []string{".toml"},
+		marshal: func(v any) ([]byte, error) {
+			var buf bytes.Buffer
+			err := toml.NewEncoder(&buf).Encode(v)
+			return buf.Bytes(), err
+		},
+		unmarshal: toml.Unmarshal,
+	}
+)
+
+// Formats lists the supported config formats, the default first.
+var Formats = []Format{JSON, YAML, TOML}
+
+// FormatFor picks the config format from the file extension of path,
+// defaulting to JSON.
+func FormatFor(path string) Format {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, f := range Formats {
+		for _, e := range f.Extensions {
+			if e == ext {
+				return f
+			}
+		}
+	}
+	return JSON
+}
+
+// probeVersion reports the schema version of a document. A bare list of
+// packages predates versioning and counts as version 1.
+func (f Format) probeVersion(bs []byte) (int, error) {
+	var doc any
+	if err := f.unmarshal(bs, &doc); err != nil {
+		return 0, err
+	}
+	switch doc := doc.(type) {
+	case []any:
+		return 1, nil
+	case map[string]any:
+		switch v := doc["version"].(type) {
+		case float64:
+			return int(v), nil
+		case int:
+			return v, nil
+		case int64:
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("config is missing a valid \"version\" field")
+}
+
+// toJSON re-encodes a document as JSON so it can be migrated.
+func (f Format) toJSON(bs []byte) ([]byte, error) {
+	var doc any
+	if err := f.unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// DefaultPath returns the first kelp config found in KelpDir, trying each
+// format in turn, or the JSON path when there is none yet.
+func DefaultPath() string {
+	for _, f := range Formats {
+		for _, ext := range f.Extensions {
+			path := filepath.Join(KelpDir, "kelp"+ext)
+			if utils.FileExists(path) {
+				return path
+			}
+		}
+	}
+	return filepath.Join(KelpDir, "kelp.json")
+}
+
+// Convert writes the config to path in the format matching its extension.
+func (kc *KelpConfig) Convert(path string) error {
+	if filepath.Clean(path) == filepath.Clean(kc.Path) {
+		return errors.New("config is already at that path")
+	}
+	converted := *kc
+	converted.Path = path
+	return converted.Save()
+}
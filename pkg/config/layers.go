@@ -0,0 +1,179 @@
+package config
+
+import (
+	"context"
+	"crhuber/kelp/pkg/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// LocalLayer names the user's own config when listing where packages come from.
+const LocalLayer = "local"
+
+// LoadIncludes loads every config listed under include, and the configs those
+// include in turn, as read-only layers beneath kc. Packages in later layers
+// override earlier ones by owner/repo and the user's own config overrides them
+// all. Relative includes are resolved against the including file.
+func (kc *KelpConfig) LoadIncludes(ctx context.Context) error {
+	kc.layers = nil
+	kc.Warnings = nil
+	return kc.loadIncludes(ctx, kc, map[string]bool{kc.Path: true})
+}
+
+func (kc *KelpConfig) loadIncludes(ctx context.Context, from *KelpConfig, seen map[string]bool) error {
+	for _, ref := range from.Include {
+		ref = resolveInclude(from.Path, ref)
+		// skip configs that were already included, which also breaks cycles
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+
+		layer, err := kc.loadInclude(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("could not include %s: %w", ref, err)
+		}
+		if !reflect.DeepEqual(layer.Settings, layer.Settings.layered()) {
+			kc.Warnings = append(kc.Warnings, fmt.Sprintf("%s has settings only your own config can set, they are ignored", ref))
+		}
+		// a layer's own includes sit beneath it
+		err = kc.loadIncludes(ctx, layer, seen)
+		if err != nil {
+			return err
+		}
+		kc.layers = append(kc.layers, layer)
+	}
+	return nil
+}
+
+// resolveInclude turns an include entry into an absolute path or URL.
+func resolveInclude(base, ref string) string {
+	if isURL(ref) {
+		return ref
+	}
+	if isURL(base) {
+		u, err := url.Parse(base)
+		if err != nil {
+			return ref
+		}
+		u.Path = path.Join(path.Dir(u.Path), ref)
+		return u.String()
+	}
+	ref = expandHome(ref)
+	if filepath.IsAbs(ref) {
+		return ref
+	}
+	return filepath.Join(filepath.Dir(base), ref)
+}
+
+func isURL(ref string) bool {
+	return strings.HasPrefix(ref, "https://") || strings.HasPrefix(ref, "http://")
+}
+
+// loadInclude loads an included config from disk or over https. Remote
+// configs are cached so the last copy seen is used when the network is
+// unavailable.
+func (kc *KelpConfig) loadInclude(ctx context.Context, ref string) (*KelpConfig, error) {
+	if !isURL(ref) {
+		return Load(ref)
+	}
+	if !strings.HasPrefix(ref, "https://") {
+		return nil, errors.New("remote includes must use https")
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	cached := filepath.Join(KelpCache, "includes", includeCacheKey(ref)+path.Ext(u.Path))
+
+	bs, err := fetchInclude(ctx, ref)
+	if err != nil {
+		// fall back only when the network failed, not when kelp was interrupted
+		if ctx.Err() != nil || !utils.FileExists(cached) {
+			return nil, err
+		}
+		kc.Warnings = append(kc.Warnings, fmt.Sprintf("could not fetch %s, using cached copy: %s", ref, err))
+		bs, err = os.ReadFile(cached)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(filepath.Dir(cached), 0755); err == nil {
+		os.WriteFile(cached, bs, 0600)
+	}
+
+	layer, err := decode(FormatFor(u.Path), bs)
+	if err != nil {
+		return nil, err
+	}
+	layer.Path = ref
+	return layer, nil
+}
+
+func includeCacheKey(ref string) string {
+	sum := sha256.Sum256([]byte(ref))
+	return hex.EncodeToString(sum[:8])
+}
+
+func fetchInclude(ctx context.Context, ref string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid HTTP status: %v", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// AllPackages returns the packages of every layer merged by owner/repo, each
+// tagged with the layer it comes from.
+func (kc *KelpConfig) AllPackages() []KelpPackage {
+	packages := []KelpPackage{}
+	index := map[string]int{}
+	add := func(kp KelpPackage, layer string) {
+		kp.Layer = layer
+		key := kp.Owner + "/" + kp.Repo
+		if i, ok := index[key]; ok {
+			packages[i] = kp
+			return
+		}
+		index[key] = len(packages)
+		packages = append(packages, kp)
+	}
+	for _, layer := range kc.layers {
+		for _, kp := range layer.Packages {
+			add(kp, layer.Path)
+		}
+	}
+	for _, kp := range kc.Packages {
+		add(kp, LocalLayer)
+	}
+	return packages
+}
+
+// EffectiveSettings merges the settings of every layer, with the user's own
+// config taking precedence. Included configs only contribute the settings
+// layered allows.
+func (kc *KelpConfig) EffectiveSettings() Settings {
+	s := Settings{}
+	for _, layer := range kc.layers {
+		s = s.Merge(layer.Settings.layered())
+	}
+	return s.Merge(kc.Settings)
+}
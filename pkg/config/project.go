@@ -0,0 +1,140 @@
+package config
+
+import (
+	"crhuber/kelp/pkg/shim"
+	"crhuber/kelp/pkg/utils"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// KelpStore holds versioned installs, one directory per owner/repo/release.
+var KelpStore = filepath.Join(KelpDir, "store")
+
+// ProjectFile is the name of a project manifest, without its extension.
+const ProjectFile = ".kelp"
+
+// FindProject walks up from dir looking for a project manifest in any of the
+// supported formats and reports whether one was found.
+func FindProject(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		for _, f := range Formats {
+			for _, ext := range f.Extensions {
+				path := filepath.Join(dir, ProjectFile+ext)
+				if utils.FileExists(path) {
+					return path, true
+				}
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// LoadProject loads a project manifest. Projects pin exact releases so every
+// checkout resolves the same tools.
+func LoadProject(path string) (*KelpConfig, error) {
+	pc, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, kp := range pc.Packages {
+		switch kp.Release {
+		case "", ChannelLatest, ChannelPrerelease:
+			return nil, fmt.Errorf("%s: %s/%s must pin an exact release", path, kp.Owner, kp.Repo)
+		}
+	}
+	return pc, nil
+}
+
+// StorePath returns the directory a release is installed to in the
+// versioned store.
+func StorePath(owner, repo, release string) string {
+	return utils.StorePath(KelpStore, owner, repo, release)
+}
+
+// NotInstalledError is returned when a pinned version has not been installed.
+type NotInstalledError struct {
+	Package KelpPackage
+	// Manifest is the config that pins the version
+	Manifest string
+}
+
+func (e *NotInstalledError) Error() string {
+	return fmt.Sprintf("%s/%s:%s is pinned by %s but not installed, run kelp install", e.Package.Owner, e.Package.Repo, e.Package.Release, e.Manifest)
+}
+
+// ResolveBinary finds the binary named tool for the project containing dir,
+// falling back to the version in the global config kc, which may be nil, and
+// finally to the kelp bin.
+func ResolveBinary(tool, dir string, kc *KelpConfig) (string, error) {
+	if path, ok := FindProject(dir); ok {
+		pc, err := LoadProject(path)
+		if err != nil {
+			return "", err
+		}
+		binary, err := resolveFrom(tool, pc.Packages, path, true)
+		if binary != "" || err != nil {
+			return binary, err
+		}
+	}
+
+	// without shims global installs live in the kelp bin instead of the store
+	if kc != nil {
+		binary, err := resolveFrom(tool, kc.AllPackages(), kc.Path, Active.UseShims())
+		if binary != "" || err != nil {
+			return binary, err
+		}
+	}
+
+	binary := filepath.Join(KelpBin, tool)
+	if !utils.FileExists(binary) || shim.IsShim(binary) {
+		return "", fmt.Errorf("%s is not installed", tool)
+	}
+	return binary, nil
+}
+
+// resolveFrom looks for tool in the versioned store directories of packages.
+// It returns an empty path when none of them provide the tool.
+func resolveFrom(tool string, packages []KelpPackage, manifest string, pinned bool) (string, error) {
+	for _, kp := range packages {
+		dir := StorePath(kp.Owner, kp.Repo, kp.Release)
+		if utils.FileExists(filepath.Join(dir, tool)) {
+			return filepath.Join(dir, tool), nil
+		}
+		if kp.Repo == tool || kp.Binary == tool {
+			// the binary may be named differently from the repo
+			if kp.Binary != "" && utils.FileExists(filepath.Join(dir, kp.Binary)) {
+				return filepath.Join(dir, kp.Binary), nil
+			}
+			if pinned {
+				return "", &NotInstalledError{Package: kp, Manifest: manifest}
+			}
+		}
+	}
+	return "", nil
+}
+
+// ErrNoProject is returned when no project manifest is found.
+var ErrNoProject = errors.New("no project manifest found")
+
+// CurrentProject loads the project manifest nearest the working directory.
+func CurrentProject() (*KelpConfig, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	path, ok := FindProject(wd)
+	if !ok {
+		return nil, ErrNoProject
+	}
+	return LoadProject(path)
+}
@@ -0,0 +1,322 @@
+package config
+
+import (
+	"context"
+	"crhuber/kelp/pkg/utils"
+	"crhuber/kelp/pkg/verify"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ListEntry describes a configured package.
+type ListEntry struct {
+	Owner     string    `json:"owner" yaml:"owner"`
+	Repo      string    `json:"repo" yaml:"repo"`
+	Release   string    `json:"release" yaml:"release"`
+	UpdatedAt time.Time `json:"updatedAt" yaml:"updatedAt"`
+	Layer     string    `json:"layer" yaml:"layer"`
+}
+
+// Listing is the result of kelp list.
+type Listing struct {
+	Packages []ListEntry `json:"packages" yaml:"packages"`
+	// Layered is set when packages come from more than one config
+	Layered bool `json:"-" yaml:"-"`
+}
+
+// List returns every package, oldest update first.
+func (kc *KelpConfig) List() Listing {
+	// sort by date
+	packages := kc.AllPackages()
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].UpdatedAt.Before(packages[j].UpdatedAt)
+	})
+
+	listing := Listing{Packages: []ListEntry{}, Layered: len(kc.layers) > 0}
+	for _, pkg := range packages {
+		listing.Packages = append(listing.Packages, ListEntry{
+			Owner:     pkg.Owner,
+			Repo:      pkg.Repo,
+			Release:   pkg.Release,
+			UpdatedAt: pkg.UpdatedAt,
+			Layer:     pkg.Layer,
+		})
+	}
+	return listing
+}
+
+func (l Listing) WriteTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 1, 1, 1, ' ', 0)
+	for _, pkg := range l.Packages {
+
+		// Format the timestamp in a more human-friendly way
+		humanFriendlyTimestamp := pkg.UpdatedAt.Format("Jan 2 2006")
+		if humanFriendlyTimestamp == "Jan 1 0001" {
+			humanFriendlyTimestamp = ""
+		}
+		release := ""
+		if strings.HasPrefix(pkg.Release, "http") {
+			// Define the regex pattern to extract version numbers
+			pattern := `[/v-]([\d.]+)`
+			// Compile the regex pattern
+			re := regexp.MustCompile(pattern)
+			match := re.FindStringSubmatch(pkg.Release)
+			if len(match) > 1 {
+				release = fmt.Sprintf("%s (https)", match[1])
+			} else {
+				release = "unknown (https)"
+			}
+		} else {
+			release = pkg.Release
+		}
+
+		// only show where packages come from when there is more than one layer
+		if l.Layered {
+			fmt.Fprintf(w, "\n%s/%s\t%s\t%s\t%s", pkg.Owner, pkg.Repo, release, humanFriendlyTimestamp, pkg.Layer)
+		} else {
+			fmt.Fprintf(w, "\n%s/%s\t%s\t%s", pkg.Owner, pkg.Repo, release, humanFriendlyTimestamp)
+		}
+	}
+	return w.Flush()
+}
+
+// Details is the result of kelp get.
+type Details struct {
+	Owner       string    `json:"owner" yaml:"owner"`
+	Repo        string    `json:"repo" yaml:"repo"`
+	Release     string    `json:"release" yaml:"release"`
+	Description string    `json:"description" yaml:"description"`
+	URL         string    `json:"url" yaml:"url"`
+	Binary      string    `json:"binary" yaml:"binary"`
+	UpdatedAt   time.Time `json:"updatedAt" yaml:"updatedAt"`
+	Layer       string    `json:"layer" yaml:"layer"`
+	// Verification is the signature check of the installed release, nil
+	// when it was never checked.
+	Verification *verify.Result `json:"verification,omitempty" yaml:"verification,omitempty"`
+}
+
+// Details describes a single package.
+func (kp KelpPackage) Details() Details {
+	d := Details{
+		Owner:       kp.Owner,
+		Repo:        kp.Repo,
+		Release:     kp.Release,
+		Description: kp.Description,
+		URL:         fmt.Sprintf("https://github.com/%s/%s", kp.Owner, kp.Repo),
+		Binary:      kp.Binary,
+		UpdatedAt:   kp.UpdatedAt,
+		Layer:       kp.Layer,
+	}
+	if r, err := verify.Load(KelpVerified, kp.Owner, kp.Repo, kp.Release); err == nil {
+		d.Verification = &r
+	}
+	return d
+}
+
+func (d Details) WriteTable(w io.Writer) error {
+	fmt.Fprintf(w, "[%s/%s]\n", d.Owner, d.Repo)
+	fmt.Fprintf(w, "Release: %s\n", d.Release)
+	fmt.Fprintf(w, "Description: %s\n", d.Description)
+	fmt.Fprintf(w, "Url: %s\n", d.URL)
+	fmt.Fprintf(w, "Binary: %s\n", d.Binary)
+	if d.Verification != nil {
+		fmt.Fprintf(w, "Signature: %s\n", d.Verification)
+	} else {
+		fmt.Fprintf(w, "Signature: not checked\n")
+	}
+	_, err := fmt.Fprintf(w, "Updated At: %s\n", d.UpdatedAt)
+	return err
+}
+
+// Binary statuses reported by Doctor.
+const (
+	StatusInstalled = "installed"
+	StatusMissing   = "missing"
+	StatusOutside   = "outside"
+)
+
+// DoctorEntry describes where a package binary was found on the PATH.
+type DoctorEntry struct {
+	Binary string `json:"binary" yaml:"binary"`
+	Status string `json:"status" yaml:"status"`
+	Path   string `json:"path,omitempty" yaml:"path,omitempty"`
+}
+
+// DoctorReport is the result of kelp doctor.
+type DoctorReport struct {
+	Binaries []DoctorEntry `json:"binaries" yaml:"binaries"`
+	// Warnings are problems with how the kelp bin dir is on the PATH.
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+}
+
+// Doctor checks whether each package binary is on the PATH and installed by
+// kelp, and whether the kelp bin dir is on the PATH ahead of other binaries
+// with the same names.
+func (kc *KelpConfig) Doctor() DoctorReport {
+	report := DoctorReport{Binaries: []DoctorEntry{}, Warnings: PathWarnings(os.Getenv("PATH"))}
+	for _, p := range kc.AllPackages() {
+		// check alias first
+		var binary string
+		if p.Binary != "" {
+			binary = p.Binary
+		} else {
+			binary = p.Repo
+		}
+
+		entry := DoctorEntry{Binary: binary}
+		path, err := utils.CommandExists(binary)
+		if err != nil {
+			entry.Status = StatusMissing
+		} else {
+			entry.Path = path
+			if strings.HasPrefix(path, KelpBin) {
+				entry.Status = StatusInstalled
+			} else {
+				entry.Status = StatusOutside
+			}
+		}
+		report.Binaries = append(report.Binaries, entry)
+	}
+	return report
+}
+
+func (r DoctorReport) WriteTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 1, 1, 1, ' ', 0)
+	for _, entry := range r.Binaries {
+		status := ""
+		switch entry.Status {
+		case StatusMissing:
+			status = "❌ Binary not found"
+		case StatusInstalled:
+			status = "✅ Installed"
+		case StatusOutside:
+			status = "⛔️ Installed outside kelp"
+		}
+		fmt.Fprintf(w, "\n%s\t%s", entry.Binary, status)
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(out, "\n⚠️  %s", warning)
+	}
+	return nil
+}
+
+// OutdatedEntry compares a package's configured release to the newest one
+// on its channel.
+type OutdatedEntry struct {
+	Owner   string `json:"owner" yaml:"owner"`
+	Repo    string `json:"repo" yaml:"repo"`
+	Release string `json:"release" yaml:"release"`
+	// Installed is the tag a package on a channel was last installed at.
+	Installed string `json:"installed,omitempty" yaml:"installed,omitempty"`
+	Latest    string `json:"latest,omitempty" yaml:"latest,omitempty"`
+	Outdated  bool   `json:"outdated" yaml:"outdated"`
+	// Tracking is set for packages on a channel that have no record of the
+	// tag they were installed at, they are up to date once installed again.
+	Tracking bool   `json:"tracking,omitempty" yaml:"tracking,omitempty"`
+	Error    string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// OutdatedReport is the result of kelp outdated.
+type OutdatedReport struct {
+	Packages []OutdatedEntry `json:"packages" yaml:"packages"`
+}
+
+// Outdated looks up the newest release of every github package on its
+// channel, checking up to Active.Parallelism packages at once. Pinned
+// packages follow the default channel. Packages on a channel are compared
+// by the tag they were installed at. Packages installed from a url are
+// skipped. It fails up front when the GitHub API rate limit can't cover
+// every lookup.
+func (kc *KelpConfig) Outdated(ctx context.Context) (OutdatedReport, error) {
+	packages := []KelpPackage{}
+	calls := 0
+	for _, kp := range kc.AllPackages() {
+		if !strings.HasPrefix(kp.Release, "http") {
+			packages = append(packages, kp)
+			if !Releases.Fresh(kp.Owner, kp.Repo, channel(kp.Release)) {
+				calls++
+			}
+		}
+	}
+	err := utils.CheckGithubBudget(ctx, HTTPClient, calls)
+	if err != nil {
+		return OutdatedReport{}, err
+	}
+
+	report := OutdatedReport{Packages: make([]OutdatedEntry, len(packages))}
+	sem := make(chan struct{}, Active.Parallelism)
+	var wg sync.WaitGroup
+	for i, kp := range packages {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			entry := OutdatedEntry{Owner: kp.Owner, Repo: kp.Repo, Release: kp.Release}
+			installed := kp.Release
+			if isChannel(kp.Release) {
+				// the verify record holds the tag the channel resolved to
+				installed = ""
+				if r, err := verify.Load(KelpVerified, kp.Owner, kp.Repo, kp.Release); err == nil {
+					installed = r.Release
+				}
+				entry.Installed = installed
+			}
+			ghr, err := Releases.Get(ctx, HTTPClient, kp.Owner, kp.Repo, channel(kp.Release))
+			switch {
+			case err != nil:
+				entry.Error = err.Error()
+			case installed == "":
+				entry.Latest = ghr.TagName
+				entry.Tracking = true
+			default:
+				entry.Latest = ghr.TagName
+				entry.Outdated = ghr.TagName != installed
+			}
+			report.Packages[i] = entry
+		}()
+	}
+	wg.Wait()
+	return report, nil
+}
+
+// isChannel reports whether release is a channel rather than a tag.
+func isChannel(release string) bool {
+	return release == ChannelLatest || release == ChannelPrerelease
+}
+
+// channel returns the channel a package on release is compared against.
+func channel(release string) string {
+	if isChannel(release) {
+		return release
+	}
+	return Active.DefaultChannel
+}
+
+func (r OutdatedReport) WriteTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 1, 1, 1, ' ', 0)
+	for _, entry := range r.Packages {
+		switch {
+		case entry.Error != "":
+			fmt.Fprintf(w, "\n%s/%s\t%s\t❌ %s", entry.Owner, entry.Repo, entry.Release, entry.Error)
+		case entry.Outdated:
+			fmt.Fprintf(w, "\n%s/%s\t%s\t⬆️  %s", entry.Owner, entry.Repo, entry.Release, entry.Latest)
+		case entry.Tracking:
+			fmt.Fprintf(w, "\n%s/%s\t%s\t🔁 Tracking, newest is %s", entry.Owner, entry.Repo, entry.Release, entry.Latest)
+		default:
+			fmt.Fprintf(w, "\n%s/%s\t%s\t✅ Up to date", entry.Owner, entry.Repo, entry.Release)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,269 @@
+package config
+
+import (
+	"crhuber/kelp/pkg/auth"
+	"crhuber/kelp/pkg/utils"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Channels a package release can be resolved from when none is given.
+const (
+	ChannelLatest     = "latest"
+	ChannelPrerelease = "prerelease"
+)
+
+// Settings holds global preferences that apply to every package.
+type Settings struct {
+	// BinDir is where installed binaries are copied to.
+	BinDir string `json:"binDir,omitempty" yaml:"binDir,omitempty" toml:"binDir,omitempty"`
+	// CacheDir is where downloaded release assets are kept.
+	CacheDir string `json:"cacheDir,omitempty" yaml:"cacheDir,omitempty" toml:"cacheDir,omitempty"`
+	// Parallelism caps how many packages bulk commands work on at once.
+	Parallelism int `json:"parallelism,omitempty" yaml:"parallelism,omitempty" toml:"parallelism,omitzero"`
+	// DefaultChannel is the release channel used when adding or updating a
+	// package without an explicit release: latest or prerelease.
+	DefaultChannel string `json:"defaultChannel,omitempty" yaml:"defaultChannel,omitempty" toml:"defaultChannel,omitempty"`
+	// AssetPreferences are substrings, such as musl, that rank a release
+	// asset higher when they appear in its file name.
+	AssetPreferences []string `json:"assetPreferences,omitempty" yaml:"assetPreferences,omitempty" toml:"assetPreferences,omitempty"`
+	// Proxy is the URL of an HTTP(S) proxy used for every request.
+	Proxy string `json:"proxy,omitempty" yaml:"proxy,omitempty" toml:"proxy,omitempty"`
+	// NoProxy lists hosts, domains and CIDR ranges reached without the
+	// proxy.
+	NoProxy []string `json:"noProxy,omitempty" yaml:"noProxy,omitempty" toml:"noProxy,omitempty"`
+	// CABundle is a PEM file of extra certificates to trust, such as the CA
+	// of a proxy that intercepts TLS.
+	CABundle string `json:"caBundle,omitempty" yaml:"caBundle,omitempty" toml:"caBundle,omitempty"`
+	// ClientCert and ClientKey are PEM files of a certificate presented to
+	// servers that require mutual TLS.
+	ClientCert string `json:"clientCert,omitempty" yaml:"clientCert,omitempty" toml:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty" yaml:"clientKey,omitempty" toml:"clientKey,omitempty"`
+	// Timeout bounds connecting to a server, waiting for it to respond and
+	// any stall while a response is downloading, ie 30s. 0 waits forever.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+	// MetadataTTL is how long release metadata for the latest and prerelease
+	// channels is cached before GitHub is asked again, ie 15m.
+	MetadataTTL string `json:"metadataTTL,omitempty" yaml:"metadataTTL,omitempty" toml:"metadataTTL,omitempty"`
+	// TrustedRoot is a sigstore trusted_root.json that keyless cosign
+	// signatures must chain to.
+	TrustedRoot string `json:"trustedRoot,omitempty" yaml:"trustedRoot,omitempty" toml:"trustedRoot,omitempty"`
+	// Offline installs from the cache only and never touches the network.
+	Offline *bool `json:"offline,omitempty" yaml:"offline,omitempty" toml:"offline,omitempty"`
+	// Shims installs every package into the versioned store and places shims
+	// in BinDir that run the version pinned for the current directory.
+	Shims *bool `json:"shims,omitempty" yaml:"shims,omitempty" toml:"shims,omitempty"`
+	// AutoInstall lets shims install a pinned version that is missing
+	// instead of failing.
+	AutoInstall *bool `json:"autoInstall,omitempty" yaml:"autoInstall,omitempty" toml:"autoInstall,omitempty"`
+	// Scripts installs executable scripts with a shebang found in release
+	// archives, not only binaries.
+	Scripts *bool `json:"scripts,omitempty" yaml:"scripts,omitempty" toml:"scripts,omitempty"`
+}
+
+// layered returns the settings an included config may set. Where kelp
+// installs to, what it trusts and how it reaches the network only come
+// from the user's own config, flags and environment.
+func (s Settings) layered() Settings {
+	return Settings{
+		Parallelism:      s.Parallelism,
+		DefaultChannel:   s.DefaultChannel,
+		AssetPreferences: s.AssetPreferences,
+		Timeout:          s.Timeout,
+		MetadataTTL:      s.MetadataTTL,
+	}
+}
+
+// IsOffline reports whether kelp must work without the network.
+func (s Settings) IsOffline() bool {
+	return s.Offline != nil && *s.Offline
+}
+
+// UseShims reports whether shims are enabled.
+func (s Settings) UseShims() bool {
+	return s.Shims != nil && *s.Shims
+}
+
+// UseAutoInstall reports whether shims may install missing versions.
+func (s Settings) UseAutoInstall() bool {
+	return s.AutoInstall != nil && *s.AutoInstall
+}
+
+// UseScripts reports whether scripts are installed as well as binaries.
+func (s Settings) UseScripts() bool {
+	return s.Scripts != nil && *s.Scripts
+}
+
+// TimeoutDuration returns the parsed timeout. Settings are validated before
+// they become active so the error is only seen for unvalidated settings.
+func (s Settings) TimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(s.Timeout)
+	return d
+}
+
+// MetadataTTLDuration returns the parsed metadata ttl.
+func (s Settings) MetadataTTLDuration() time.Duration {
+	d, _ := time.ParseDuration(s.MetadataTTL)
+	return d
+}
+
+// HTTPClient makes every request of the kelp command line, honouring the
+// proxy and TLS settings.
+var HTTPClient = http.DefaultClient
+
+// Releases caches github release metadata in the cache dir.
+var Releases = &utils.ReleaseCache{Dir: filepath.Join(KelpDir, "cache", "releases"), TTL: 15 * time.Minute}
+
+// Active holds the settings in effect for this run. It starts out as the
+// defaults and is replaced by Apply once the config file and flags are known.
+var Active = DefaultSettings()
+
+// DefaultSettings returns the settings used when nothing else is configured.
+func DefaultSettings() Settings {
+	return Settings{
+		BinDir:         filepath.Join(KelpDir, "bin"),
+		CacheDir:       filepath.Join(KelpDir, "cache"),
+		Parallelism:    4,
+		DefaultChannel: ChannelLatest,
+		Timeout:        "30s",
+		MetadataTTL:    "15m",
+		TrustedRoot:    filepath.Join(KelpDir, "trusted_root.json"),
+	}
+}
+
+// Merge returns a copy of s with every field that is set in override
+// replacing its counterpart.
+func (s Settings) Merge(override Settings) Settings {
+	if override.BinDir != "" {
+		s.BinDir = override.BinDir
+	}
+	if override.CacheDir != "" {
+		s.CacheDir = override.CacheDir
+	}
+	if override.Parallelism != 0 {
+		s.Parallelism = override.Parallelism
+	}
+	if override.DefaultChannel != "" {
+		s.DefaultChannel = override.DefaultChannel
+	}
+	if len(override.AssetPreferences) > 0 {
+		s.AssetPreferences = override.AssetPreferences
+	}
+	if override.Proxy != "" {
+		s.Proxy = override.Proxy
+	}
+	if len(override.NoProxy) > 0 {
+		s.NoProxy = override.NoProxy
+	}
+	if override.CABundle != "" {
+		s.CABundle = override.CABundle
+	}
+	if override.ClientCert != "" {
+		s.ClientCert = override.ClientCert
+	}
+	if override.ClientKey != "" {
+		s.ClientKey = override.ClientKey
+	}
+	if override.Timeout != "" {
+		s.Timeout = override.Timeout
+	}
+	if override.MetadataTTL != "" {
+		s.MetadataTTL = override.MetadataTTL
+	}
+	if override.TrustedRoot != "" {
+		s.TrustedRoot = override.TrustedRoot
+	}
+	if override.Offline != nil {
+		s.Offline = override.Offline
+	}
+	if override.Shims != nil {
+		s.Shims = override.Shims
+	}
+	if override.AutoInstall != nil {
+		s.AutoInstall = override.AutoInstall
+	}
+	if override.Scripts != nil {
+		s.Scripts = override.Scripts
+	}
+	return s
+}
+
+// Validate reports settings that cannot be used.
+func (s Settings) Validate() error {
+	if s.Parallelism < 1 {
+		return fmt.Errorf("parallelism must be at least 1, got %d", s.Parallelism)
+	}
+	if s.DefaultChannel != ChannelLatest && s.DefaultChannel != ChannelPrerelease {
+		return fmt.Errorf("unknown default channel %q, use %s or %s", s.DefaultChannel, ChannelLatest, ChannelPrerelease)
+	}
+	if d, err := time.ParseDuration(s.Timeout); err != nil || d < 0 {
+		return fmt.Errorf("invalid timeout %q, use a duration such as 30s or 2m", s.Timeout)
+	}
+	if d, err := time.ParseDuration(s.MetadataTTL); err != nil || d < 0 {
+		return fmt.Errorf("invalid metadata ttl %q, use a duration such as 15m or 1h", s.MetadataTTL)
+	}
+	return nil
+}
+
+// Apply layers s over the defaults and makes the result the Active settings,
+// pointing KelpBin, KelpCache, KelpStore, KelpShare and KelpVerified at the
+// configured directories.
+func Apply(s Settings) error {
+	s = DefaultSettings().Merge(s)
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	s.BinDir = expandHome(s.BinDir)
+	s.CacheDir = expandHome(s.CacheDir)
+	s.CABundle = expandHome(s.CABundle)
+	s.ClientCert = expandHome(s.ClientCert)
+	s.ClientKey = expandHome(s.ClientKey)
+	s.TrustedRoot = expandHome(s.TrustedRoot)
+	credentials, err := auth.Load(filepath.Join(KelpDir, "credentials"))
+	if err != nil {
+		return err
+	}
+	client, err := utils.NewHTTPClient(utils.HTTPOptions{
+		Proxy:       s.Proxy,
+		NoProxy:     s.NoProxy,
+		CABundle:    s.CABundle,
+		ClientCert:  s.ClientCert,
+		ClientKey:   s.ClientKey,
+		Credentials: credentials,
+		Timeout:     s.TimeoutDuration(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.IsOffline() {
+		client = utils.OfflineClient()
+	}
+
+	Active = s
+	HTTPClient = client
+	Releases = &utils.ReleaseCache{Dir: filepath.Join(s.CacheDir, "releases"), TTL: s.MetadataTTLDuration(), Offline: s.IsOffline()}
+	KelpBin = s.BinDir
+	KelpCache = s.CacheDir
+	// versioned installs, man pages and signature records sit next to the
+	// bin dir, so a bin dir of /opt/tools/bin keeps them under /opt/tools
+	root := filepath.Dir(s.BinDir)
+	KelpStore = filepath.Join(root, "store")
+	KelpShare = filepath.Join(root, "share")
+	KelpVerified = filepath.Join(root, "verified")
+	return nil
+}
+
+// expandHome resolves a leading ~ so paths in shared configs stay portable.
+func expandHome(path string) string {
+	if path == "~" {
+		return home
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(home, path[2:])
+	}
+	return path
+}
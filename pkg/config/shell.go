@@ -0,0 +1,182 @@
+package config
+
+import (
+	"crhuber/kelp/pkg/install"
+	"crhuber/kelp/pkg/types"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Shells kelp shellenv writes the environment for.
+var Shells = []string{"bash", "zsh", "fish", "powershell"}
+
+// DetectShell returns the user's shell from $SHELL, or bash when it isn't
+// one kelp knows.
+func DetectShell() string {
+	shell := filepath.Base(os.Getenv("SHELL"))
+	if shell == "pwsh" {
+		return "powershell"
+	}
+	if slices.Contains(Shells, shell) {
+		return shell
+	}
+	return "bash"
+}
+
+// ShellEnv returns the shell code that puts KelpBin on the PATH, the man
+// pages in KelpShare on the MANPATH and loads the shell completions kelp
+// installed.
+func ShellEnv(shell string) (string, error) {
+	man := filepath.Join(KelpShare, install.ManDir)
+	var b strings.Builder
+	switch shell {
+	case "bash", "zsh":
+		bin, man := shQuote(KelpBin), shQuote(man)
+		fmt.Fprintf(&b, "case \":$PATH:\" in\n  *:%s:*) ;;\n  *) export PATH=%s:\"$PATH\" ;;\nesac\n", bin, bin)
+		// a MANPATH ending in : still has the system man pages
+		fmt.Fprintf(&b, "case \":${MANPATH:-}:\" in\n  *:%s:*) ;;\n  *) export MANPATH=%s:\"${MANPATH:-}\" ;;\nesac\n", man, man)
+		if shell == "zsh" {
+			// kelp init --shell adds this after compinit has usually run, which
+			// then has to run again to load the completions
+			fmt.Fprintf(&b, "completions=%s\nif (( ! ${fpath[(Ie)$completions]} )); then\n  fpath=(\"$completions\" $fpath)\n  if (( $+functions[compdef] )); then\n    autoload -Uz compinit && compinit\n  fi\nfi\nunset completions\n", shQuote(filepath.Join(KelpShare, install.ZshCompletionDir)))
+		} else {
+			fmt.Fprintf(&b, "for completion in %s/*; do\n  [ -r \"$completion\" ] && . \"$completion\"\ndone\nunset completion\n", shQuote(filepath.Join(KelpShare, install.BashCompletionDir)))
+		}
+	case "fish":
+		bin, man, completions := fishQuote(KelpBin), fishQuote(man), fishQuote(filepath.Join(KelpShare, install.FishCompletionDir))
+		fmt.Fprintf(&b, "contains %s $PATH; or set -gx PATH %s $PATH\n", bin, bin)
+		fmt.Fprintf(&b, "set -q MANPATH; or set -gx MANPATH ''\n")
+		fmt.Fprintf(&b, "contains %s $MANPATH; or set -gx MANPATH %s $MANPATH\n", man, man)
+		fmt.Fprintf(&b, "contains %s $fish_complete_path; or set -g fish_complete_path %s $fish_complete_path\n", completions, completions)
+	case "powershell":
+		fmt.Fprintf(&b, "$env:PATH = '%s' + [IO.Path]::PathSeparator + $env:PATH\n", psQuote(KelpBin))
+		fmt.Fprintf(&b, "$env:MANPATH = '%s' + [IO.Path]::PathSeparator + $env:MANPATH\n", psQuote(man))
+	default:
+		return "", fmt.Errorf("unknown shell %q, use one of %s", shell, strings.Join(Shells, ", "))
+	}
+	return b.String(), nil
+}
+
+// shQuote quotes s for sh, bash and zsh.
+func shQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// psQuote escapes s for a single quoted powershell string.
+func psQuote(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+// RcFile returns the startup file of shell that kelp init --shell adds kelp
+// to.
+func RcFile(shell string) (string, error) {
+	switch shell {
+	case "bash":
+		// terminals on macOS start login shells, which don't read .bashrc
+		if types.IsDarwin() {
+			return filepath.Join(home, ".bash_profile"), nil
+		}
+		return filepath.Join(home, ".bashrc"), nil
+	case "zsh":
+		dir := os.Getenv("ZDOTDIR")
+		if dir == "" {
+			dir = home
+		}
+		return filepath.Join(dir, ".zshrc"), nil
+	case "fish":
+		return filepath.Join(home, ".config", "fish", "config.fish"), nil
+	case "powershell":
+		return filepath.Join(home, ".config", "powershell", "Microsoft.PowerShell_profile.ps1"), nil
+	}
+	return "", fmt.Errorf("unknown shell %q, use one of %s", shell, strings.Join(Shells, ", "))
+}
+
+// EvalLine returns the line of a shell's startup file that runs the output
+// of kelp shellenv, with kelp the path of the kelp executable.
+func EvalLine(shell, kelp string) string {
+	switch shell {
+	case "fish":
+		return fmt.Sprintf("%s shellenv fish | source", fishQuote(kelp))
+	case "powershell":
+		return fmt.Sprintf("& '%s' shellenv powershell | Out-String | Invoke-Expression", psQuote(kelp))
+	}
+	return fmt.Sprintf("eval \"$(%s shellenv %s)\"", shQuote(kelp), shell)
+}
+
+// AddToShell appends the eval line of shell to its startup file, unless it
+// already runs kelp shellenv. It returns the file and whether it was
+// changed.
+func AddToShell(shell, kelp string) (string, bool, error) {
+	rc, err := RcFile(shell)
+	if err != nil {
+		return "", false, err
+	}
+	line := EvalLine(shell, kelp)
+	contents, err := os.ReadFile(rc)
+	if err != nil && !os.IsNotExist(err) {
+		return rc, false, err
+	}
+	for _, l := range strings.Split(string(contents), "\n") {
+		if strings.Contains(l, "kelp") && strings.Contains(l, "shellenv") {
+			return rc, false, nil
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(rc), 0755)
+	if err != nil {
+		return rc, false, err
+	}
+	f, err := os.OpenFile(rc, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return rc, false, err
+	}
+	prefix := ""
+	if len(contents) > 0 {
+		prefix = "\n"
+		if !strings.HasSuffix(string(contents), "\n") {
+			prefix = "\n\n"
+		}
+	}
+	_, err = fmt.Fprintf(f, "%s# added by kelp init\n%s\n", prefix, line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return rc, err == nil, err
+}
+
+// PathWarnings returns the problems with how KelpBin is on path, a PATH
+// value: that it is missing, or that binaries in it are shadowed by ones
+// with the same name in directories before it.
+func PathWarnings(path string) []string {
+	bin := filepath.Clean(KelpBin)
+	dirs := filepath.SplitList(path)
+	position := slices.IndexFunc(dirs, func(dir string) bool { return dir != "" && filepath.Clean(dir) == bin })
+	if position == -1 {
+		return []string{fmt.Sprintf("%s is not on your PATH, run kelp init --shell", KelpBin)}
+	}
+	warnings := []string{}
+	entries, err := os.ReadDir(bin)
+	if err != nil {
+		return warnings
+	}
+	for _, e := range entries {
+		for _, dir := range dirs[:position] {
+			if dir == "" || filepath.Clean(dir) == bin {
+				continue
+			}
+			info, err := os.Stat(filepath.Join(dir, e.Name()))
+			if err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+				warnings = append(warnings, fmt.Sprintf("%s in %s shadows the one in %s, put %s earlier on your PATH", e.Name(), dir, KelpBin, KelpBin))
+				break
+			}
+		}
+	}
+	return warnings
+}
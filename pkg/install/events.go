@@ -0,0 +1,121 @@
+package install
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// EventType identifies a step an Installer reports.
+type EventType int
+
+const (
+	// Resolving is sent while a github release is looked up.
+	Resolving EventType = iota
+	// Candidate is sent for each release asset that suits the platform.
+	Candidate
+	// Selected is sent with the release asset chosen for download.
+	Selected
+	// Downloading is sent before a file is downloaded.
+	Downloading
+	// Cached is sent when a download is already in the cache.
+	Cached
+	// Verified is sent when a download's signature checks out.
+	Verified
+	// Extracting is sent before an archive is extracted.
+	Extracting
+	// Installed is sent for each binary, man page or completion copied to
+	// its destination.
+	Installed
+	// Skipped is sent for each extracted file that is not a binary.
+	Skipped
+	// Unquarantining is sent before the macOS quarantine flag is removed
+	// from an installed binary.
+	Unquarantining
+	// Shimmed is sent for each shim placed in the bin dir.
+	Shimmed
+	// Warning reports a problem that did not stop the install.
+	Warning
+)
+
+// Event describes a step of an install.
+type Event struct {
+	Type    EventType
+	Message string
+	// Path is the file the event is about, when there is one.
+	Path string
+}
+
+// Events receives progress from an Installer. Implementations must be safe
+// for concurrent use when packages are installed in parallel.
+type Events interface {
+	// Event reports a step of an install.
+	Event(e Event)
+	// Progress reports the bytes downloaded so far. total is -1 when the size
+	// is not known.
+	Progress(name string, done, total int64)
+}
+
+// Console prints events the way the kelp command line does, with a progress
+// bar on stderr for downloads.
+type Console struct {
+	Out io.Writer
+
+	mu   sync.Mutex
+	bars map[string]*progressbar.ProgressBar
+}
+
+var prefixes = map[EventType]string{
+	Resolving:      "🌐 ",
+	Selected:       "🍏 ",
+	Downloading:    "===> ",
+	Verified:       "🔏 ",
+	Extracting:     "📂 ",
+	Installed:      "✅ ",
+	Unquarantining: "🛃 ",
+	Shimmed:        "🔗 ",
+	Warning:        "⚠️  ",
+}
+
+func (c *Console) Event(e Event) {
+	out := c.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	fmt.Fprintf(out, "%s%s\n", prefixes[e.Type], e.Message)
+}
+
+func (c *Console) Progress(name string, done, total int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bars == nil {
+		c.bars = map[string]*progressbar.ProgressBar{}
+	}
+	bar, ok := c.bars[name]
+	if !ok {
+		bar = progressbar.DefaultBytes(total, "Downloading")
+		c.bars[name] = bar
+	}
+	bar.Set64(done)
+	if total >= 0 && done >= total {
+		bar.Finish()
+		delete(c.bars, name)
+	}
+}
+
+// progressWriter forwards the number of bytes written to Events.
+type progressWriter struct {
+	events Events
+	name   string
+	done   int64
+	total  int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.done += int64(len(p))
+	pw.events.Progress(pw.name, pw.done, pw.total)
+	return len(p), nil
+}
@@ -0,0 +1,181 @@
+package install
+
+import (
+	"bytes"
+	"crhuber/kelp/pkg/types"
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// elfMachines are the ELF machines binaries for each architecture are built
+// for.
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"loong64": elf.EM_LOONGARCH,
+	"ppc64le": elf.EM_PPC64,
+	"riscv64": elf.EM_RISCV,
+	"s390x":   elf.EM_S390,
+}
+
+// machoCpus are the Mach-O cpu types binaries for each architecture are
+// built for.
+var machoCpus = map[string]macho.Cpu{
+	"386":   macho.Cpu386,
+	"amd64": macho.CpuAmd64,
+	"arm64": macho.CpuArm64,
+}
+
+// builtFor returns the architecture a binary was built for, by its go name
+// where there is one.
+func builtFor[T comparable](targets map[string]T, target T, fallback string) string {
+	for name, t := range targets {
+		if t == target {
+			return name
+		}
+	}
+	return fallback
+}
+
+// arch returns the go name of an architecture given as uname does.
+func arch(name string) string {
+	switch name {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	}
+	return name
+}
+
+// executable reports whether the file at path runs on platform: an ELF or
+// Mach-O executable for its os and architecture, or when scripts is set a
+// script with a shebang and an executable bit. The reason says why not
+// otherwise.
+func executable(path string, platform *types.Capabilities, scripts bool) (bool, string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false, "not an executable"
+	}
+	be, le := binary.BigEndian.Uint32(magic), binary.LittleEndian.Uint32(magic)
+	switch {
+	case string(magic) == elf.ELFMAG:
+		return elfExecutable(f, platform)
+	case be == macho.MagicFat:
+		return fatExecutable(f, platform)
+	case be == macho.Magic32, be == macho.Magic64, le == macho.Magic32, le == macho.Magic64:
+		return machoExecutable(f, platform)
+	case bytes.HasPrefix(magic, []byte("#!")):
+		info, err := f.Stat()
+		switch {
+		case err != nil:
+			return false, err.Error()
+		case !scripts:
+			return false, "is a script, turn on the scripts setting to install it"
+		case info.Mode()&0111 == 0:
+			return false, "is a script that isn't executable"
+		}
+		return true, ""
+	}
+	return false, "not an executable"
+}
+
+// elfExecutable checks an ELF file is a program, not a library, and is for
+// platform. Position independent executables are shared objects too, and
+// told apart by their interpreter or PIE flag.
+func elfExecutable(r io.ReaderAt, platform *types.Capabilities) (bool, string) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return false, fmt.Sprintf("invalid ELF file: %s", err)
+	}
+	if platform.OS != types.Linux {
+		return false, "is a linux executable"
+	}
+	switch f.Type {
+	case elf.ET_EXEC:
+	case elf.ET_DYN:
+		if !isPIE(f) {
+			return false, "is a shared library"
+		}
+	default:
+		return false, fmt.Sprintf("is an ELF %s", f.Type)
+	}
+	want, ok := elfMachines[arch(platform.Arch)]
+	if ok && f.Machine != want {
+		return false, fmt.Sprintf("is built for %s, not %s", builtFor(elfMachines, f.Machine, f.Machine.String()), platform.Arch)
+	}
+	return true, ""
+}
+
+func isPIE(f *elf.File) bool {
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return true
+		}
+	}
+	flags, _ := f.DynValue(elf.DT_FLAGS_1)
+	for _, flag := range flags {
+		if elf.DynFlag1(flag)&elf.DF_1_PIE != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// machoExecutable checks a Mach-O file is a program for platform.
+func machoExecutable(r io.ReaderAt, platform *types.Capabilities) (bool, string) {
+	f, err := macho.NewFile(r)
+	if err != nil {
+		return false, fmt.Sprintf("invalid Mach-O file: %s", err)
+	}
+	if platform.OS != types.Darwin {
+		return false, "is a macOS executable"
+	}
+	if f.Type != macho.TypeExec {
+		return false, fmt.Sprintf("is a Mach-O %s", f.Type)
+	}
+	want, ok := machoCpus[arch(platform.Arch)]
+	if ok && f.Cpu != want {
+		return false, fmt.Sprintf("is built for %s, not %s", builtFor(machoCpus, f.Cpu, f.Cpu.String()), platform.Arch)
+	}
+	return true, ""
+}
+
+// fatExecutable checks a universal binary holds a program for platform. The
+// magic is shared with java class files, which aren't executables.
+func fatExecutable(r io.ReaderAt, platform *types.Capabilities) (bool, string) {
+	f, err := macho.NewFatFile(r)
+	if err != nil {
+		return false, "not an executable"
+	}
+	if platform.OS != types.Darwin {
+		return false, "is a macOS executable"
+	}
+	want, ok := machoCpus[arch(platform.Arch)]
+	built := []string{}
+	for _, a := range f.Arches {
+		if a.Type != macho.TypeExec {
+			continue
+		}
+		if !ok || a.Cpu == want {
+			return true, ""
+		}
+		built = append(built, builtFor(machoCpus, a.Cpu, a.Cpu.String()))
+	}
+	if len(built) == 0 {
+		return false, "is a universal binary without an executable"
+	}
+	return false, fmt.Sprintf("is built for %s, not %s", strings.Join(built, " and "), platform.Arch)
+}
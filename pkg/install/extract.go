@@ -0,0 +1,164 @@
+package install
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archives"
+)
+
+// Limits on what extracting one archive may write, so a decompression bomb
+// fails instead of filling the disk.
+const (
+	DefaultMaxExtractSize  int64 = 4 << 30
+	DefaultMaxExtractFiles       = 100000
+)
+
+// extraction writes the entries of an archive into dir. Every entry must
+// stay inside dir: paths that escape it are rejected, nothing is written
+// through a symlink, and links must point inside dir.
+type extraction struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	size     int64
+	files    int
+	links    []string
+}
+
+func (i *Installer) newExtraction(dir string) *extraction {
+	e := &extraction{dir: dir, maxSize: i.MaxExtractSize, maxFiles: i.MaxExtractFiles}
+	if e.maxSize <= 0 {
+		e.maxSize = DefaultMaxExtractSize
+	}
+	if e.maxFiles <= 0 {
+		e.maxFiles = DefaultMaxExtractFiles
+	}
+	return e
+}
+
+// local returns where the entry called name goes, relative to dir.
+func (e *extraction) local(name string) (string, error) {
+	local := filepath.Clean(filepath.FromSlash(name))
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("archive entry %s is outside the archive", name)
+	}
+	// nothing may be written through a link extracted before
+	parent := e.dir
+	for _, part := range strings.Split(filepath.Dir(local), string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %s is inside the link %s", name, part)
+		}
+	}
+	return local, nil
+}
+
+// extract writes one entry of the archive.
+func (e *extraction) extract(ctx context.Context, f archives.FileInfo) error {
+	local, err := e.local(f.NameInArchive)
+	if err != nil {
+		return err
+	}
+	e.files++
+	if e.files > e.maxFiles {
+		return fmt.Errorf("archive has more than %d files", e.maxFiles)
+	}
+	path := filepath.Join(e.dir, local)
+	if f.IsDir() {
+		return os.MkdirAll(path, f.Mode().Perm()|0700)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// a later entry replaces an earlier one rather than writing through it
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case f.Mode()&os.ModeSymlink != 0:
+		target := filepath.FromSlash(f.LinkTarget)
+		if filepath.IsAbs(target) || !filepath.IsLocal(filepath.Join(filepath.Dir(local), target)) {
+			return fmt.Errorf("archive link %s points outside the archive to %s", f.NameInArchive, f.LinkTarget)
+		}
+		e.links = append(e.links, path)
+		return os.Symlink(target, path)
+	case f.Mode().IsRegular() && f.LinkTarget != "":
+		// hard links name an earlier entry of the archive, which is copied
+		// so the two never share changes
+		target, err := e.local(f.LinkTarget)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(filepath.Join(e.dir, target))
+		if err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("archive link %s points to %s, which is not a file in the archive", f.NameInArchive, f.LinkTarget)
+		}
+		from, err := os.Open(filepath.Join(e.dir, target))
+		if err != nil {
+			return err
+		}
+		defer from.Close()
+		return e.write(ctx, path, info.Mode().Perm(), from)
+	case f.Mode().IsRegular():
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return e.write(ctx, path, f.Mode().Perm(), rc)
+	}
+	// devices, fifos and sockets are never needed to install a binary
+	return nil
+}
+
+// write copies r to a new file at path within the size limit.
+func (e *extraction) write(ctx context.Context, path string, perm os.FileMode, r io.Reader) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	n, err := io.Copy(out, io.LimitReader(&contextReader{ctx: ctx, r: r}, e.maxSize-e.size+1))
+	e.size += n
+	if err != nil {
+		return err
+	}
+	if e.size > e.maxSize {
+		return fmt.Errorf("archive extracts to more than %d bytes", e.maxSize)
+	}
+	return nil
+}
+
+// checkLinks makes sure every extracted link resolves inside dir once the
+// whole archive is written, since links to links can only be followed then.
+// Links to nothing are removed.
+func (e *extraction) checkLinks() error {
+	root, err := filepath.EvalSymlinks(e.dir)
+	if err != nil {
+		return err
+	}
+	for _, link := range e.links {
+		resolved, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			os.Remove(link)
+			continue
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("archive link %s points outside the archive", strings.TrimPrefix(link, e.dir+string(filepath.Separator)))
+		}
+	}
+	return nil
+}
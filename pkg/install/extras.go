@@ -0,0 +1,109 @@
+package install
+
+import (
+	"bytes"
+	"crhuber/kelp/pkg/utils"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Directories of the share dir man pages and shell completions are
+// installed into, laid out the way each tool searches them.
+const (
+	ManDir            = "man"
+	ZshCompletionDir  = "zsh/site-functions"
+	BashCompletionDir = "bash-completion"
+	FishCompletionDir = "fish"
+)
+
+// maxExtraSize bounds the files looked at, no man page or completion is
+// larger.
+const maxExtraSize = 1 << 20
+
+// manPage matches the file names of man pages, ie tool.1 or tool.1.gz.
+var manPage = regexp.MustCompile(`\.([1-9])[a-z]*(\.gz)?$`)
+
+// extra returns where a man page or shell completion goes in the share dir,
+// or "" when the file at path is neither. rel is where the file is in the
+// release. Files are told apart by their name and what is in them, since
+// releases lay them out in many ways.
+func extra(path, rel string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() > maxExtraSize {
+		return ""
+	}
+	contents, err := io.ReadAll(f)
+	if err != nil || bytes.Contains(contents, []byte{0}) && !bytes.HasPrefix(contents, []byte{0x1f, 0x8b}) {
+		return ""
+	}
+	name := filepath.Base(rel)
+	dir := strings.ToLower(filepath.ToSlash(filepath.Dir(rel)))
+
+	if m := manPage.FindStringSubmatch(name); m != nil {
+		// man pages are roff, either plain or gzipped
+		if bytes.HasPrefix(contents, []byte{0x1f, 0x8b}) || bytes.HasPrefix(contents, []byte(".")) || bytes.HasPrefix(contents, []byte("'\\\"")) {
+			return filepath.Join(ManDir, "man"+m[1], name)
+		}
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(contents, []byte("#compdef")):
+		if !strings.HasPrefix(name, "_") {
+			name = "_" + strings.TrimSuffix(name, ".zsh")
+		}
+		return filepath.Join(ZshCompletionDir, name)
+	case strings.HasSuffix(name, ".fish"):
+		if bytes.Contains(contents, []byte("complete -c")) || bytes.Contains(contents, []byte("complete --command")) {
+			return filepath.Join(FishCompletionDir, name)
+		}
+	case strings.HasSuffix(name, ".bash") || strings.HasSuffix(name, ".bash-completion") || strings.Contains(dir, "bash"):
+		if bytes.Contains(contents, []byte("complete -")) {
+			// bash-completion loads a command's completion from the file
+			// named after it
+			for _, suffix := range []string{".bash", ".bash-completion", ".sh", "-completion", "_completion"} {
+				name = strings.TrimSuffix(name, suffix)
+			}
+			return filepath.Join(BashCompletionDir, strings.TrimPrefix(name, "_"))
+		}
+	}
+	return ""
+}
+
+// installExtras copies the man pages and shell completions extracted to
+// tempDir into ShareDir.
+func (i *Installer) installExtras(tempDir string) error {
+	files, err := utils.FilePathWalkDir(tempDir)
+	if err != nil {
+		return fmt.Errorf("could not walk directory: %w", err)
+	}
+	for _, file := range files {
+		rel, err := filepath.Rel(tempDir, file)
+		if err != nil {
+			return err
+		}
+		destination := extra(file, rel)
+		if destination == "" {
+			continue
+		}
+		destination = filepath.Join(i.ShareDir, destination)
+		err = os.MkdirAll(filepath.Dir(destination), 0755)
+		if err != nil {
+			return err
+		}
+		err = utils.CopyFile(file, destination)
+		if err != nil {
+			return err
+		}
+		i.emit(Installed, destination, "Installed %v !", strings.TrimPrefix(destination, i.ShareDir+string(filepath.Separator)))
+	}
+	return nil
+}
@@ -2,24 +2,25 @@ package install
 
 import (
 	"context"
-	"crhuber/kelp/pkg/config"
+	"crhuber/kelp/pkg/shim"
 	"crhuber/kelp/pkg/types"
+	"crhuber/kelp/pkg/unpack"
 	"crhuber/kelp/pkg/utils"
+	"crhuber/kelp/pkg/verify"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"sort"
 	"strings"
+	"time"
 
-	"github.com/gabriel-vasile/mimetype"
 	"github.com/mholt/archives"
-	"github.com/schollz/progressbar/v3"
 )
 
 // A data structure to hold key/value pairs
@@ -31,215 +32,653 @@ type Pair struct {
 // A slice of pairs that implements sort.Interface to sort by values
 type PairList []Pair
 
-func (p PairList) Len() int           { return len(p) }
-func (p PairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
-func (p PairList) Less(i, j int) bool { return p[i].Value < p[j].Value }
+func (p PairList) Len() int      { return len(p) }
+func (p PairList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
-func Install(owner, repo, release string) error {
-	// handle http packages
-	if strings.HasPrefix(release, "http") {
-		urlsplit := strings.SplitAfter(release, "/")
-		filename := urlsplit[len(urlsplit)-1]
-		downloadPath := filepath.Join(config.KelpCache, filename)
-		tempdir, _ := os.MkdirTemp("", "kelp")
-		err := downloadFile(downloadPath, release)
+// Less ranks equal scores by their position in the release, so the first
+// of them is picked rather than one at random.
+func (p PairList) Less(i, j int) bool {
+	return p[i].Value < p[j].Value || p[i].Value == p[j].Value && p[i].Key > p[j].Key
+}
+
+// Installer downloads release assets, extracts them and installs the
+// binaries they contain.
+type Installer struct {
+	// BinDir is where binaries are installed to.
+	BinDir string
+	// CacheDir is where downloads are kept.
+	CacheDir string
+	// StoreDir holds versioned installs, one directory per owner/repo/release.
+	StoreDir string
+	// Client makes every request. http.DefaultClient is used when nil. Use
+	// utils.NewHTTPClient with credentials for private repos.
+	Client *http.Client
+	// Releases caches github release metadata. Nothing is cached when nil.
+	Releases *utils.ReleaseCache
+	// Platform is the machine assets are picked and binaries recognised
+	// for. It is this one when nil.
+	Platform *types.Capabilities
+	// Offline installs from CacheDir and the release metadata in Releases
+	// only, failing for anything that isn't cached.
+	Offline bool
+	// Events receives progress. Nothing is reported when nil.
+	Events Events
+	// Trust is what the release signatures of each package, by owner/repo,
+	// must verify against. Packages without trust are installed unchecked.
+	Trust map[string]verify.Trust
+	// TrustedRoot is the sigstore trusted_root.json keyless cosign
+	// signatures are checked against.
+	TrustedRoot string
+	// VerifyDir is where the outcome of checking each release's signature is
+	// recorded. Nothing is recorded when empty.
+	VerifyDir string
+	// AssetPreferences rank release assets containing any of them higher.
+	AssetPreferences []string
+	// MaxExtractSize and MaxExtractFiles limit the bytes and entries one
+	// archive may extract. DefaultMaxExtractSize and DefaultMaxExtractFiles
+	// are used when zero.
+	MaxExtractSize  int64
+	MaxExtractFiles int
+	// ShareDir is where man pages and shell completions that come with a
+	// release are installed, under ManDir and the completion dirs. They are
+	// left out when empty.
+	ShareDir string
+	// Scripts installs scripts with a shebang and an executable bit as well
+	// as binaries.
+	Scripts bool
+	// ShimTarget is the kelp executable shims call back into. When set,
+	// Install puts packages in StoreDir and places shims in BinDir.
+	ShimTarget string
+}
+
+func (i *Installer) client() *http.Client {
+	if i.Client == nil {
+		return http.DefaultClient
+	}
+	return i.Client
+}
+
+func (i *Installer) platform() *types.Capabilities {
+	if i.Platform == nil {
+		return types.GetCapabilities()
+	}
+	return i.Platform
+}
+
+func (i *Installer) emit(t EventType, path, format string, args ...any) {
+	if i.Events != nil {
+		i.Events.Event(Event{Type: t, Message: fmt.Sprintf(format, args...), Path: path})
+	}
+}
+
+// Install installs a release of a github package, or the file at release when
+// it is a url, into BinDir. Cancelling ctx stops the install and keeps the
+// partial download in the cache so the next install resumes it.
+func (i *Installer) Install(ctx context.Context, owner, repo, release string) error {
+	if i.ShimTarget != "" {
+		return i.InstallVersion(ctx, owner, repo, release)
+	}
+	return i.installTo(ctx, owner, repo, release, i.BinDir)
+}
+
+// InstallVersion installs a release into its own directory in the versioned
+// store so several versions of a package can live side by side. A tag is
+// only installed once, the latest and prerelease channels are installed
+// again every time since they move on to new releases.
+func (i *Installer) InstallVersion(ctx context.Context, owner, repo, release string) error {
+	if i.StoreDir == "" {
+		return errors.New("installer has no store dir")
+	}
+	binDir := utils.StorePath(i.StoreDir, owner, repo, release)
+	channel := release == "latest" || release == "prerelease"
+	entries, err := os.ReadDir(binDir)
+	installed := err == nil && len(entries) > 0
+	if installed && !channel {
+		i.emit(Cached, binDir, "%s/%s:%s already installed.", owner, repo, release)
+	} else {
+		// keep the installed release until its replacement is in place
+		previous := binDir + ".kelp-previous"
+		if installed {
+			os.RemoveAll(previous)
+			err = os.Rename(binDir, previous)
+			if err != nil {
+				return err
+			}
+		}
+		err = os.MkdirAll(binDir, 0755)
+		if err == nil {
+			err = i.installTo(ctx, owner, repo, release, binDir)
+		}
 		if err != nil {
+			// leave no half installed version behind
+			os.RemoveAll(binDir)
+			if installed {
+				os.Rename(previous, binDir)
+			}
 			return err
 		}
-		err = extractPackage(downloadPath, tempdir)
+		os.RemoveAll(previous)
+	}
+	if i.ShimTarget != "" {
+		return i.writeShims(binDir)
+	}
+	return nil
+}
+
+// writeShims places a shim in the bin dir for every binary in dir.
+func (i *Installer) writeShims(dir string) error {
+	err := os.MkdirAll(i.BinDir, 0755)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// a shim for kelp would end up calling itself
+		if e.Name() == "kelp" {
+			err = utils.CopyFile(filepath.Join(dir, e.Name()), filepath.Join(i.BinDir, e.Name()))
+		} else {
+			i.emit(Shimmed, filepath.Join(i.BinDir, e.Name()), "Shimming %s...", e.Name())
+			err = shim.Write(i.BinDir, e.Name(), i.ShimTarget)
+		}
 		if err != nil {
 			return err
 		}
-		destinations := installBinary(tempdir)
-		if types.IsDarwin() {
-			for _, d := range destinations {
-				unquarantineFile(d)
+	}
+	return nil
+}
+
+// Download is a release asset fetched into the cache.
+type Download struct {
+	// Release is the github release the asset belongs to. It is nil for
+	// packages installed from a url.
+	Release *types.GithubRelease
+	// Path is the downloaded file in CacheDir.
+	Path string
+	// Signatures are the signatures covering the asset. Those the package's
+	// trust can check are downloaded to CacheDir with any checksum file they
+	// sign.
+	Signatures []verify.Signature
+	// Attestations is the file in CacheDir holding the github attestations
+	// of the asset, when the package's trust asks for its provenance.
+	Attestations string
+}
+
+// Download fetches the asset of a release that suits Platform into CacheDir
+// without installing it.
+func (i *Installer) Download(ctx context.Context, owner, repo, release string) (Download, error) {
+	// handle http packages
+	if strings.HasPrefix(release, "http") {
+		urlsplit := strings.SplitAfter(release, "/")
+		filename := urlsplit[len(urlsplit)-1]
+		downloadPath := filepath.Join(i.CacheDir, filename)
+		if i.Offline {
+			if !isCached(downloadPath, 0) {
+				return Download{}, fmt.Errorf("%s is not in the cache, run kelp install once while online", filename)
+			}
+			i.emit(Cached, downloadPath, "Offline, using %s from cache.", filename)
+		} else {
+			err := i.downloadFile(ctx, downloadPath, release, 0)
+			if err != nil {
+				return Download{}, err
 			}
 		}
-		os.RemoveAll(tempdir)
+		return Download{Path: downloadPath}, nil
+	}
 
-	} else {
-		asset, err := downloadGithubRelease(owner, repo, release)
+	ghr, asset, err := i.downloadGithubRelease(ctx, owner, repo, release)
+	if err != nil {
+		return Download{}, err
+	}
+	sigs, err := i.downloadSignatures(ctx, owner, repo, ghr, asset)
+	if err != nil {
+		return Download{}, err
+	}
+	download := Download{Release: &ghr, Path: filepath.Join(i.CacheDir, asset.Name), Signatures: sigs}
+	if trust, ok := i.Trust[owner+"/"+repo]; ok && trust.Provenance != nil {
+		download.Attestations, err = i.downloadAttestations(ctx, owner, repo, ghr, download.Path)
 		if err != nil {
-			return err
+			return Download{}, err
 		}
+	}
+	return download, nil
+}
 
-		downloadPath := filepath.Join(config.KelpCache, asset.Name)
-		tempdir, err := os.MkdirTemp("", "kelp")
-		if err != nil {
-			return err
+// downloadAttestations asks github for the attestations of the asset at
+// path and keeps them with its signatures.
+func (i *Installer) downloadAttestations(ctx context.Context, owner, repo string, ghr types.GithubRelease, path string) (string, error) {
+	name := filepath.Base(path)
+	attestations := filepath.Join(i.CacheDir, "signatures", owner, repo, ghr.TagName, name+".attestations.json")
+	if utils.FileExists(attestations) {
+		return attestations, nil
+	}
+	if i.Offline {
+		return "", fmt.Errorf("the attestations of %s are not in the cache, run kelp install once while online", name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	bs, err := utils.GetGithubAttestations(ctx, i.client(), owner, repo, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(attestations), 0755)
+	if err != nil {
+		return "", err
+	}
+	return attestations, os.WriteFile(attestations, bs, 0644)
+}
+
+// downloadSignatures fetches the signatures of asset that the package's
+// trust can check. They are kept apart from other downloads since names
+// like checksums.txt are shared by every release.
+func (i *Installer) downloadSignatures(ctx context.Context, owner, repo string, ghr types.GithubRelease, asset types.Asset) ([]verify.Signature, error) {
+	trust, ok := i.Trust[owner+"/"+repo]
+	if !ok {
+		return nil, nil
+	}
+	assets := map[string]types.Asset{}
+	names := []string{}
+	for _, a := range ghr.Assets {
+		assets[a.Name] = a
+		names = append(names, a.Name)
+	}
+	dir := filepath.Join(i.CacheDir, "signatures", owner, repo, ghr.TagName)
+	sigs := []verify.Signature{}
+	for _, sig := range verify.Find(names, asset.Name) {
+		path := filepath.Join(dir, sig.Path)
+		signed := filepath.Join(i.CacheDir, asset.Name)
+		if sig.Signed != asset.Name {
+			signed = filepath.Join(dir, sig.Signed)
 		}
-		err = extractPackage(downloadPath, tempdir)
+		sigs = append(sigs, verify.Signature{Path: path, Signed: signed})
+		if !trust.Accepts(sig.Path) {
+			continue
+		}
+		err := i.fetchAsset(ctx, path, assets[sig.Path])
 		if err != nil {
-			return err
+			return nil, err
 		}
-		destinations := installBinary(tempdir)
-		if runtime.GOOS == "darwin" {
-			for _, d := range destinations {
-				unquarantineFile(d)
+		if sig.Signed != asset.Name {
+			err = i.fetchAsset(ctx, signed, assets[sig.Signed])
+			if err != nil {
+				return nil, err
 			}
 		}
-		os.RemoveAll(tempdir)
-
 	}
-	return nil
+	return sigs, nil
 }
 
-func unquarantineFile(filepath string) error {
-	fmt.Printf("🛃 Unquarantining %s...\n", filepath)
-	cmd := exec.Command("xattr", "-d", "com.apple.quarantine", filepath)
-	err := cmd.Run()
+// fetchAsset downloads a release asset to path unless it is cached.
+func (i *Installer) fetchAsset(ctx context.Context, path string, asset types.Asset) error {
+	if isCached(path, int64(asset.Size)) {
+		return nil
+	}
+	if i.Offline {
+		return fmt.Errorf("%s is not in the cache, run kelp install once while online", asset.Name)
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
 		return err
 	}
+	return i.downloadFile(ctx, path, asset.URL, int64(asset.Size))
+}
+
+// verify checks the download against the package's trust before anything
+// in it is extracted, and records the outcome in VerifyDir.
+func (i *Installer) verify(owner, repo, release string, download Download) error {
+	result := verify.Result{Asset: filepath.Base(download.Path), Status: verify.Unsigned, CheckedAt: time.Now().UTC()}
+	var err error
+	if trust, ok := i.Trust[owner+"/"+repo]; ok {
+		result, err = i.verifyTrust(owner, repo, trust, download)
+	} else if download.Release != nil {
+		names := []string{}
+		for _, a := range download.Release.Assets {
+			names = append(names, a.Name)
+		}
+		if len(verify.Find(names, result.Asset)) > 0 {
+			result.Status = verify.Unchecked
+		}
+	}
+	result.Release = release
+	if download.Release != nil {
+		result.Release = download.Release.TagName
+	}
+	if i.VerifyDir != "" {
+		if saveErr := verify.Save(i.VerifyDir, owner, repo, release, result); saveErr != nil {
+			i.emit(Warning, download.Path, "Could not record the signature check of %s: %s", result.Asset, saveErr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not verify %s: %w", result.Asset, err)
+	}
+	if result.Status == verify.Verified && result.Signer != "" {
+		i.emit(Verified, download.Path, "Verified %s signature of %s from %s", result.Method, result.Asset, result.Signer)
+	}
+	if result.Builder != "" {
+		i.emit(Verified, download.Path, "Verified provenance of %s, built by %s", result.Asset, result.Builder)
+	}
 	return nil
 }
 
-// downloadFile downloads files
-func downloadFile(filepath string, url string) error {
-	fmt.Printf("===> Downloading %s...\n", url)
-	fmt.Printf("To: %s...\n", filepath)
+// verifyTrust checks the download's signatures and then its provenance, as
+// far as trust asks for them.
+func (i *Installer) verifyTrust(owner, repo string, trust verify.Trust, download Download) (verify.Result, error) {
+	if trust.Provenance != nil && trust.Provenance.Repository == "" {
+		provenance := *trust.Provenance
+		provenance.Repository = owner + "/" + repo
+		trust.Provenance = &provenance
+	}
+	verifier := verify.Verifier{Trust: trust, TrustedRoot: i.TrustedRoot}
+	result := verify.Result{Asset: filepath.Base(download.Path), Status: verify.Verified, Method: verify.Attestation, CheckedAt: time.Now().UTC()}
+	var err error
+	if trust.Signs() {
+		result, err = verifier.Verify(download.Path, download.Signatures)
+		if err != nil {
+			return result, err
+		}
+	}
+	if trust.Provenance == nil {
+		return result, nil
+	}
+	if download.Attestations == "" {
+		err = fmt.Errorf("%s has no build provenance attestation", result.Asset)
+	} else {
+		result.Builder, err = verifier.VerifyProvenance(download.Path, download.Attestations)
+	}
+	if err != nil {
+		result.Status = verify.Failed
+		result.Error = fmt.Sprintf("provenance: %s", err)
+		return result, fmt.Errorf("provenance: %w", err)
+	}
+	return result, nil
+}
 
-	// Get the data
-	req, _ := http.NewRequest("GET", url, nil)
-	// set headers for github auth
-	ghToken := os.Getenv("GITHUB_TOKEN")
-	if ghToken != "" {
-		fmt.Println("Using Github token in http request")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ghToken))
+func (i *Installer) installTo(ctx context.Context, owner, repo, release, binDir string) error {
+	download, err := i.Download(ctx, owner, repo, release)
+	if err != nil {
+		return err
 	}
-	req.Header.Set("Accept", "application/octet-stream")
-	resp, err := http.DefaultClient.Do(req)
+	err = i.verify(owner, repo, release, download)
+	if err != nil {
+		return err
+	}
+
+	tempdir, err := os.MkdirTemp("", "kelp")
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("\ninvalid HTTP status: %v", resp.StatusCode)
+	defer os.RemoveAll(tempdir)
+	if types.IsAppImage(download.Path) {
+		// an AppImage is the executable, installed under the repo's name
+		err = utils.CopyFile(download.Path, filepath.Join(tempdir, repo))
+	} else {
+		err = i.extractPackage(ctx, download.Path, tempdir)
 	}
-	defer resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	destinations, err := i.installBinary(tempdir, binDir)
+	if err != nil {
+		return err
+	}
+	if i.ShareDir != "" {
+		err = i.installExtras(tempdir)
+		if err != nil {
+			return fmt.Errorf("could not install man pages and completions: %w", err)
+		}
+	}
+	// only binaries for this mac can be quarantined
+	if types.IsDarwin() && i.platform().OS == types.Darwin {
+		for _, d := range destinations {
+			i.unquarantineFile(d)
+		}
+	}
+	return nil
+}
+
+func (i *Installer) unquarantineFile(filepath string) {
+	i.emit(Unquarantining, filepath, "Unquarantining %s...", filepath)
+	cmd := exec.Command("xattr", "-d", "com.apple.quarantine", filepath)
+	err := cmd.Run()
+	if err != nil {
+		i.emit(Warning, filepath, "Could not unquarantine %s: %s", filepath, err)
+	}
+}
 
-	// Create the file
-	out, err := os.Create(filepath)
+// downloadFile downloads files. The download is written to a .part file
+// which later attempts resume with a Range request when the server supports
+// it, and is only moved to filepath once complete. size is the expected
+// length in bytes, or 0 when it is not known, in which case downloads start
+// over instead of resuming.
+func (i *Installer) downloadFile(ctx context.Context, filepath string, url string, size int64) error {
+	i.emit(Downloading, filepath, "Downloading %s to %s...", url, filepath)
+
+	part := filepath + ".part"
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var resumable bool
+		resumable, err = i.downloadPart(ctx, part, url, size)
+		if err == nil || !resumable || ctx.Err() != nil {
+			break
+		}
+		i.emit(Warning, filepath, "Download of %s interrupted, resuming: %s", url, err)
+	}
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
-	// Write the body to file
-	bar := progressbar.DefaultBytes(
-		resp.ContentLength,
-		"Downloading",
-	)
-	_, err = io.Copy(io.MultiWriter(out, bar), resp.Body)
+	if size > 0 {
+		info, err := os.Stat(part)
+		if err != nil {
+			return err
+		}
+		if info.Size() != size {
+			removePart(part)
+			return fmt.Errorf("downloaded %d bytes of %s, expected %d", info.Size(), url, size)
+		}
+	}
+	err = os.Rename(part, filepath)
 	if err != nil {
 		return err
 	}
+	os.Remove(part + ".validator")
 	return nil
 }
 
-func extractPackage(downloadPath, tempDir string) error {
-	fmt.Printf("📂 Extracting %s\n", downloadPath)
+// removePart removes a partial download and the validator it was
+// downloaded with.
+func removePart(part string) {
+	os.Remove(part)
+	os.Remove(part + ".validator")
+}
 
-	// Handle dmg files
-	if strings.HasSuffix(downloadPath, ".dmg") {
-		fmt.Println("Skipping dmg..")
-		return errors.New("kelp does not support dmg files")
+// downloadPart downloads whatever part is missing. It reports whether the
+// server supports resuming so an interrupted download can be continued.
+// The ETag or Last-Modified of the download is kept next to the part and
+// sent with If-Range, so a part is only continued with the same file.
+func (i *Installer) downloadPart(ctx context.Context, part, url string, size int64) (bool, error) {
+	var offset int64
+	validator := ""
+	if info, err := os.Stat(part); err == nil && size > 0 {
+		if bs, err := os.ReadFile(part + ".validator"); err == nil && len(bs) > 0 {
+			offset, validator = info.Size(), string(bs)
+		}
 	}
-
-	// Check if it's a file without extension (binary)
-	fp := strings.SplitAfter(downloadPath, "/")
-	fn := fp[len(fp)-1]
-	if !strings.Contains(fn, ".") {
-		fmt.Println("Found unextractable file. Installing instead")
-		installBinary(downloadPath)
-		return nil
+	if size > 0 && offset == size {
+		return true, nil
+	}
+	if offset > size {
+		// not a prefix of this file, start over
+		offset = 0
 	}
 
-	// Open the file
-	file, err := os.Open(downloadPath)
+	// Get the data
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("could not open archive: %w", err)
+		return false, err
 	}
-	defer file.Close()
-
-	// Use the correct Identify signature with context
-	ctx := context.Background()
-	format, stream, err := archives.Identify(ctx, downloadPath, file)
+	req.Header.Set("Accept", "application/octet-stream")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := i.client().Do(req)
 	if err != nil {
-		return fmt.Errorf("could not identify archive format: %w", err)
+		return false, err
 	}
+	defer resp.Body.Close()
 
-	// Check if the format supports extraction
-	extractor, ok := format.(archives.Extractor)
-	if !ok {
-		return fmt.Errorf("archive format does not support extraction")
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if offset == 0 || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			removePart(part)
+			return true, fmt.Errorf("server did not resume %s where it left off", url)
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// the server ignored the range or the file changed, and it sent the
+		// whole file
+		offset = 0
+		flags |= os.O_TRUNC
+		removePart(part)
+		validator = responseValidator(resp)
+		if size > 0 && validator != "" {
+			err = os.WriteFile(part+".validator", []byte(validator), 0644)
+			if err != nil {
+				return false, err
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the file changed since the part was downloaded
+		removePart(part)
+		return true, fmt.Errorf("could not resume download of %s", url)
+	default:
+		return false, fmt.Errorf("invalid HTTP status: %v", resp.StatusCode)
 	}
+	resumable := size > 0 && validator != "" && (resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Accept-Ranges") == "bytes")
 
-	// Extract all files to destination directory
-	err = extractor.Extract(ctx, stream, func(_ context.Context, f archives.FileInfo) error {
-		return extractFile(f, tempDir)
-	})
-
+	out, err := os.OpenFile(part, flags, 0644)
 	if err != nil {
-		return fmt.Errorf("extraction failed: %w", err)
+		return false, err
 	}
 
-	return nil
+	// Write the body to file
+	var w io.Writer = out
+	if i.Events != nil {
+		total := resp.ContentLength
+		if total >= 0 {
+			total += offset
+		}
+		w = io.MultiWriter(out, &progressWriter{events: i.Events, name: strings.TrimSuffix(part, ".part"), done: offset, total: total})
+	}
+	_, err = io.Copy(w, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return resumable, err
 }
 
-// Helper function to extract a single file
-func extractFile(f archives.FileInfo, destDir string) error {
-	extractPath := filepath.Join(destDir, f.NameInArchive)
-
-	if f.IsDir() {
-		return os.MkdirAll(extractPath, f.Mode())
+// responseValidator returns what identifies the version of a file a
+// response holds: its strong ETag, or else its Last-Modified date.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
 	}
+	return resp.Header.Get("Last-Modified")
+}
 
-	if err := os.MkdirAll(filepath.Dir(extractPath), 0755); err != nil {
-		return err
+func (i *Installer) extractPackage(ctx context.Context, downloadPath, tempDir string) error {
+	i.emit(Extracting, downloadPath, "Extracting %s", downloadPath)
+
+	// Check if it's a file without extension (binary)
+	fp := strings.SplitAfter(downloadPath, "/")
+	fn := fp[len(fp)-1]
+	if !strings.Contains(fn, ".") {
+		i.emit(Extracting, downloadPath, "Found unextractable file. Installing instead")
+		return utils.CopyFile(downloadPath, filepath.Join(tempDir, fn))
 	}
 
-	rc, err := f.Open()
+	// Open the file
+	file, err := os.Open(downloadPath)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not open archive: %w", err)
+	}
+	defer file.Close()
+
+	var extractor archives.Extractor
+	var stream io.Reader = file
+	switch {
+	// macOS packages and disk images are read from the file itself
+	case strings.HasSuffix(downloadPath, ".pkg"):
+		extractor = unpack.Pkg{}
+	case strings.HasSuffix(downloadPath, ".dmg"):
+		extractor = unpack.Dmg{}
+	// so are linux packages, which are unpacked without installing them
+	case strings.HasSuffix(downloadPath, ".deb"):
+		extractor = unpack.Deb{}
+	case strings.HasSuffix(downloadPath, ".rpm"):
+		extractor = unpack.Rpm{}
+	default:
+		format, identified, err := archives.Identify(ctx, downloadPath, file)
+		if err != nil {
+			return fmt.Errorf("could not identify archive format: %w", err)
+		}
+
+		// Check if the format supports extraction
+		var ok bool
+		extractor, ok = format.(archives.Extractor)
+		if !ok {
+			return fmt.Errorf("archive format does not support extraction")
+		}
+		stream = identified
 	}
-	defer rc.Close()
 
-	outFile, err := os.OpenFile(extractPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode())
+	// Extract all files to destination directory
+	extraction := i.newExtraction(tempDir)
+	err = extractor.Extract(ctx, stream, extraction.extract)
+	if err == nil {
+		err = extraction.checkLinks()
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("extraction failed: %w", err)
 	}
-	defer outFile.Close()
 
-	_, err = io.Copy(outFile, rc)
-	return err
+	return nil
 }
 
-func installBinary(tempDir string) []string {
-	fmt.Println("🧐 Checking for binary files in extract...")
+func (i *Installer) installBinary(tempDir, binDir string) ([]string, error) {
 	files, err := utils.FilePathWalkDir(tempDir)
 	if err != nil {
-		log.Panic("Could not walk directory")
+		return nil, fmt.Errorf("could not walk directory: %w", err)
 	}
 	destinations := []string{}
-	osCap := types.GetCapabilities()
 	for _, file := range files {
-		mime, _ := mimetype.DetectFile(string(file))
-		// only install binary files
-		if mime.String() == osCap.ExecutableMime {
+		ok, reason := executable(file, i.platform(), i.Scripts)
+		if ok {
 			splits := strings.SplitAfter(file, "/")
 			fileName := splits[len(splits)-1]
-			fmt.Printf("Binary file %s found in extract.\n", fileName)
-			destination := filepath.Join(config.KelpBin, fileName)
-			fmt.Printf("💾 Copying %v to kelp bin...\n", fileName)
-			utils.CopyFile(file, destination)
-			fmt.Printf("✅ Installed %v !\n", fileName)
+			destination := filepath.Join(binDir, fileName)
+			err = utils.CopyFile(file, destination)
+			if err != nil {
+				return destinations, fmt.Errorf("could not install %s: %w", fileName, err)
+			}
+			i.emit(Installed, destination, "Installed %v !", fileName)
 			destinations = append(destinations, destination)
 		} else {
-			fmt.Printf("Skipping non executable file: %v - %v\n", file, mime.String())
+			i.emit(Skipped, file, "Skipping %v: %v", file, reason)
 		}
 	}
-	return destinations
+	return destinations, nil
 }
 
 func getHighestScore(assetScores map[int]int) Pair {
@@ -273,18 +712,26 @@ func evaluateAssetSuitability(capabilities *types.Capabilities, asset types.Asse
 
 }
 
-func findGithubReleaseMacAssets(assets []types.Asset) (types.Asset, error) {
-
-	fmt.Println("🍏 Finding assets to download...")
-	assetScores := map[int]int{}
-	for index, asset := range assets {
-		filename := strings.Split(asset.BrowserDownloadURL, "/")
-		assetScore := evaluateAssetSuitability(types.GetCapabilities(), asset)
-		if assetScore >= 6 {
-			fmt.Printf("Found suitable candidate %v for download. Score: %v\n", filename[len(filename)-1], assetScore)
-			assetScores[index] = assetScore
+// preferenceBonus ranks assets matching one of the configured asset
+// preferences above otherwise equally suitable candidates.
+func preferenceBonus(preferences []string, asset types.Asset) int {
+	bdu := strings.SplitAfter(asset.BrowserDownloadURL, "/")
+	filename := strings.ToLower(bdu[len(bdu)-1])
+	for _, preference := range preferences {
+		if preference != "" && strings.Contains(filename, strings.ToLower(preference)) {
+			return 1
 		}
+	}
+	return 0
+}
+
+func (i *Installer) findGithubReleaseMacAssets(assets []types.Asset) (types.Asset, error) {
 
+	assetScores := i.scoreAssets(assets, false)
+	if len(assetScores) == 0 {
+		// .deb, .rpm and AppImage are only used when a release has no plain
+		// binary or archive
+		assetScores = i.scoreAssets(assets, true)
 	}
 	if len(assetScores) == 0 {
 		return types.Asset{}, errors.New("could not find a github asset")
@@ -294,30 +741,90 @@ func findGithubReleaseMacAssets(assets []types.Asset) (types.Asset, error) {
 	highest := getHighestScore(assetScores)
 	bestAsset := assets[highest.Key]
 	filename := strings.Split(bestAsset.BrowserDownloadURL, "/")
-	fmt.Printf("Adding highest ranked asset %v to download queue.\n", filename[len(filename)-1])
+	i.emit(Selected, "", "Adding highest ranked asset %v to download queue.", filename[len(filename)-1])
 	return bestAsset, nil
 }
 
-func downloadGithubRelease(owner, repo, release string) (types.Asset, error) {
-	fmt.Printf("===> Installing %s/%s:%s...\n", owner, repo, release)
-	ghr, err := utils.GetGithubRelease(owner, repo, release)
+// scoreAssets returns the scores of the suitable assets by their index,
+// looking only at linux packages or only at every other asset.
+func (i *Installer) scoreAssets(assets []types.Asset, packages bool) map[int]int {
+	platform := i.platform()
+	assetScores := map[int]int{}
+	for index, asset := range assets {
+		if asset.IsLinuxPackage() != packages {
+			continue
+		}
+		filename := strings.Split(asset.BrowserDownloadURL, "/")
+		assetScore := evaluateAssetSuitability(platform, asset)
+		suitable := assetScore >= 6
+		if packages {
+			// AppImages often leave the architecture out of their name
+			suitable = asset.IsSameOS(platform) && (asset.IsSameArchitecture(platform) || types.IsAppImage(asset.BrowserDownloadURL) && !asset.NamesArchitecture())
+		}
+		if suitable {
+			assetScore += preferenceBonus(i.AssetPreferences, asset)
+			i.emit(Candidate, "", "Found suitable candidate %v for download. Score: %v", filename[len(filename)-1], assetScore)
+			assetScores[index] = assetScore
+		}
+	}
+	return assetScores
+}
+
+func (i *Installer) downloadGithubRelease(ctx context.Context, owner, repo, release string) (types.GithubRelease, types.Asset, error) {
+	i.emit(Resolving, "", "Installing %s/%s:%s...", owner, repo, release)
+	releases := i.Releases
+	if i.Offline {
+		if releases == nil {
+			return types.GithubRelease{}, types.Asset{}, errors.New("offline installs need a release cache")
+		}
+		offline := *releases
+		offline.Offline = true
+		releases = &offline
+	}
+	ghr, err := releases.Get(ctx, i.client(), owner, repo, release)
 	if err != nil {
-		return types.Asset{}, err
+		return types.GithubRelease{}, types.Asset{}, err
 	}
-	downloadableAsset, err := findGithubReleaseMacAssets(ghr.Assets)
+	downloadableAsset, err := i.findGithubReleaseMacAssets(ghr.Assets)
 	if err != nil {
-		return types.Asset{}, err
+		return types.GithubRelease{}, types.Asset{}, err
 	}
 
-	downloadPath := filepath.Join(config.KelpCache, downloadableAsset.Name)
-	if utils.FileExists(downloadPath) {
-		fmt.Printf("File %v already exists in cache, skipping download.\n", downloadableAsset.Name)
+	downloadPath := filepath.Join(i.CacheDir, downloadableAsset.Name)
+	if isCached(downloadPath, int64(downloadableAsset.Size)) {
+		i.emit(Cached, downloadPath, "File %v already exists in cache, skipping download.", downloadableAsset.Name)
+	} else if i.Offline {
+		return types.GithubRelease{}, types.Asset{}, fmt.Errorf("%s for %s/%s:%s is not in the cache, run kelp install once while online", downloadableAsset.Name, owner, repo, release)
 	} else {
-		err := downloadFile(downloadPath, downloadableAsset.URL)
+		err := i.downloadFile(ctx, downloadPath, downloadableAsset.URL, int64(downloadableAsset.Size))
 		if err != nil {
-			return types.Asset{}, err
+			return types.GithubRelease{}, types.Asset{}, err
 		}
 	}
 
-	return downloadableAsset, nil
+	return ghr, downloadableAsset, nil
+}
+
+// isCached reports whether a complete download of size bytes is at path.
+// size is 0 when it is not known.
+func isCached(path string, size int64) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	return size == 0 || info.Size() == size
+}
+
+// contextReader stops reading once ctx is cancelled so large files don't
+// keep extracting after an interrupt.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
 }
@@ -0,0 +1,655 @@
+package install
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crhuber/kelp/pkg/install/installtest"
+	"crhuber/kelp/pkg/types"
+	"crhuber/kelp/pkg/utils"
+	"crhuber/kelp/pkg/verify"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/elf"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tarGz builds a gzipped tarball from a map of file names to contents.
+func tarGz(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, contents := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(contents)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(contents)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) Event(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) Progress(string, int64, int64) {}
+
+func (r *recorder) paths(t EventType) []string {
+	paths := []string{}
+	for _, e := range r.events {
+		if e.Type == t {
+			paths = append(paths, e.Path)
+		}
+	}
+	return paths
+}
+
+func TestInstallerInstallURL(t *testing.T) {
+	if !types.IsLinux() || runtime.GOARCH != "amd64" {
+		t.Skip("fixture binary is a linux amd64 executable")
+	}
+	archive := tarGz(t, map[string][]byte{
+		"tool_1.0/tool":      installtest.ELF(elf.EM_X86_64),
+		"tool_1.0/README.md": []byte("# tool\n"),
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	events := &recorder{}
+	installer := &Installer{
+		BinDir:   t.TempDir(),
+		CacheDir: t.TempDir(),
+		StoreDir: t.TempDir(),
+		Client:   server.Client(),
+		Events:   events,
+	}
+	require.NoError(t, installer.Install(context.Background(), "foo", "tool", server.URL+"/tool_1.0_linux_amd64.tar.gz"))
+	require.FileExists(t, filepath.Join(installer.BinDir, "tool"))
+	require.NoFileExists(t, filepath.Join(installer.BinDir, "README.md"))
+	require.FileExists(t, filepath.Join(installer.CacheDir, "tool_1.0_linux_amd64.tar.gz"))
+	require.Equal(t, []string{filepath.Join(installer.BinDir, "tool")}, events.paths(Installed))
+
+	// versioned installs land in the store and leave the bin dir alone
+	require.NoError(t, os.Remove(filepath.Join(installer.BinDir, "tool")))
+	require.NoError(t, installer.InstallVersion(context.Background(), "foo", "tool", server.URL+"/tool_1.0_linux_amd64.tar.gz"))
+	entries, err := os.ReadDir(installer.BinDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.Len(t, events.paths(Installed), 2)
+}
+
+func TestInstallVersionChannel(t *testing.T) {
+	if !types.IsLinux() || runtime.GOARCH != "amd64" {
+		t.Skip("fixture binary is a linux amd64 executable")
+	}
+	tag := "v1.0"
+	archives := map[string][]byte{
+		"v1.0": tarGz(t, map[string][]byte{"tool": installtest.ELF(elf.EM_X86_64)}),
+		"v2.0": tarGz(t, map[string][]byte{"tool": installtest.ELF(elf.EM_X86_64), "helper": installtest.ELF(elf.EM_X86_64)}),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/download/") {
+			archive, ok := archives[strings.TrimPrefix(r.URL.Path, "/download/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(archive)
+			return
+		}
+		name := "tool_" + tag + "_linux_amd64.tar.gz"
+		fmt.Fprintf(w, `{"tag_name": %q, "assets": [{"name": %q, "size": %d, "url": "http://%s/download/%[1]s", "browser_download_url": "https://example.com/%[2]s"}]}`, tag, name, len(archives[tag]), r.Host)
+	}))
+	defer server.Close()
+	defer func(api string) { utils.GithubAPI = api }(utils.GithubAPI)
+	utils.GithubAPI = server.URL
+
+	installer := &Installer{
+		BinDir:   t.TempDir(),
+		CacheDir: t.TempDir(),
+		StoreDir: t.TempDir(),
+		Client:   server.Client(),
+		Releases: &utils.ReleaseCache{Dir: t.TempDir()},
+	}
+	dir := utils.StorePath(installer.StoreDir, "foo", "tool", "latest")
+	require.NoError(t, installer.InstallVersion(context.Background(), "foo", "tool", "latest"))
+	require.FileExists(t, filepath.Join(dir, "tool"))
+	require.NoFileExists(t, filepath.Join(dir, "helper"))
+
+	// a new release on the channel replaces the installed one
+	tag = "v2.0"
+	require.NoError(t, installer.InstallVersion(context.Background(), "foo", "tool", "latest"))
+	require.FileExists(t, filepath.Join(dir, "helper"))
+
+	// a failed install keeps the installed release
+	tag = "v3.0"
+	require.ErrorContains(t, installer.InstallVersion(context.Background(), "foo", "tool", "latest"), "404")
+	require.FileExists(t, filepath.Join(dir, "helper"))
+	require.NoDirExists(t, dir+".kelp-previous")
+}
+
+func TestInstallerErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	installer := &Installer{BinDir: t.TempDir(), CacheDir: t.TempDir(), Client: server.Client()}
+	require.ErrorContains(t, installer.Install(context.Background(), "foo", "tool", server.URL+"/tool.tar.gz"), "404")
+	require.ErrorContains(t, installer.InstallVersion(context.Background(), "foo", "tool", "v1.0"), "no store dir")
+}
+
+func TestInstallerStalledDownload(t *testing.T) {
+	// send part of the file and then hang until the client gives up
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.Write(make([]byte, 512))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client, err := utils.NewHTTPClient(utils.HTTPOptions{Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	installer := &Installer{BinDir: t.TempDir(), CacheDir: t.TempDir(), Client: client}
+	err = installer.Install(context.Background(), "foo", "tool", server.URL+"/tool.tar.gz")
+	require.ErrorContains(t, err, "no data received")
+	require.NoFileExists(t, filepath.Join(installer.CacheDir, "tool.tar.gz"))
+	require.FileExists(t, filepath.Join(installer.CacheDir, "tool.tar.gz.part"))
+
+	// cancelling the context aborts the download the same way
+	installer.Client = server.Client()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = installer.Install(ctx, "foo", "tool", server.URL+"/tool.tar.gz")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NoFileExists(t, filepath.Join(installer.CacheDir, "tool.tar.gz"))
+}
+
+func TestDownloadResumes(t *testing.T) {
+	content := bytes.Repeat([]byte("kelp"), 1024)
+	etag := `"v1"`
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "tool.tar.gz", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	installer := &Installer{CacheDir: t.TempDir(), Client: server.Client()}
+	path := filepath.Join(installer.CacheDir, "tool.tar.gz")
+	require.NoError(t, os.WriteFile(path+".part", content[:1000], 0644))
+	require.NoError(t, os.WriteFile(path+".part.validator", []byte(etag), 0644))
+
+	require.NoError(t, installer.downloadFile(context.Background(), path, server.URL, int64(len(content))))
+	require.Equal(t, []string{"bytes=1000-"}, ranges)
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+	require.NoFileExists(t, path+".part")
+	require.NoFileExists(t, path+".part.validator")
+
+	// a part of a file that changed since is thrown away
+	old := bytes.Repeat([]byte("pleK"), 1024)
+	require.NoError(t, os.WriteFile(path+".part", old[:1000], 0644))
+	require.NoError(t, os.WriteFile(path+".part.validator", []byte(`"v0"`), 0644))
+	ranges = nil
+	require.NoError(t, installer.downloadFile(context.Background(), path, server.URL, int64(len(content))))
+	require.Equal(t, []string{"bytes=1000-"}, ranges)
+	got, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+
+	// so is one without a validator, or of a file of unknown size
+	for _, size := range []int64{int64(len(content)), 0} {
+		require.NoError(t, os.WriteFile(path+".part", old[:1000], 0644))
+		ranges = nil
+		require.NoError(t, installer.downloadFile(context.Background(), path, server.URL, size))
+		require.Equal(t, []string{""}, ranges)
+		got, err = os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+	}
+
+	// a download that doesn't match the expected size is thrown away
+	err = installer.downloadFile(context.Background(), path, server.URL, int64(len(content))+1)
+	require.ErrorContains(t, err, "expected")
+	require.NoFileExists(t, path+".part")
+}
+
+func TestInstallerOffline(t *testing.T) {
+	if !types.IsLinux() || runtime.GOARCH != "amd64" {
+		t.Skip("fixture binary is a linux amd64 executable")
+	}
+	name := "tool_1.0_linux_" + runtime.GOARCH + ".tar.gz"
+	archive := tarGz(t, map[string][]byte{"tool": installtest.ELF(elf.EM_X86_64)})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download" {
+			w.Write(archive)
+			return
+		}
+		fmt.Fprintf(w, `{"tag_name": "v1.0", "assets": [{"name": %q, "size": %d, "url": "http://%s/download", "browser_download_url": "https://example.com/%s"}]}`, name, len(archive), r.Host, name)
+	}))
+	defer func(api string) { utils.GithubAPI = api }(utils.GithubAPI)
+	utils.GithubAPI = server.URL
+
+	installer := &Installer{
+		BinDir:   t.TempDir(),
+		CacheDir: t.TempDir(),
+		Client:   server.Client(),
+		Releases: &utils.ReleaseCache{Dir: t.TempDir()},
+	}
+	require.NoError(t, installer.Install(context.Background(), "foo", "tool", "v1.0"))
+	server.Close()
+	require.NoError(t, os.Remove(filepath.Join(installer.BinDir, "tool")))
+
+	// a warm cache installs without the network
+	installer.Client = utils.OfflineClient()
+	installer.Offline = true
+	require.NoError(t, installer.Install(context.Background(), "foo", "tool", "v1.0"))
+	require.FileExists(t, filepath.Join(installer.BinDir, "tool"))
+
+	err := installer.Install(context.Background(), "foo", "tool", "v2.0")
+	require.ErrorContains(t, err, "not cached")
+	require.NoError(t, os.Remove(filepath.Join(installer.CacheDir, name)))
+	err = installer.Install(context.Background(), "foo", "tool", "v1.0")
+	require.ErrorContains(t, err, "not in the cache")
+}
+
+// fakeMachO returns the header of a macOS arm64 executable.
+func fakeMachO() []byte {
+	header := make([]byte, 32)
+	binary.LittleEndian.PutUint32(header, 0xfeedfacf)     // 64 bit magic
+	binary.LittleEndian.PutUint32(header[4:], 0x0100000c) // arm64
+	binary.LittleEndian.PutUint32(header[12:], 2)         // MH_EXECUTE
+	return header
+}
+
+func TestInstallerPlatform(t *testing.T) {
+	archive := tarGz(t, map[string][]byte{
+		"linux/tool":  installtest.ELF(elf.EM_X86_64),
+		"darwin/tool": fakeMachO(),
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	// the binary for the other os is skipped whatever this machine is
+	for platform, skipped := range map[string]string{"linux/amd64": "darwin", "darwin/arm64": "linux"} {
+		t.Run(platform, func(t *testing.T) {
+			target, err := types.ParsePlatform(platform)
+			require.NoError(t, err)
+			events := &recorder{}
+			installer := &Installer{BinDir: t.TempDir(), CacheDir: t.TempDir(), Client: server.Client(), Events: events, Platform: target}
+			require.NoError(t, installer.Install(context.Background(), "foo", "tool", server.URL+"/tool.tar.gz"))
+			require.Equal(t, []string{filepath.Join(installer.BinDir, "tool")}, events.paths(Installed))
+			require.Len(t, events.paths(Skipped), 1)
+			require.Equal(t, skipped, filepath.Base(filepath.Dir(events.paths(Skipped)[0])))
+		})
+	}
+}
+
+// fakePIE returns the header of a position independent linux executable,
+// which is a shared object with an interpreter. Without the interpreter it
+// is a shared library.
+func fakePIE(interpreter bool) []byte {
+	header := installtest.ELF(elf.EM_X86_64)
+	binary.LittleEndian.PutUint16(header[16:], 3) // ET_DYN
+	if !interpreter {
+		return header
+	}
+	binary.LittleEndian.PutUint64(header[32:], 64) // program headers
+	binary.LittleEndian.PutUint16(header[54:], 56)
+	binary.LittleEndian.PutUint16(header[56:], 1)
+	program := make([]byte, 56)
+	binary.LittleEndian.PutUint32(program, 3) // PT_INTERP
+	return append(header, program...)
+}
+
+// fakeFat returns a universal macOS binary of arm64 and amd64 executables.
+func fakeFat() []byte {
+	arm, amd := fakeMachO(), fakeMachO()
+	binary.LittleEndian.PutUint32(amd[4:], 0x01000007) // x86-64
+	fat := make([]byte, 64)
+	binary.BigEndian.PutUint32(fat, 0xcafebabe)
+	binary.BigEndian.PutUint32(fat[4:], 2)
+	for n, offset := range []uint32{64, 96} {
+		arch := fat[8+n*20:]
+		binary.BigEndian.PutUint32(arch, binary.LittleEndian.Uint32([][]byte{arm, amd}[n][4:]))
+		binary.BigEndian.PutUint32(arch[8:], offset)
+		binary.BigEndian.PutUint32(arch[12:], 32)
+	}
+	return append(append(fat, arm...), amd...)
+}
+
+func TestExecutable(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, contents []byte, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, contents, mode))
+		return path
+	}
+	exe := write("elf", installtest.ELF(elf.EM_X86_64), 0755)
+	arm := write("arm", installtest.ELF(elf.EM_AARCH64), 0755)
+	pie := write("pie", fakePIE(true), 0755)
+	library := write("library.so", fakePIE(false), 0644)
+	machO := write("macho", fakeMachO(), 0755)
+	fat := write("fat", fakeFat(), 0755)
+	class := write("Tool.class", []byte("\xca\xfe\xba\xbe\x00\x00\x00\x34"), 0644)
+	script := write("script", []byte("#!/bin/sh\necho hi\n"), 0755)
+	plain := write("plain.sh", []byte("#!/bin/sh\necho hi\n"), 0644)
+	readme := write("README.md", []byte("# tool\n"), 0644)
+
+	for _, test := range []struct {
+		path, platform string
+		scripts        bool
+		reason         string
+	}{
+		{path: exe, platform: "linux/amd64"},
+		{path: exe, platform: "linux/x86_64"},
+		{path: exe, platform: "linux/arm64", reason: "is built for amd64, not arm64"},
+		{path: exe, platform: "darwin/amd64", reason: "is a linux executable"},
+		{path: arm, platform: "linux/arm64"},
+		{path: arm, platform: "linux/amd64", reason: "is built for arm64, not amd64"},
+		{path: pie, platform: "linux/amd64"},
+		{path: library, platform: "linux/amd64", reason: "is a shared library"},
+		{path: machO, platform: "darwin/arm64"},
+		{path: machO, platform: "darwin/amd64", reason: "is built for arm64, not amd64"},
+		{path: machO, platform: "linux/arm64", reason: "is a macOS executable"},
+		{path: fat, platform: "darwin/arm64"},
+		{path: fat, platform: "darwin/amd64"},
+		{path: fat, platform: "darwin/386", reason: "is built for arm64 and amd64, not 386"},
+		{path: class, platform: "darwin/arm64", reason: "not an executable"},
+		{path: script, platform: "linux/amd64", reason: "is a script, turn on the scripts setting to install it"},
+		{path: script, platform: "linux/amd64", scripts: true},
+		{path: plain, platform: "linux/amd64", scripts: true, reason: "is a script that isn't executable"},
+		{path: readme, platform: "linux/amd64", scripts: true, reason: "not an executable"},
+	} {
+		t.Run(filepath.Base(test.path)+" "+test.platform, func(t *testing.T) {
+			platform, err := types.ParsePlatform(test.platform)
+			require.NoError(t, err)
+			ok, reason := executable(test.path, platform, test.scripts)
+			require.Equal(t, test.reason, reason)
+			require.Equal(t, test.reason == "", ok)
+		})
+	}
+}
+
+func TestExtra(t *testing.T) {
+	dir := t.TempDir()
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(".TH TOOL 1\n"))
+	require.NoError(t, gw.Close())
+
+	for rel, test := range map[string]struct {
+		contents    string
+		destination string
+	}{
+		"doc/tool.1":                   {".TH TOOL 1\n", "man/man1/tool.1"},
+		"man/tool-config.5.gz":         {gzipped.String(), "man/man5/tool-config.5.gz"},
+		"libtool.so.1":                 {"\x7fELF\x00\x00", ""},
+		"CHANGELOG.1":                  {"# 1.0\n", ""},
+		"completions/_tool":            {"#compdef tool\n_tool() {}\n", "zsh/site-functions/_tool"},
+		"completions/tool.zsh":         {"#compdef tool\n_tool() {}\n", "zsh/site-functions/_tool"},
+		"completions/tool.bash":        {"_tool() { :; }\ncomplete -F _tool tool\n", "bash-completion/tool"},
+		"autocomplete/bash/tool":       {"complete -o default -F _tool tool\n", "bash-completion/tool"},
+		"contrib/tool-completion.bash": {"complete -F _tool tool\n", "bash-completion/tool"},
+		"scripts/install.bash":         {"#!/bin/bash\ncp tool /usr/local/bin\n", ""},
+		"completions/tool.fish":        {"complete -c tool -l help\n", "fish/tool.fish"},
+		"config.fish":                  {"set -x PATH $PATH\n", ""},
+		"README.md":                    {"# tool\n", ""},
+	} {
+		t.Run(rel, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(rel, "/", "_"))
+			require.NoError(t, os.WriteFile(path, []byte(test.contents), 0644))
+			require.Equal(t, filepath.FromSlash(test.destination), extra(path, filepath.FromSlash(rel)))
+		})
+	}
+}
+
+func TestInstallerInstallsExtras(t *testing.T) {
+	archive := tarGz(t, map[string][]byte{
+		"tool_1.0/tool":                  installtest.ELF(elf.EM_X86_64),
+		"tool_1.0/doc/tool.1":            []byte(".TH TOOL 1\n"),
+		"tool_1.0/completions/_tool":     []byte("#compdef tool\n"),
+		"tool_1.0/completions/tool.bash": []byte("complete -F _tool tool\n"),
+		"tool_1.0/completions/tool.fish": []byte("complete -c tool -l help\n"),
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	platform, err := types.ParsePlatform("linux/amd64")
+	require.NoError(t, err)
+	installer := &Installer{BinDir: t.TempDir(), CacheDir: t.TempDir(), Client: server.Client(), Platform: platform}
+	require.NoError(t, installer.Install(context.Background(), "foo", "tool", server.URL+"/tool_1.0_linux_amd64.tar.gz"))
+	require.FileExists(t, filepath.Join(installer.BinDir, "tool"))
+	entries, err := os.ReadDir(installer.BinDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// with a share dir they are installed too
+	installer.ShareDir = t.TempDir()
+	require.NoError(t, installer.Install(context.Background(), "foo", "tool", server.URL+"/tool_1.0_linux_amd64.tar.gz"))
+	for _, extra := range []string{"man/man1/tool.1", "zsh/site-functions/_tool", "bash-completion/tool", "fish/tool.fish"} {
+		require.FileExists(t, filepath.Join(installer.ShareDir, extra))
+	}
+}
+
+func TestInstallerVerifiesSignatures(t *testing.T) {
+	name := "tool_1.0_linux_amd64.tar.gz"
+	archive := tarGz(t, map[string][]byte{"tool": installtest.ELF(elf.EM_X86_64)})
+	sum := sha256.Sum256(archive)
+	checksums := []byte(fmt.Sprintf("%x  %s\n", sum, name))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	digest := sha256.Sum256(checksums)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	files := map[string][]byte{
+		name:                archive,
+		"checksums.txt":     checksums,
+		"checksums.txt.sig": []byte(base64.StdEncoding.EncodeToString(sig)),
+	}
+	attested := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := strings.CutPrefix(r.URL.Path, "/download/"); ok {
+			w.Write(files[f])
+			return
+		}
+		if r.URL.Path == fmt.Sprintf("/repos/foo/tool/attestations/sha256:%x", sum) {
+			attested++
+			w.Write([]byte(`{"attestations": []}`))
+			return
+		}
+		if strings.Contains(r.URL.Path, "/attestations/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		assets := []string{}
+		for f, bs := range files {
+			assets = append(assets, fmt.Sprintf(`{"name": %q, "size": %d, "url": "http://%s/download/%[1]s", "browser_download_url": "https://example.com/%[1]s"}`, f, len(bs), r.Host))
+		}
+		fmt.Fprintf(w, `{"tag_name": "v1.0", "assets": [%s]}`, strings.Join(assets, ","))
+	}))
+	defer server.Close()
+	defer func(api string) { utils.GithubAPI = api }(utils.GithubAPI)
+	utils.GithubAPI = server.URL
+
+	pemKey := func(k *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+		require.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	platform, err := types.ParsePlatform("linux/amd64")
+	require.NoError(t, err)
+	newInstaller := func(trust map[string]verify.Trust) (*Installer, *recorder) {
+		events := &recorder{}
+		return &Installer{
+			BinDir:    t.TempDir(),
+			CacheDir:  t.TempDir(),
+			Client:    server.Client(),
+			Platform:  platform,
+			Trust:     trust,
+			VerifyDir: t.TempDir(),
+			Events:    events,
+		}, events
+	}
+
+	installer, events := newInstaller(map[string]verify.Trust{"foo/tool": {CosignKey: pemKey(key)}})
+	require.NoError(t, installer.Install(context.Background(), "foo", "tool", "latest"))
+	require.FileExists(t, filepath.Join(installer.BinDir, "tool"))
+	require.FileExists(t, filepath.Join(installer.CacheDir, "signatures", "foo", "tool", "v1.0", "checksums.txt.sig"))
+	require.Len(t, events.paths(Verified), 1)
+	r, err := verify.Load(installer.VerifyDir, "foo", "tool", "latest")
+	require.NoError(t, err)
+	require.Equal(t, verify.Verified, r.Status)
+	require.Equal(t, "v1.0", r.Release)
+
+	// without trust the signature is noted but not checked
+	installer, _ = newInstaller(nil)
+	require.NoError(t, installer.Install(context.Background(), "foo", "tool", "latest"))
+	r, err = verify.Load(installer.VerifyDir, "foo", "tool", "latest")
+	require.NoError(t, err)
+	require.Equal(t, verify.Unchecked, r.Status)
+
+	// a signature from another key stops the install before extracting
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	installer, _ = newInstaller(map[string]verify.Trust{"foo/tool": {CosignKey: pemKey(other)}})
+	err = installer.Install(context.Background(), "foo", "tool", "latest")
+	require.ErrorContains(t, err, "signature does not match")
+	require.NoFileExists(t, filepath.Join(installer.BinDir, "tool"))
+	r, err = verify.Load(installer.VerifyDir, "foo", "tool", "latest")
+	require.NoError(t, err)
+	require.Equal(t, verify.Failed, r.Status)
+
+	// provenance is looked up by the asset's digest, and a build github
+	// doesn't attest is refused even with a good signature
+	installer, _ = newInstaller(map[string]verify.Trust{"foo/tool": {CosignKey: pemKey(key), Provenance: &verify.Provenance{}}})
+	err = installer.Install(context.Background(), "foo", "tool", "latest")
+	require.ErrorContains(t, err, "provenance: tool_1.0_linux_amd64.tar.gz has no build provenance attestation")
+	require.NoFileExists(t, filepath.Join(installer.BinDir, "tool"))
+	require.Equal(t, 1, attested)
+	require.FileExists(t, filepath.Join(installer.CacheDir, "signatures", "foo", "tool", "v1.0", name+".attestations.json"))
+	r, err = verify.Load(installer.VerifyDir, "foo", "tool", "latest")
+	require.NoError(t, err)
+	require.Equal(t, verify.Failed, r.Status)
+}
+
+func TestExtractPackageSafely(t *testing.T) {
+	archive := func(headers ...*tar.Header) string {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for _, h := range headers {
+			if h.Typeflag == 0 {
+				h.Typeflag = tar.TypeReg
+			}
+			h.Mode = 0755
+			require.NoError(t, tw.WriteHeader(h))
+			if h.Typeflag == tar.TypeReg {
+				_, err := tw.Write(bytes.Repeat([]byte("x"), int(h.Size)))
+				require.NoError(t, err)
+			}
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, gw.Close())
+		path := filepath.Join(t.TempDir(), "tool.tar.gz")
+		require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+		return path
+	}
+	extract := func(i *Installer, path string) (string, error) {
+		dir := filepath.Join(t.TempDir(), "extract")
+		require.NoError(t, os.Mkdir(dir, 0755))
+		return dir, i.extractPackage(context.Background(), path, dir)
+	}
+	installer := &Installer{}
+
+	// links inside the archive are kept, hard links are copied
+	dir, err := extract(installer, archive(
+		&tar.Header{Name: "libexec/tool", Size: 4},
+		&tar.Header{Name: "bin/tool", Typeflag: tar.TypeSymlink, Linkname: "../libexec/tool"},
+		&tar.Header{Name: "tool-copy", Typeflag: tar.TypeLink, Linkname: "libexec/tool"},
+	))
+	require.NoError(t, err)
+	resolved, err := filepath.EvalSymlinks(filepath.Join(dir, "bin", "tool"))
+	require.NoError(t, err)
+	require.Equal(t, "tool", filepath.Base(resolved))
+	info, err := os.Lstat(filepath.Join(dir, "tool-copy"))
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+	require.EqualValues(t, 4, info.Size())
+
+	for name, headers := range map[string][]*tar.Header{
+		"is outside the archive": {{Name: "../evil", Size: 1}},
+		"is outside":             {{Name: "/tmp/evil", Size: 1}},
+		"points outside the archive to ../../etc": {
+			{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "../../etc"},
+		},
+		"points outside the archive to /etc": {
+			{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		},
+		// each link is inside on its own, but the second goes up through
+		// the first
+		"archive link esc points outside the archive": {
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "esc", Typeflag: tar.TypeSymlink, Linkname: "up/.."},
+		},
+		"is inside the link dir": {
+			{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "sub"},
+			{Name: "dir/tool", Size: 1},
+		},
+		"entry ../../etc/passwd is outside the archive": {
+			{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"},
+		},
+		"which is not a file in the archive": {
+			{Name: "tool", Typeflag: tar.TypeLink, Linkname: "missing"},
+		},
+	} {
+		dir, err := extract(installer, archive(headers...))
+		require.ErrorContains(t, err, name)
+		require.NoFileExists(t, filepath.Join(filepath.Dir(dir), "evil"))
+	}
+
+	// decompression bombs stop at the limits
+	_, err = extract(&Installer{MaxExtractSize: 10}, archive(&tar.Header{Name: "bomb", Size: 11}))
+	require.ErrorContains(t, err, "archive extracts to more than 10 bytes")
+	_, err = extract(&Installer{MaxExtractFiles: 2}, archive(
+		&tar.Header{Name: "a", Size: 1},
+		&tar.Header{Name: "b", Size: 1},
+		&tar.Header{Name: "c", Size: 1},
+	))
+	require.ErrorContains(t, err, "archive has more than 2 files")
+}
@@ -0,0 +1,22 @@
+// Package installtest provides fixtures for testing packages that install
+// release binaries.
+package installtest
+
+import (
+	"debug/elf"
+	"encoding/binary"
+)
+
+// ELF returns the header of a statically linked linux executable built for
+// machine.
+func ELF(machine elf.Machine) []byte {
+	header := make([]byte, 64)
+	copy(header, elf.ELFMAG)
+	header[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.LittleEndian.PutUint16(header[16:], uint16(elf.ET_EXEC))
+	binary.LittleEndian.PutUint16(header[18:], uint16(machine))
+	binary.LittleEndian.PutUint32(header[20:], uint32(elf.EV_CURRENT))
+	return header
+}
@@ -20,7 +20,7 @@ func TestFindGithubReleaseMacAssets(t *testing.T) {
 	}
 	assets = append(assets, asset1, asset2)
 
-	downloadableAssets, _ := findGithubReleaseMacAssets(assets)
+	downloadableAssets, _ := (&Installer{}).findGithubReleaseMacAssets(assets)
 	if runtime.GOOS == "arm64" {
 		require.Equal(t, asset2, downloadableAssets)
 	} else {
@@ -49,9 +49,8 @@ func TestEvalAssetSuitabilityDarwin(t *testing.T) {
 	// pandoc-2.14.2-macOS.pkg = 6
 	// direnv.darwin-amd64 =8
 	osCap := &types.Capabilities{
-		OS:             types.Darwin,
-		ExecutableMime: "application/x-mach-binary",
-		Arch:           "arm64",
+		OS:   types.Darwin,
+		Arch: "arm64",
 	}
 	asset := types.Asset{
 		BrowserDownloadURL: "https://github.com/foo/bar/releases/download/v1.0/direnv.darwin-arm64",
@@ -92,9 +91,8 @@ func TestEvalAssetSuitabilityLinux(t *testing.T) {
 	// pandoc-2.14.2-macOS.pkg = 6
 	// direnv.darwin-amd64 =8
 	osCap := &types.Capabilities{
-		OS:             types.Linux,
-		ExecutableMime: "asdf",
-		Arch:           "amd64",
+		OS:   types.Linux,
+		Arch: "amd64",
 	}
 	asset := types.Asset{
 		BrowserDownloadURL: "https://github.com/foo/bar/releases/download/v1.0/direnv.linux-amd64",
@@ -124,4 +122,71 @@ func TestEvalAssetSuitabilityLinux(t *testing.T) {
 	// gopass-1.15.11-darwin-arm64.tar.gz
 	asset.BrowserDownloadURL = "https://github.com/foo/bar/releases/download/v1.0/gopass-1.15.11-linux-amd64.tar.gz"
 	require.Equal(t, 9, evaluateAssetSuitability(osCap, asset))
+	// linux packages rank below archives and binaries
+	asset.BrowserDownloadURL = "https://github.com/foo/bar/releases/download/v1.0/gopass_1.15.11_amd64.deb"
+	require.Equal(t, 7, evaluateAssetSuitability(osCap, asset))
+	asset.BrowserDownloadURL = "https://github.com/foo/bar/releases/download/v1.0/gopass-1.15.11.x86_64.rpm"
+	require.Equal(t, 7, evaluateAssetSuitability(osCap, asset))
+	asset.BrowserDownloadURL = "https://github.com/foo/bar/releases/download/v1.0/Gopass-1.15.11-x86_64.AppImage"
+	require.Equal(t, 7, evaluateAssetSuitability(osCap, asset))
+}
+
+func TestFindGithubReleaseLinuxPackages(t *testing.T) {
+	installer := &Installer{Platform: &types.Capabilities{OS: types.Linux, Arch: "amd64"}}
+	deb := types.Asset{BrowserDownloadURL: "https://github.com/foo/bar/releases/download/v1.0/bar_1.0_amd64.deb"}
+	arm := types.Asset{BrowserDownloadURL: "https://github.com/foo/bar/releases/download/v1.0/bar_1.0_arm64.deb"}
+	archive := types.Asset{BrowserDownloadURL: "https://github.com/foo/bar/releases/download/v1.0/bar_1.0_linux_amd64.tar.gz"}
+
+	asset, err := installer.findGithubReleaseMacAssets([]types.Asset{arm, deb, archive})
+	require.NoError(t, err)
+	require.Equal(t, archive, asset)
+	asset, err = installer.findGithubReleaseMacAssets([]types.Asset{arm, deb})
+	require.NoError(t, err)
+	require.Equal(t, deb, asset)
+}
+
+func TestFindGithubReleaseLinuxPackagesFallback(t *testing.T) {
+	installer := &Installer{Platform: &types.Capabilities{OS: types.Linux, Arch: "amd64"}}
+	asset := func(name string) types.Asset {
+		return types.Asset{BrowserDownloadURL: "https://github.com/foo/bar/releases/download/v1.0/" + name}
+	}
+	zst := asset("bar_linux_amd64.tar.zst")
+	deb := asset("bar_1.0_amd64.deb")
+	rpm := asset("bar-1.0.x86_64.rpm")
+	appImage := asset("Bar-1.0.AppImage")
+	armAppImage := asset("Bar-1.0-aarch64.AppImage")
+	darwin := asset("bar_darwin_amd64.tar.gz")
+
+	for _, test := range []struct {
+		assets []types.Asset
+		want   types.Asset
+	}{
+		// packages never beat a plain asset, whatever the order or the score
+		{[]types.Asset{deb, rpm, appImage, zst}, zst},
+		{[]types.Asset{zst, deb, rpm}, zst},
+		// equally suitable packages are picked in release order
+		{[]types.Asset{darwin, rpm, deb}, rpm},
+		{[]types.Asset{darwin, deb, rpm}, deb},
+		{[]types.Asset{darwin, armAppImage, appImage}, appImage},
+	} {
+		for range 10 {
+			got, err := installer.findGithubReleaseMacAssets(test.assets)
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		}
+	}
+	_, err := installer.findGithubReleaseMacAssets([]types.Asset{darwin, armAppImage})
+	require.ErrorContains(t, err, "could not find a github asset")
+}
+
+func TestPreferenceBonus(t *testing.T) {
+	gnu := types.Asset{
+		BrowserDownloadURL: "https://github.com/foo/bar/releases/download/v1.0/bar-x86_64-unknown-linux-gnu.tar.gz",
+	}
+	musl := types.Asset{
+		BrowserDownloadURL: "https://github.com/foo/bar/releases/download/v1.0/bar-x86_64-unknown-linux-musl.tar.gz",
+	}
+	require.Equal(t, 0, preferenceBonus(nil, musl))
+	require.Equal(t, 0, preferenceBonus([]string{"musl"}, gnu))
+	require.Equal(t, 1, preferenceBonus([]string{"static", "MUSL"}, musl))
 }
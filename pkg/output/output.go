@@ -0,0 +1,50 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Formats results can be written in.
+const (
+	Table = "table"
+	JSON  = "json"
+	YAML  = "yaml"
+)
+
+// Tabular results print themselves as human readable text.
+type Tabular interface {
+	WriteTable(w io.Writer) error
+}
+
+// Validate reports whether format is supported.
+func Validate(format string) error {
+	switch format {
+	case Table, JSON, YAML:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, use %s, %s or %s", format, Table, JSON, YAML)
+}
+
+// Write renders a command result in the given format.
+func Write(w io.Writer, format string, result Tabular) error {
+	switch format {
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	case YAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+		return enc.Close()
+	case Table:
+		return result.WriteTable(w)
+	}
+	return Validate(format)
+}
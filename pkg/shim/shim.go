@@ -0,0 +1,59 @@
+package shim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// marker identifies kelp shims so they are never mistaken for real binaries.
+const marker = "# kelp shim"
+
+// Write places a shim for tool in binDir. When run, the shim asks kelp to
+// exec the version of tool pinned for the current directory.
+func Write(binDir, tool, kelpPath string) error {
+	// the name is written on the comment line, a line break would end it
+	if strings.ContainsAny(tool, "\r\n") {
+		return fmt.Errorf("tool name %q contains a line break", tool)
+	}
+	script := fmt.Sprintf("#!/bin/sh\n%s: runs the version of %s pinned for the current directory\nexec %s exec %s \"$@\"\n", marker, tool, shQuote(kelpPath), shQuote(tool))
+	path := filepath.Join(binDir, tool)
+	// replace rather than truncate so a running binary of the same name is
+	// left intact
+	tmp := path + ".kelp-shim"
+	err := os.WriteFile(tmp, []byte(script), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// shQuote quotes s for sh.
+func shQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// IsShim reports whether the file at path is a kelp shim.
+func IsShim(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(f, head)
+	return bytes.Contains(head[:n], []byte(marker))
+}
+
+// Executable returns the absolute path of the running kelp binary, which
+// shims call back into.
+func Executable() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
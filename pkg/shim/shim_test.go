@@ -0,0 +1,32 @@
+package shim
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shims are sh scripts")
+	}
+	dir := t.TempDir()
+	// a fake kelp that prints its arguments, in a path sh would expand
+	kelp := filepath.Join(dir, "it's $HOME `x`")
+	err := os.WriteFile(kelp, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\"\n"), 0755)
+	require.Nil(t, err)
+
+	err = Write(dir, "to$ol", kelp)
+	require.Nil(t, err)
+	require.True(t, IsShim(filepath.Join(dir, "to$ol")))
+	out, err := exec.Command(filepath.Join(dir, "to$ol"), "a b").Output()
+	require.Nil(t, err)
+	require.Equal(t, "exec\nto$ol\na b\n", string(out))
+
+	err = Write(dir, "tool\nrm -rf ~", kelp)
+	require.ErrorContains(t, err, "line break")
+}
@@ -94,7 +94,24 @@ func (a Asset) IsMacAsset() bool {
 	return false
 }
 
+// IsLinuxPackage reports whether the asset is a .deb, an .rpm or an
+// AppImage, which are only made for linux. They are installed when no plain
+// binary or archive suits.
+func (a Asset) IsLinuxPackage() bool {
+	lower := strings.ToLower(a.BrowserDownloadURL)
+	return strings.HasSuffix(lower, ".deb") || strings.HasSuffix(lower, ".rpm") || IsAppImage(lower)
+}
+
+// IsAppImage reports whether the file called name is an AppImage, an
+// executable that carries its own files.
+func IsAppImage(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".appimage")
+}
+
 func (a Asset) IsLinuxAsset() bool {
+	if a.IsLinuxPackage() {
+		return true
+	}
 	macIdentifiers := []string{"linux"}
 
 	for _, word := range macIdentifiers {
@@ -116,6 +133,19 @@ func (a Asset) IsSameOS(capabilities *Capabilities) bool {
 	return false
 }
 
+// NamesArchitecture reports whether the asset's file name says which
+// architecture it is built for.
+func (a Asset) NamesArchitecture() bool {
+	bdu := strings.SplitAfter(a.BrowserDownloadURL, "/")
+	filename := strings.ToLower(bdu[len(bdu)-1])
+	for _, arch := range []string{"amd64", "x86_64", "x64", "arm64", "aarch64", "armv", "armhf", "386", "i686", "ppc64", "s390x", "riscv64", "loong64"} {
+		if strings.Contains(filename, arch) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a Asset) IsSameArchitecture(capabilities *Capabilities) bool {
 	lowerURL := strings.ToLower(a.BrowserDownloadURL)
 
@@ -1,7 +1,9 @@
 package types
 
 import (
+	"fmt"
 	"runtime"
+	"strings"
 )
 
 type OS int
@@ -11,6 +13,16 @@ const (
 	Linux
 )
 
+func (o OS) String() string {
+	switch o {
+	case Darwin:
+		return "darwin"
+	case Linux:
+		return "linux"
+	}
+	return "unknown"
+}
+
 func IsDarwin() bool {
 	return runtime.GOOS == "darwin"
 }
@@ -20,9 +32,8 @@ func IsLinux() bool {
 }
 
 type Capabilities struct {
-	OS             OS
-	ExecutableMime string
-	Arch           string
+	OS   OS
+	Arch string
 }
 
 func GetOS() OS {
@@ -35,6 +46,27 @@ func GetOS() OS {
 	return -1
 }
 
+// String returns the platform as os/arch, ie linux/amd64.
+func (c *Capabilities) String() string {
+	return c.OS.String() + "/" + c.Arch
+}
+
+// ParsePlatform returns the capabilities of a platform given as os/arch, ie
+// linux/amd64, so assets can be picked for a machine other than this one.
+func ParsePlatform(platform string) (*Capabilities, error) {
+	goos, arch, ok := strings.Cut(platform, "/")
+	if !ok || arch == "" {
+		return nil, fmt.Errorf("invalid platform %q, use os/arch such as linux/amd64", platform)
+	}
+	switch goos {
+	case "darwin":
+		return &Capabilities{OS: Darwin, Arch: arch}, nil
+	case "linux":
+		return &Capabilities{OS: Linux, Arch: arch}, nil
+	}
+	return nil, fmt.Errorf("unsupported os %q in platform %q, use darwin or linux", goos, platform)
+}
+
 var current *Capabilities
 
 func GetCapabilities() *Capabilities {
@@ -42,12 +74,6 @@ func GetCapabilities() *Capabilities {
 		return current
 	}
 
-	switch runtime.GOOS {
-	case "darwin":
-		current = &Capabilities{OS: Darwin, ExecutableMime: "application/x-mach-binary"}
-	case "linux":
-		current = &Capabilities{OS: Linux, ExecutableMime: "application/x-executable"}
-	}
-	current.Arch = runtime.GOARCH
+	current, _ = ParsePlatform(runtime.GOOS + "/" + runtime.GOARCH)
 	return current
 }
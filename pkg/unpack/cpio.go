@@ -0,0 +1,214 @@
+package unpack
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mholt/archives"
+)
+
+// cpioHeader is an entry of a cpio archive in the odc (070707) format of
+// macOS payloads or the newc (070701, 070702) format of rpms.
+type cpioHeader struct {
+	name  string
+	ino   uint64
+	mode  uint32
+	nlink uint64
+	size  int64
+}
+
+// cpioReader reads a cpio archive entry by entry.
+type cpioReader struct {
+	r      *bufio.Reader
+	offset int64
+	// pad is the alignment of names and data, 4 for newc and 1 for odc.
+	pad       int64
+	remaining int64
+}
+
+func newCpioReader(r io.Reader) *cpioReader {
+	return &cpioReader{r: bufio.NewReader(r), pad: 1}
+}
+
+func (c *cpioReader) Read(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	c.offset += int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *cpioReader) skip(n int64) error {
+	skipped, err := c.r.Discard(int(n))
+	c.offset += int64(skipped)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (c *cpioReader) align() error {
+	if rem := c.offset % c.pad; rem != 0 {
+		return c.skip(c.pad - rem)
+	}
+	return nil
+}
+
+func (c *cpioReader) read(n int) ([]byte, error) {
+	bs := make([]byte, n)
+	read, err := io.ReadFull(c.r, bs)
+	c.offset += int64(read)
+	return bs, err
+}
+
+// next skips what's left of the current entry and reads the next header.
+// It returns io.EOF after the trailer.
+func (c *cpioReader) next() (cpioHeader, error) {
+	h := cpioHeader{}
+	if err := c.skip(c.remaining); err != nil {
+		return h, err
+	}
+	c.remaining = 0
+	if err := c.align(); err != nil {
+		return h, err
+	}
+	magic, err := c.read(6)
+	if err != nil {
+		return h, err
+	}
+	var fields []uint64
+	var namesize uint64
+	switch string(magic) {
+	case "070707":
+		c.pad = 1
+		bs, err := c.read(70)
+		if err != nil {
+			return h, err
+		}
+		// dev ino mode uid gid nlink rdev mtime namesize filesize
+		widths := []int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11}
+		fields, err = parseFields(bs, widths, 8)
+		if err != nil {
+			return h, err
+		}
+		h.ino, h.mode, h.nlink = fields[1], uint32(fields[2]), fields[5]
+		namesize, h.size = fields[8], int64(fields[9])
+	case "070701", "070702":
+		c.pad = 4
+		bs, err := c.read(104)
+		if err != nil {
+			return h, err
+		}
+		// ino mode uid gid nlink mtime filesize devmajor devminor rdevmajor
+		// rdevminor namesize check
+		widths := []int{8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8}
+		fields, err = parseFields(bs, widths, 16)
+		if err != nil {
+			return h, err
+		}
+		h.ino, h.mode, h.nlink = fields[0], uint32(fields[1]), fields[4]
+		namesize, h.size = fields[11], int64(fields[6])
+	default:
+		return h, errors.New("not a cpio archive")
+	}
+	if namesize == 0 || namesize > 4096 {
+		return h, errors.New("invalid cpio entry name")
+	}
+	name, err := c.read(int(namesize))
+	if err != nil {
+		return h, err
+	}
+	h.name = strings.TrimRight(string(name), "\x00")
+	if err := c.align(); err != nil {
+		return h, err
+	}
+	if h.name == "TRAILER!!!" {
+		return h, io.EOF
+	}
+	c.remaining = h.size
+	return h, nil
+}
+
+func parseFields(bs []byte, widths []int, base int) ([]uint64, error) {
+	fields := []uint64{}
+	for _, w := range widths {
+		v, err := strconv.ParseUint(string(bs[:w]), base, 64)
+		if err != nil {
+			return nil, errors.New("invalid cpio header")
+		}
+		fields = append(fields, v)
+		bs = bs[w:]
+	}
+	return fields, nil
+}
+
+// extractCpio hands every entry of a cpio archive to handle, with prefix
+// before its name. Hard links become links to the entry holding the data.
+func extractCpio(ctx context.Context, r io.Reader, prefix string, handle archives.FileHandler) error {
+	c := newCpioReader(r)
+	// newc stores the data of hard linked files once, with the last link
+	linked := map[uint64][]string{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h, err := c.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cpio: %w", err)
+		}
+		name := path.Clean(strings.TrimPrefix(h.name, "./"))
+		if name == "." {
+			continue
+		}
+		name = path.Join(prefix, name)
+		mode := unixMode(h.mode)
+		switch {
+		case mode&fs.ModeSymlink != 0:
+			if h.size > 4096 {
+				return errors.New("cpio: invalid link")
+			}
+			target, err := io.ReadAll(c)
+			if err != nil {
+				return fmt.Errorf("cpio: %w", err)
+			}
+			err = handle(ctx, linkInfo(name, string(target), mode))
+			if err != nil {
+				return err
+			}
+		case mode.IsRegular() && h.nlink > 1 && h.size == 0 && c.pad == 4:
+			linked[h.ino] = append(linked[h.ino], name)
+		default:
+			err = handle(ctx, fileInfo(name, h.size, mode, func() (io.Reader, error) { return c, nil }))
+			if err != nil {
+				return err
+			}
+			if mode.IsRegular() {
+				for _, link := range linked[h.ino] {
+					err = handle(ctx, linkInfo(link, name, mode))
+					if err != nil {
+						return err
+					}
+				}
+				delete(linked, h.ino)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package unpack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mholt/archives"
+)
+
+// Deb extracts the files of a debian package, an ar archive whose
+// data.tar member holds what the package installs. The control files and
+// maintainer scripts are left out.
+type Deb struct{}
+
+// Extract hands the files in the package's data archive to handleFile.
+func (Deb) Extract(ctx context.Context, archive io.Reader, handleFile archives.FileHandler) error {
+	ra, size, err := readerAt(archive)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, 8)
+	if _, err := ra.ReadAt(magic, 0); err != nil || string(magic) != "!<arch>\n" {
+		return errors.New("not a debian package")
+	}
+	header := make([]byte, 60)
+	for offset := int64(8); offset+60 <= size; {
+		if _, err := ra.ReadAt(header, offset); err != nil {
+			return err
+		}
+		if string(header[58:60]) != "`\n" {
+			return errors.New("invalid debian package")
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[:16])), "/")
+		length, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil || length < 0 || offset+60+length > size {
+			return errors.New("invalid debian package")
+		}
+		offset += 60
+		if strings.HasPrefix(name, "data.tar") {
+			return extractData(ctx, name, io.NewSectionReader(ra, offset, length), handleFile)
+		}
+		// members are aligned to two bytes
+		offset += length + length%2
+	}
+	return errors.New("debian package has no data archive")
+}
+
+// extractData extracts the data.tar member of a debian package, which may
+// be compressed with gzip, xz, zstd or bzip2.
+func extractData(ctx context.Context, name string, data io.Reader, handleFile archives.FileHandler) error {
+	format, stream, err := archives.Identify(ctx, name, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	extractor, ok := format.(archives.Extractor)
+	if !ok {
+		return fmt.Errorf("%s is not an archive", name)
+	}
+	return extractor.Extract(ctx, stream, rooted(handleFile))
+}
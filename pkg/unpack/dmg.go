@@ -0,0 +1,306 @@
+package unpack
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/mholt/archives"
+	"howett.net/plist"
+)
+
+// Dmg extracts the files of a macOS disk image: a UDIF image of an HFS+
+// volume, uncompressed or compressed with zlib, bzip2 or ADC. APFS volumes
+// and LZFSE or LZMA compressed images are not supported.
+type Dmg struct{}
+
+const sectorSize = 512
+
+// udifChunk is a run of sectors of a partition and where its data is
+// stored in the image.
+type udifChunk struct {
+	kind             uint32
+	sector, sectors  int64
+	offset, length   int64
+	compressedLength int64
+}
+
+// UDIF chunk types.
+const (
+	chunkZero    = 0x00000000
+	chunkRaw     = 0x00000001
+	chunkIgnore  = 0x00000002
+	chunkADC     = 0x80000004
+	chunkZlib    = 0x80000005
+	chunkBzip2   = 0x80000006
+	chunkLZFSE   = 0x80000007
+	chunkLZMA    = 0x80000008
+	chunkComment = 0x7ffffffe
+	chunkLast    = 0xffffffff
+)
+
+// maxChunk bounds the data of a chunk, which is decompressed into memory.
+const maxChunk = 64 << 20
+
+// partition reads the sectors of a partition of a UDIF image, decompressing
+// a chunk at a time.
+type partition struct {
+	r      io.ReaderAt
+	chunks []udifChunk
+	size   int64
+	cached int
+	data   []byte
+}
+
+// Extract hands the files of the image's HFS+ volume to handleFile.
+func (Dmg) Extract(ctx context.Context, archive io.Reader, handleFile archives.FileHandler) error {
+	ra, size, err := readerAt(archive)
+	if err != nil {
+		return err
+	}
+	partitions, err := readPartitions(ra, size)
+	if err != nil {
+		return err
+	}
+	apfs := false
+	for _, p := range partitions {
+		signature := make([]byte, 2)
+		_, err := p.ReadAt(signature, 1024)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if string(signature) == "H+" || string(signature) == "HX" {
+			return extractHFS(ctx, p, handleFile)
+		}
+		magic := make([]byte, 4)
+		if _, err := p.ReadAt(magic, 32); err == nil && string(magic) == "NXSB" {
+			apfs = true
+		}
+	}
+	if apfs {
+		return errors.New("disk image holds an APFS volume, only HFS+ disk images are supported")
+	}
+	return errors.New("disk image has no HFS+ volume")
+}
+
+// readPartitions reads the partitions listed in the blkx resource of a
+// UDIF image.
+func readPartitions(ra io.ReaderAt, size int64) ([]*partition, error) {
+	trailer := make([]byte, 512)
+	if size < 512 {
+		return nil, errors.New("not a disk image")
+	}
+	if _, err := ra.ReadAt(trailer, size-512); err != nil || string(trailer[:4]) != "koly" {
+		return nil, errors.New("not a disk image")
+	}
+	dataFork := int64(binary.BigEndian.Uint64(trailer[24:]))
+	xmlOffset := int64(binary.BigEndian.Uint64(trailer[216:]))
+	xmlLength := int64(binary.BigEndian.Uint64(trailer[224:]))
+	if xmlLength <= 0 || xmlLength > maxChunk || xmlOffset < 0 || xmlOffset+xmlLength > size {
+		return nil, errors.New("disk image has no partition list")
+	}
+	bs := make([]byte, xmlLength)
+	if _, err := ra.ReadAt(bs, xmlOffset); err != nil {
+		return nil, err
+	}
+	var resources struct {
+		ResourceFork struct {
+			Blkx []struct {
+				Name string `plist:"Name"`
+				Data []byte `plist:"Data"`
+			} `plist:"blkx"`
+		} `plist:"resource-fork"`
+	}
+	if _, err := plist.Unmarshal(bs, &resources); err != nil {
+		return nil, fmt.Errorf("invalid disk image partition list: %w", err)
+	}
+
+	partitions := []*partition{}
+	for _, blkx := range resources.ResourceFork.Blkx {
+		p, err := parseMish(ra, size, dataFork, blkx.Data)
+		if err != nil {
+			return nil, fmt.Errorf("disk image partition %s: %w", blkx.Name, err)
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, nil
+}
+
+// parseMish reads the chunk table of a partition.
+func parseMish(ra io.ReaderAt, size, dataFork int64, bs []byte) (*partition, error) {
+	if len(bs) < 204 || string(bs[:4]) != "mish" {
+		return nil, errors.New("invalid chunk table")
+	}
+	dataOffset := int64(binary.BigEndian.Uint64(bs[24:]))
+	count := int(binary.BigEndian.Uint32(bs[200:]))
+	if len(bs) < 204+count*40 {
+		return nil, errors.New("invalid chunk table")
+	}
+	p := &partition{r: ra, cached: -1}
+	for i := range count {
+		c := bs[204+i*40:]
+		chunk := udifChunk{
+			kind:             binary.BigEndian.Uint32(c),
+			sector:           int64(binary.BigEndian.Uint64(c[8:])),
+			sectors:          int64(binary.BigEndian.Uint64(c[16:])),
+			offset:           dataFork + dataOffset + int64(binary.BigEndian.Uint64(c[24:])),
+			compressedLength: int64(binary.BigEndian.Uint64(c[32:])),
+		}
+		if chunk.kind == chunkComment || chunk.kind == chunkLast {
+			continue
+		}
+		chunk.length = chunk.sectors * sectorSize
+		if chunk.sector < 0 || chunk.sectors <= 0 || chunk.length > maxChunk || chunk.compressedLength < 0 || chunk.compressedLength > maxChunk || chunk.offset+chunk.compressedLength > size {
+			return nil, errors.New("invalid chunk")
+		}
+		p.chunks = append(p.chunks, chunk)
+		if end := (chunk.sector + chunk.sectors) * sectorSize; end > p.size {
+			p.size = end
+		}
+	}
+	sort.Slice(p.chunks, func(i, j int) bool { return p.chunks[i].sector < p.chunks[j].sector })
+	return p, nil
+}
+
+// ReadAt reads the partition as if it were uncompressed.
+func (p *partition) ReadAt(bs []byte, off int64) (int, error) {
+	n := 0
+	for n < len(bs) {
+		pos := off + int64(n)
+		if pos >= p.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(p.chunks), func(i int) bool {
+			return (p.chunks[i].sector+p.chunks[i].sectors)*sectorSize > pos
+		})
+		if i == len(p.chunks) || p.chunks[i].sector*sectorSize > pos {
+			// sectors no chunk covers read as zeros
+			end := p.size
+			if i < len(p.chunks) {
+				end = p.chunks[i].sector * sectorSize
+			}
+			gap := bs[n:min(len(bs), n+int(end-pos))]
+			clear(gap)
+			n += len(gap)
+			continue
+		}
+		data, err := p.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(bs[n:], data[pos-p.chunks[i].sector*sectorSize:])
+	}
+	return n, nil
+}
+
+// chunk returns the decompressed data of chunk i.
+func (p *partition) chunk(i int) ([]byte, error) {
+	if p.cached == i {
+		return p.data, nil
+	}
+	c := p.chunks[i]
+	var data []byte
+	var err error
+	switch c.kind {
+	case chunkZero, chunkIgnore:
+		data = make([]byte, c.length)
+	case chunkRaw:
+		data = make([]byte, c.length)
+		_, err = p.r.ReadAt(data[:min(c.length, c.compressedLength)], c.offset)
+	case chunkZlib, chunkBzip2, chunkADC:
+		compressed := make([]byte, c.compressedLength)
+		if _, err := p.r.ReadAt(compressed, c.offset); err != nil {
+			return nil, err
+		}
+		data, err = decompressChunk(c, compressed)
+	case chunkLZFSE:
+		return nil, errors.New("LZFSE compressed disk images are not supported")
+	case chunkLZMA:
+		return nil, errors.New("LZMA compressed disk images are not supported")
+	default:
+		return nil, fmt.Errorf("unknown disk image chunk type %#x", c.kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < c.length {
+		data = append(data, make([]byte, c.length-int64(len(data)))...)
+	}
+	p.cached, p.data = i, data[:c.length]
+	return p.data, nil
+}
+
+func decompressChunk(c udifChunk, compressed []byte) ([]byte, error) {
+	var r io.Reader
+	switch c.kind {
+	case chunkADC:
+		return decompressADC(compressed, c.length)
+	case chunkZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case chunkBzip2:
+		r = bzip2.NewReader(bytes.NewReader(compressed))
+	}
+	data, err := io.ReadAll(io.LimitReader(r, c.length))
+	if err != nil {
+		return nil, fmt.Errorf("invalid disk image chunk: %w", err)
+	}
+	return data, nil
+}
+
+// decompressADC decompresses Apple Data Compression, a run of literals and
+// back references to what was already decompressed.
+func decompressADC(in []byte, size int64) ([]byte, error) {
+	out := make([]byte, 0, size)
+	invalid := errors.New("invalid ADC chunk")
+	for i := 0; i < len(in) && int64(len(out)) < size; {
+		b := in[i]
+		var n, distance int
+		switch {
+		case b&0x80 != 0:
+			n = int(b&0x7f) + 1
+			if i+1+n > len(in) {
+				return nil, invalid
+			}
+			out = append(out, in[i+1:i+1+n]...)
+			i += 1 + n
+			continue
+		case b&0x40 != 0:
+			if i+3 > len(in) {
+				return nil, invalid
+			}
+			n = int(b&0x3f) + 4
+			distance = int(in[i+1])<<8 | int(in[i+2])
+			i += 3
+		default:
+			if i+2 > len(in) {
+				return nil, invalid
+			}
+			n = int(b>>2&0x0f) + 3
+			distance = int(b&0x03)<<8 | int(in[i+1])
+			i += 2
+		}
+		start := len(out) - distance - 1
+		if start < 0 {
+			return nil, invalid
+		}
+		// the reference may overlap what it produces
+		for j := range n {
+			out = append(out, out[start+j])
+		}
+	}
+	if int64(len(out)) > size {
+		out = out[:size]
+	}
+	return out, nil
+}
@@ -0,0 +1,311 @@
+package unpack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/mholt/archives"
+)
+
+// HFS+ catalog ids and record types.
+const (
+	hfsRootParentID = 1
+	hfsRootFolderID = 2
+
+	hfsFolderRecord = 1
+	hfsFileRecord   = 2
+
+	// hfsCompressed is the owner flag of files whose data is compressed
+	// into their resource fork or an attribute.
+	hfsCompressed = 0x20
+)
+
+// hfsExtent is a run of allocation blocks.
+type hfsExtent struct {
+	start, count uint32
+}
+
+// hfsFork is the data of a file: its size and the first eight extents
+// holding it.
+type hfsFork struct {
+	size        int64
+	totalBlocks uint32
+	extents     [8]hfsExtent
+}
+
+func parseFork(bs []byte) hfsFork {
+	f := hfsFork{
+		size:        int64(binary.BigEndian.Uint64(bs)),
+		totalBlocks: binary.BigEndian.Uint32(bs[12:]),
+	}
+	for i := range f.extents {
+		f.extents[i] = hfsExtent{binary.BigEndian.Uint32(bs[16+i*8:]), binary.BigEndian.Uint32(bs[20+i*8:])}
+	}
+	return f
+}
+
+// forkReader reads a fork as a contiguous file.
+type forkReader struct {
+	r         io.ReaderAt
+	blockSize int64
+	fork      hfsFork
+}
+
+// readFork returns a reader of a fork. Forks in more than eight extents
+// continue in the extents overflow file, which isn't read.
+func readFork(r io.ReaderAt, blockSize int64, fork hfsFork) (*forkReader, error) {
+	blocks := uint32(0)
+	for _, e := range fork.extents {
+		blocks += e.count
+	}
+	if blocks < fork.totalBlocks || int64(blocks)*blockSize < fork.size {
+		return nil, errors.New("file is too fragmented to read")
+	}
+	return &forkReader{r: r, blockSize: blockSize, fork: fork}, nil
+}
+
+func (f *forkReader) ReadAt(bs []byte, off int64) (int, error) {
+	n := 0
+	for n < len(bs) {
+		pos := off + int64(n)
+		if pos >= f.fork.size {
+			return n, io.EOF
+		}
+		start := int64(0)
+		for _, e := range f.fork.extents {
+			length := int64(e.count) * f.blockSize
+			if pos < start+length {
+				want := min(int64(len(bs)-n), start+length-pos, f.fork.size-pos)
+				read, err := f.r.ReadAt(bs[n:n+int(want)], int64(e.start)*f.blockSize+pos-start)
+				n += read
+				if err != nil && !(err == io.EOF && read == int(want)) {
+					return n, err
+				}
+				break
+			}
+			start += length
+		}
+	}
+	return n, nil
+}
+
+// hfsRecord is a file or folder in the catalog.
+type hfsRecord struct {
+	parent  uint32
+	name    string
+	id      uint32
+	folder  bool
+	mode    uint16
+	flags   uint8
+	creator string
+	fork    hfsFork
+}
+
+// extractHFS hands the files and folders of an HFS+ volume to handle,
+// relative to its root folder. Hidden files at the root such as the
+// journal, hard links and compressed files are skipped.
+func extractHFS(ctx context.Context, r io.ReaderAt, handle archives.FileHandler) error {
+	header := make([]byte, 512)
+	if _, err := r.ReadAt(header, 1024); err != nil {
+		return fmt.Errorf("invalid HFS+ volume: %w", err)
+	}
+	blockSize := int64(binary.BigEndian.Uint32(header[40:]))
+	if blockSize < 512 || blockSize&(blockSize-1) != 0 {
+		return errors.New("invalid HFS+ volume block size")
+	}
+	catalog, err := readFork(r, blockSize, parseFork(header[272:]))
+	if err != nil {
+		return fmt.Errorf("HFS+ catalog: %w", err)
+	}
+	records, err := readCatalog(catalog)
+	if err != nil {
+		return err
+	}
+
+	folders := map[uint32]hfsRecord{}
+	for _, rec := range records {
+		if rec.folder {
+			folders[rec.id] = rec
+		}
+	}
+	// pathOf returns where a record goes, or "" for the root folder and for
+	// anything that isn't extracted
+	pathOf := func(rec hfsRecord) string {
+		parts := []string{}
+		for depth := 0; rec.id != hfsRootFolderID; depth++ {
+			if depth > 256 || rec.name == "" || strings.HasPrefix(rec.name, "\x00") {
+				return ""
+			}
+			parts = append(parts, strings.ReplaceAll(rec.name, "/", ":"))
+			if rec.parent == hfsRootFolderID {
+				if strings.HasPrefix(rec.name, ".") {
+					return ""
+				}
+				break
+			}
+			parent, ok := folders[rec.parent]
+			if !ok {
+				return ""
+			}
+			rec = parent
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return path.Join(parts...)
+	}
+
+	type named struct {
+		path string
+		rec  hfsRecord
+	}
+	entries := []named{}
+	for _, rec := range records {
+		if p := pathOf(rec); p != "" {
+			entries = append(entries, named{p, rec})
+		}
+	}
+	// folders come before what's in them
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rec := e.rec
+		mode := unixMode(uint32(rec.mode))
+		if rec.mode == 0 {
+			mode = 0644
+		}
+		if rec.folder {
+			err = handle(ctx, dirInfo(e.path, 0755))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if rec.creator == "hlnkhfs+" {
+			continue
+		}
+		if rec.flags&hfsCompressed != 0 {
+			return fmt.Errorf("%s is compressed with HFS+ compression, which is not supported", e.path)
+		}
+		data, err := readFork(r, blockSize, rec.fork)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.path, err)
+		}
+		if mode&fs.ModeSymlink != 0 {
+			if rec.fork.size > 4096 {
+				return fmt.Errorf("%s: invalid link", e.path)
+			}
+			target := make([]byte, rec.fork.size)
+			if _, err := data.ReadAt(target, 0); err != nil && err != io.EOF {
+				return fmt.Errorf("%s: %w", e.path, err)
+			}
+			err = handle(ctx, linkInfo(e.path, string(target), mode))
+		} else {
+			err = handle(ctx, fileInfo(e.path, rec.fork.size, mode, func() (io.Reader, error) {
+				return io.NewSectionReader(data, 0, rec.fork.size), nil
+			}))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCatalog reads the file and folder records in the leaf nodes of the
+// catalog B-tree.
+func readCatalog(catalog io.ReaderAt) ([]hfsRecord, error) {
+	invalid := errors.New("invalid HFS+ catalog")
+	header := make([]byte, 14+106)
+	if _, err := catalog.ReadAt(header, 0); err != nil {
+		return nil, invalid
+	}
+	node := binary.BigEndian.Uint32(header[14+10:])
+	nodeSize := int(binary.BigEndian.Uint16(header[14+18:]))
+	totalNodes := binary.BigEndian.Uint32(header[14+22:])
+	if nodeSize < 512 || nodeSize > 32768 {
+		return nil, invalid
+	}
+
+	records := []hfsRecord{}
+	bs := make([]byte, nodeSize)
+	for visited := uint32(0); node != 0; visited++ {
+		if visited > totalNodes {
+			return nil, invalid
+		}
+		if _, err := catalog.ReadAt(bs, int64(node)*int64(nodeSize)); err != nil {
+			return nil, invalid
+		}
+		if int8(bs[8]) != -1 {
+			return nil, invalid
+		}
+		count := int(binary.BigEndian.Uint16(bs[10:]))
+		if 14+count*2 > nodeSize {
+			return nil, invalid
+		}
+		for i := range count {
+			off := int(binary.BigEndian.Uint16(bs[nodeSize-2*(i+1):]))
+			rec, ok := parseCatalogRecord(bs, off)
+			if !ok {
+				return nil, invalid
+			}
+			if rec != nil {
+				records = append(records, *rec)
+			}
+		}
+		node = binary.BigEndian.Uint32(bs)
+	}
+	return records, nil
+}
+
+// parseCatalogRecord parses the leaf record at off in a node. Thread
+// records are nil.
+func parseCatalogRecord(node []byte, off int) (*hfsRecord, bool) {
+	if off < 14 || off+8 > len(node) {
+		return nil, false
+	}
+	keyLength := int(binary.BigEndian.Uint16(node[off:]))
+	nameLength := int(binary.BigEndian.Uint16(node[off+6:]))
+	data := off + 2 + keyLength
+	if keyLength < 6 || off+8+nameLength*2 > len(node) || data+2 > len(node) {
+		return nil, false
+	}
+	name := make([]uint16, nameLength)
+	for i := range name {
+		name[i] = binary.BigEndian.Uint16(node[off+8+i*2:])
+	}
+	rec := &hfsRecord{parent: binary.BigEndian.Uint32(node[off+2:]), name: string(utf16.Decode(name))}
+	kind := binary.BigEndian.Uint16(node[data:])
+	switch kind {
+	case hfsFolderRecord:
+		if data+88 > len(node) {
+			return nil, false
+		}
+		rec.folder = true
+	case hfsFileRecord:
+		if data+248 > len(node) {
+			return nil, false
+		}
+		rec.creator = string(node[data+48 : data+56])
+		rec.fork = parseFork(node[data+88:])
+	default:
+		return nil, true
+	}
+	rec.id = binary.BigEndian.Uint32(node[data+8:])
+	rec.flags = node[data+41]
+	rec.mode = binary.BigEndian.Uint16(node[data+42:])
+	if rec.parent == hfsRootParentID && rec.id != hfsRootFolderID {
+		return nil, true
+	}
+	return rec, true
+}
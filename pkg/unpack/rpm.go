@@ -0,0 +1,76 @@
+package unpack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mholt/archives"
+)
+
+// Rpm extracts the files of an rpm package, a cpio archive after the
+// package's headers. Scriptlets are not run.
+type Rpm struct{}
+
+// Extract hands the files in the package's payload to handleFile.
+func (Rpm) Extract(ctx context.Context, archive io.Reader, handleFile archives.FileHandler) error {
+	ra, size, err := readerAt(archive)
+	if err != nil {
+		return err
+	}
+	lead := make([]byte, 96)
+	if _, err := ra.ReadAt(lead, 0); err != nil || string(lead[:4]) != "\xed\xab\xee\xdb" {
+		return errors.New("not an rpm package")
+	}
+	// the signature header is padded to eight bytes, the main header isn't
+	offset := int64(96)
+	for _, align := range []int64{8, 1} {
+		length, err := headerLength(ra, offset)
+		if err != nil {
+			return err
+		}
+		offset += length
+		if rest := offset % align; rest != 0 {
+			offset += align - rest
+		}
+	}
+	if offset > size {
+		return errors.New("invalid rpm package")
+	}
+	payload := io.NewSectionReader(ra, offset, size-offset)
+
+	// the payload is a cpio archive, usually compressed
+	format, stream, err := archives.Identify(ctx, "", payload)
+	var r io.Reader = payload
+	switch {
+	case errors.Is(err, archives.NoMatch):
+	case err != nil:
+		return fmt.Errorf("rpm payload: %w", err)
+	default:
+		decompressor, ok := format.(archives.Decompressor)
+		if !ok {
+			return errors.New("rpm payload is not a cpio archive")
+		}
+		rc, err := decompressor.OpenReader(stream)
+		if err != nil {
+			return fmt.Errorf("rpm payload: %w", err)
+		}
+		defer rc.Close()
+		r = rc
+	}
+	return extractCpio(ctx, r, "", rooted(handleFile))
+}
+
+// headerLength returns the length of the rpm header at offset: its
+// preamble, index entries and data store.
+func headerLength(ra io.ReaderAt, offset int64) (int64, error) {
+	preamble := make([]byte, 16)
+	if _, err := ra.ReadAt(preamble, offset); err != nil || string(preamble[:3]) != "\x8e\xad\xe8" {
+		return 0, errors.New("invalid rpm header")
+	}
+	entries := int64(binary.BigEndian.Uint32(preamble[8:]))
+	store := int64(binary.BigEndian.Uint32(preamble[12:]))
+	return 16 + entries*16 + store, nil
+}
@@ -0,0 +1,118 @@
+// Package unpack reads the package formats the archives library doesn't:
+// macOS installer packages and disk images, and debian and rpm packages.
+// Each format is an archives.Extractor, so its entries go through the same
+// safe extraction as any other archive.
+package unpack
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mholt/archives"
+)
+
+// entry describes a file found in a package.
+type entry struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (e entry) Name() string       { return path.Base(e.name) }
+func (e entry) Size() int64        { return e.size }
+func (e entry) Mode() fs.FileMode  { return e.mode }
+func (e entry) ModTime() time.Time { return e.modTime }
+func (e entry) IsDir() bool        { return e.mode.IsDir() }
+func (e entry) Sys() any           { return nil }
+
+// fileInfo describes a file whose contents open is called to read.
+func fileInfo(name string, size int64, mode fs.FileMode, open func() (io.Reader, error)) archives.FileInfo {
+	return archives.FileInfo{
+		FileInfo:      entry{name: name, size: size, mode: mode},
+		NameInArchive: name,
+		Open: func() (fs.File, error) {
+			r, err := open()
+			if err != nil {
+				return nil, err
+			}
+			return file{Reader: r, info: entry{name: name, size: size, mode: mode}}, nil
+		},
+	}
+}
+
+// dirInfo describes a directory.
+func dirInfo(name string, mode fs.FileMode) archives.FileInfo {
+	return linkInfo(name, "", fs.ModeDir|mode)
+}
+
+// linkInfo describes a symlink, or a hard link when mode is regular.
+func linkInfo(name, target string, mode fs.FileMode) archives.FileInfo {
+	return archives.FileInfo{
+		FileInfo:      entry{name: name, mode: mode},
+		NameInArchive: name,
+		LinkTarget:    target,
+		Open: func() (fs.File, error) {
+			return file{Reader: strings.NewReader(""), info: entry{name: name, mode: mode}}, nil
+		},
+	}
+}
+
+// file is an opened entry.
+type file struct {
+	io.Reader
+	info entry
+}
+
+func (f file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f file) Close() error               { return nil }
+
+// unixMode converts the st_mode of a cpio or HFS+ entry.
+func unixMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & 0170000 {
+	case 0040000:
+		m |= fs.ModeDir
+	case 0120000:
+		m |= fs.ModeSymlink
+	case 0100000:
+	default:
+		m |= fs.ModeIrregular
+	}
+	return m
+}
+
+// rooted hands entries to handle with the absolute link targets of a
+// package, which are meant for the root of the filesystem, made relative to
+// where the package is extracted.
+func rooted(handle archives.FileHandler) archives.FileHandler {
+	return func(ctx context.Context, info archives.FileInfo) error {
+		if info.Mode()&fs.ModeSymlink != 0 && path.IsAbs(info.LinkTarget) {
+			dir := path.Dir(path.Clean(info.NameInArchive))
+			target, err := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(info.LinkTarget[1:]))
+			if err != nil {
+				return err
+			}
+			info.LinkTarget = filepath.ToSlash(target)
+		}
+		return handle(ctx, info)
+	}
+}
+
+// readerAt returns the random access the formats need, from the file being
+// extracted.
+func readerAt(r io.Reader) (io.ReaderAt, int64, error) {
+	ra, ok := r.(io.ReaderAt)
+	seeker, canSeek := r.(io.Seeker)
+	if !ok || !canSeek {
+		return nil, 0, errors.New("can only be extracted from a file")
+	}
+	size, err := seeker.Seek(0, io.SeekEnd)
+	return ra, size, err
+}
@@ -0,0 +1,539 @@
+package unpack
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/mholt/archives"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+	"howett.net/plist"
+)
+
+// extract runs e over bs and returns what it handed over: the contents of
+// files, -> and the target of links, and / for directories.
+func extract(t *testing.T, e archives.Extractor, bs []byte) (map[string]string, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "package")
+	require.NoError(t, os.WriteFile(path, bs, 0644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	extracted := map[string]string{}
+	err = e.Extract(context.Background(), f, func(ctx context.Context, info archives.FileInfo) error {
+		switch {
+		case info.IsDir():
+			extracted[info.NameInArchive] = "/"
+		case info.LinkTarget != "":
+			extracted[info.NameInArchive] = "-> " + info.LinkTarget
+		default:
+			r, err := info.Open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			bs, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			extracted[info.NameInArchive] = string(bs)
+		}
+		return nil
+	})
+	return extracted, err
+}
+
+type cpioEntry struct {
+	name  string
+	mode  uint32
+	ino   int
+	nlink int
+	data  string
+}
+
+// odc writes a cpio archive the way macOS payloads are.
+func odc(entries ...cpioEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range append(entries, cpioEntry{name: "TRAILER!!!"}) {
+		fmt.Fprintf(&buf, "070707%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o%s\x00%s",
+			0, e.ino, e.mode, 0, 0, max(e.nlink, 1), 0, 0, len(e.name)+1, len(e.data), e.name, e.data)
+	}
+	return buf.Bytes()
+}
+
+// newc writes a cpio archive the way rpms are, with the data of hard links
+// in the last one.
+func newc(entries ...cpioEntry) []byte {
+	var buf bytes.Buffer
+	pad := func() {
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	for _, e := range append(entries, cpioEntry{name: "TRAILER!!!"}) {
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00",
+			e.ino, e.mode, 0, 0, max(e.nlink, 1), 0, len(e.data), 0, 0, 0, 0, len(e.name)+1, 0, e.name)
+		pad()
+		buf.WriteString(e.data)
+		pad()
+	}
+	return buf.Bytes()
+}
+
+func TestCpio(t *testing.T) {
+	archive := newc(
+		cpioEntry{name: "./usr", mode: 0040755},
+		cpioEntry{name: "./usr/bin/tool-link", mode: 0100755, ino: 7, nlink: 2},
+		cpioEntry{name: "./usr/bin/tool", mode: 0100755, ino: 7, nlink: 2, data: "tool"},
+		cpioEntry{name: "./usr/bin/t", mode: 0120777, data: "tool"},
+	)
+	extracted := map[string]string{}
+	err := extractCpio(context.Background(), bytes.NewReader(archive), "rpm", func(ctx context.Context, info archives.FileInfo) error {
+		extracted[info.NameInArchive] = info.LinkTarget
+		if info.Mode().IsRegular() && info.LinkTarget == "" {
+			r, err := info.Open()
+			require.NoError(t, err)
+			bs, err := io.ReadAll(r)
+			require.NoError(t, err)
+			extracted[info.NameInArchive] = string(bs)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"rpm/usr":               "",
+		"rpm/usr/bin/tool":      "tool",
+		"rpm/usr/bin/tool-link": "rpm/usr/bin/tool",
+		"rpm/usr/bin/t":         "tool",
+	}, extracted)
+}
+
+type xarEntry struct {
+	name     string
+	data     []byte
+	encoding string
+}
+
+// xarPkg writes a flat package with the files at the top or in the
+// component package called dir.
+func xarPkg(t *testing.T, top []xarEntry, dir string, component []xarEntry) []byte {
+	var heap bytes.Buffer
+	id := 0
+	files := func(entries []xarEntry) string {
+		s := ""
+		for _, e := range entries {
+			data := e.data
+			if e.encoding == "application/x-gzip" {
+				var buf bytes.Buffer
+				zw := zlib.NewWriter(&buf)
+				zw.Write(e.data)
+				zw.Close()
+				data = buf.Bytes()
+			}
+			id++
+			s += fmt.Sprintf(`<file id="%d"><name>%s</name><type>file</type><data><offset>%d</offset><length>%d</length><size>%d</size><encoding style="%s"/></data></file>`,
+				id, e.name, heap.Len(), len(data), len(e.data), e.encoding)
+			heap.Write(data)
+		}
+		return s
+	}
+	toc := `<?xml version="1.0" encoding="UTF-8"?><xar><toc>` + files(top)
+	if dir != "" {
+		toc += fmt.Sprintf(`<file id="99"><name>%s</name><type>directory</type>%s</file>`, dir, files(component))
+	}
+	toc += `</toc></xar>`
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte(toc))
+	require.NoError(t, zw.Close())
+
+	var buf bytes.Buffer
+	buf.WriteString("xar!")
+	binary.Write(&buf, binary.BigEndian, uint16(28))
+	binary.Write(&buf, binary.BigEndian, uint16(1))
+	binary.Write(&buf, binary.BigEndian, uint64(compressed.Len()))
+	binary.Write(&buf, binary.BigEndian, uint64(len(toc)))
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	buf.Write(compressed.Bytes())
+	buf.Write(heap.Bytes())
+	return buf.Bytes()
+}
+
+func gzipped(bs []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(bs)
+	gw.Close()
+	return buf.Bytes()
+}
+
+// pbzx compresses bs into a pbzx payload of an xz chunk and a stored one.
+func pbzx(t *testing.T, bs []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("pbzx")
+	binary.Write(&buf, binary.BigEndian, uint64(1<<24))
+	half := len(bs) / 2
+	var chunk bytes.Buffer
+	xw, err := xz.NewWriter(&chunk)
+	require.NoError(t, err)
+	xw.Write(bs[:half])
+	require.NoError(t, xw.Close())
+	for _, c := range [][]byte{chunk.Bytes(), bs[half:]} {
+		binary.Write(&buf, binary.BigEndian, uint64(1<<24))
+		binary.Write(&buf, binary.BigEndian, uint64(len(c)))
+		buf.Write(c)
+	}
+	return buf.Bytes()
+}
+
+func TestPkg(t *testing.T) {
+	payload := odc(
+		cpioEntry{name: ".", mode: 0040755},
+		cpioEntry{name: "./usr/local/bin", mode: 0040755},
+		cpioEntry{name: "./usr/local/bin/tool", mode: 0100755, data: "#!/bin/sh\necho tool\n"},
+		cpioEntry{name: "./usr/local/bin/t", mode: 0120755, data: "tool"},
+	)
+
+	// a product archive with a component package
+	pkg := xarPkg(t,
+		[]xarEntry{{name: "Distribution", data: []byte("<installer-gui-script/>"), encoding: "application/octet-stream"}},
+		"tool.pkg",
+		[]xarEntry{
+			{name: "Bom", data: []byte("bom"), encoding: "application/octet-stream"},
+			{name: "Payload", data: gzipped(payload), encoding: "application/octet-stream"},
+		},
+	)
+	extracted, err := extract(t, Pkg{}, pkg)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"tool.pkg/usr/local/bin":      "/",
+		"tool.pkg/usr/local/bin/tool": "#!/bin/sh\necho tool\n",
+		"tool.pkg/usr/local/bin/t":    "-> tool",
+	}, extracted)
+
+	// a component package on its own, with a pbzx payload
+	pkg = xarPkg(t, []xarEntry{{name: "Payload", data: pbzx(t, payload), encoding: "application/x-gzip"}}, "", nil)
+	extracted, err = extract(t, Pkg{}, pkg)
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/sh\necho tool\n", extracted["usr/local/bin/tool"])
+
+	_, err = extract(t, Pkg{}, xarPkg(t, []xarEntry{{name: "Distribution", encoding: "application/octet-stream"}}, "", nil))
+	require.ErrorContains(t, err, "installer package has no payload")
+	_, err = extract(t, Pkg{}, []byte("not a package"))
+	require.ErrorContains(t, err, "not a macOS installer package")
+}
+
+type hfsEntry struct {
+	parent, id uint32
+	name       string
+	folder     bool
+	mode       uint16
+	data       string
+}
+
+// hfsImage writes an HFS+ volume with 512 byte blocks holding entries, with
+// the catalog in a single leaf node.
+func hfsImage(t *testing.T, entries []hfsEntry) []byte {
+	const blockSize, nodeSize, catalogBlock, dataBlock = 512, 4096, 8, 32
+	image := make([]byte, 64*blockSize)
+	be := binary.BigEndian
+	header := image[1024:]
+	copy(header, "H+")
+	be.PutUint16(header[2:], 4)
+	be.PutUint32(header[40:], blockSize)
+	be.PutUint32(header[44:], 64)
+	fork := func(bs []byte, size int64, start, blocks uint32) {
+		be.PutUint64(bs, uint64(size))
+		be.PutUint32(bs[12:], blocks)
+		be.PutUint32(bs[16:], start)
+		be.PutUint32(bs[20:], blocks)
+	}
+	fork(header[272:], 2*nodeSize, catalogBlock, 2*nodeSize/blockSize)
+
+	catalog := image[catalogBlock*blockSize:]
+	catalog[8] = 1
+	be.PutUint16(catalog[10:], 3)
+	be.PutUint16(catalog[14:], 1)
+	be.PutUint32(catalog[16:], 1)
+	be.PutUint32(catalog[24:], 1)
+	be.PutUint32(catalog[28:], 1)
+	be.PutUint16(catalog[32:], nodeSize)
+	be.PutUint32(catalog[36:], 2)
+
+	leaf := catalog[nodeSize : 2*nodeSize]
+	leaf[8] = 0xff
+	leaf[9] = 1
+	off, block := 14, uint32(dataBlock)
+	for i, e := range append(entries, hfsEntry{parent: 16}) {
+		be.PutUint16(leaf[10:], uint16(i+1))
+		be.PutUint16(leaf[nodeSize-2*(i+1):], uint16(off))
+		name := utf16.Encode([]rune(e.name))
+		be.PutUint16(leaf[off:], uint16(6+2*len(name)))
+		be.PutUint32(leaf[off+2:], e.parent)
+		be.PutUint16(leaf[off+6:], uint16(len(name)))
+		for j, c := range name {
+			be.PutUint16(leaf[off+8+2*j:], c)
+		}
+		rec := leaf[off+8+2*len(name):]
+		switch {
+		case e.id == 0:
+			// a thread record
+			be.PutUint16(rec, 3)
+			off += 8 + 2*len(name) + 10
+			continue
+		case e.folder:
+			be.PutUint16(rec, 1)
+			off += 8 + 2*len(name) + 88
+		default:
+			be.PutUint16(rec, 2)
+			copy(image[block*blockSize:], e.data)
+			fork(rec[88:], int64(len(e.data)), block, 1)
+			block++
+			off += 8 + 2*len(name) + 248
+		}
+		be.PutUint32(rec[8:], e.id)
+		be.PutUint16(rec[42:], e.mode)
+	}
+	return image
+}
+
+type udifPartition struct {
+	name   string
+	chunks []udifTestChunk
+}
+
+type udifTestChunk struct {
+	kind    uint32
+	sectors int
+	data    []byte
+}
+
+// udif writes a disk image of partitions.
+func udif(t *testing.T, partitions ...udifPartition) []byte {
+	var fork bytes.Buffer
+	blkx := []map[string]any{}
+	for _, p := range partitions {
+		mish := make([]byte, 204)
+		copy(mish, "mish")
+		sector := 0
+		for _, c := range append(p.chunks, udifTestChunk{kind: chunkLast}) {
+			chunk := make([]byte, 40)
+			binary.BigEndian.PutUint32(chunk, c.kind)
+			binary.BigEndian.PutUint64(chunk[8:], uint64(sector))
+			binary.BigEndian.PutUint64(chunk[16:], uint64(c.sectors))
+			binary.BigEndian.PutUint64(chunk[24:], uint64(fork.Len()))
+			binary.BigEndian.PutUint64(chunk[32:], uint64(len(c.data)))
+			mish = append(mish, chunk...)
+			fork.Write(c.data)
+			sector += c.sectors
+		}
+		binary.BigEndian.PutUint64(mish[16:], uint64(sector))
+		binary.BigEndian.PutUint32(mish[200:], uint32(len(p.chunks)+1))
+		blkx = append(blkx, map[string]any{"Name": p.name, "Data": mish, "ID": "0"})
+	}
+	xml, err := plist.MarshalIndent(map[string]any{"resource-fork": map[string]any{"blkx": blkx}}, plist.XMLFormat, "\t")
+	require.NoError(t, err)
+	koly := make([]byte, 512)
+	copy(koly, "koly")
+	binary.BigEndian.PutUint32(koly[4:], 4)
+	binary.BigEndian.PutUint32(koly[8:], 512)
+	binary.BigEndian.PutUint64(koly[32:], uint64(fork.Len()))
+	binary.BigEndian.PutUint64(koly[216:], uint64(fork.Len()))
+	binary.BigEndian.PutUint64(koly[224:], uint64(len(xml)))
+	fork.Write(xml)
+	fork.Write(koly)
+	return fork.Bytes()
+}
+
+// adcLiterals compresses bs with ADC literal runs only.
+func adcLiterals(bs []byte) []byte {
+	out := []byte{}
+	for len(bs) > 0 {
+		n := min(len(bs), 128)
+		out = append(out, 0x80|byte(n-1))
+		out = append(out, bs[:n]...)
+		bs = bs[n:]
+	}
+	return out
+}
+
+func TestDmg(t *testing.T) {
+	image := hfsImage(t, []hfsEntry{
+		{parent: 1, id: 2, name: "Tool", folder: true, mode: 0040755},
+		{parent: 2, id: 16, name: "bin", folder: true, mode: 0040755},
+		{parent: 16, id: 17, name: "tool", mode: 0100755, data: "#!/bin/sh\necho tool\n"},
+		{parent: 2, id: 18, name: "tool-link", mode: 0120755, data: "bin/tool"},
+		{parent: 2, id: 19, name: ".journal", mode: 0100644, data: "journal"},
+	})
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(image[:32*512])
+	require.NoError(t, zw.Close())
+
+	dmg := udif(t,
+		udifPartition{name: "Driver Descriptor Map (DDM : 0)", chunks: []udifTestChunk{{kind: chunkIgnore, sectors: 1}}},
+		udifPartition{name: "Apple_HFS (Apple_HFS : 1)", chunks: []udifTestChunk{
+			{kind: chunkZlib, sectors: 32, data: compressed.Bytes()},
+			{kind: chunkADC, sectors: 16, data: adcLiterals(image[32*512 : 48*512])},
+			{kind: chunkRaw, sectors: 8, data: image[48*512 : 56*512]},
+			{kind: chunkZero, sectors: 8},
+		}},
+	)
+	extracted, err := extract(t, Dmg{}, dmg)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"bin":       "/",
+		"bin/tool":  "#!/bin/sh\necho tool\n",
+		"tool-link": "-> bin/tool",
+	}, extracted)
+
+	apfs := make([]byte, 4096)
+	copy(apfs[32:], "NXSB")
+	_, err = extract(t, Dmg{}, udif(t, udifPartition{name: "Apple_APFS", chunks: []udifTestChunk{{kind: chunkRaw, sectors: 8, data: apfs}}}))
+	require.ErrorContains(t, err, "APFS")
+	_, err = extract(t, Dmg{}, udif(t, udifPartition{name: "Apple_HFS", chunks: []udifTestChunk{{kind: chunkLZFSE, sectors: 8, data: []byte("bvx2")}}}))
+	require.ErrorContains(t, err, "LZFSE compressed disk images are not supported")
+	_, err = extract(t, Dmg{}, []byte("not a disk image"))
+	require.ErrorContains(t, err, "not a disk image")
+}
+
+func TestDecompressADC(t *testing.T) {
+	// "abc" then three byte and two byte references back to it
+	out, err := decompressADC([]byte{0x82, 'a', 'b', 'c', 0x40 | 2, 0, 2, 0x00 | 1<<2, 5}, 13)
+	require.NoError(t, err)
+	require.Equal(t, "abcabcabcabca", string(out))
+	_, err = decompressADC([]byte{0x40, 0, 9}, 8)
+	require.ErrorContains(t, err, "invalid ADC chunk")
+}
+
+// ar writes a debian package with the given members.
+func ar(members ...xarEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	for _, m := range members {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", m.name+"/", 0, 0, 0, 0644, len(m.data))
+		buf.Write(m.data)
+		if len(m.data)%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// tarball writes a tar archive of headers, with the data of regular files
+// from contents.
+func tarball(t *testing.T, headers []tar.Header, contents map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range headers {
+		h.Size = int64(len(contents[h.Name]))
+		require.NoError(t, tw.WriteHeader(&h))
+		_, err := tw.Write([]byte(contents[h.Name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestDeb(t *testing.T) {
+	data := tarball(t, []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "./usr/bin/t", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/tool"},
+	}, map[string]string{"./usr/bin/tool": "tool"})
+	control := tarball(t, []tar.Header{{Name: "./postinst", Typeflag: tar.TypeReg, Mode: 0755}}, map[string]string{"./postinst": "rm -rf /"})
+
+	for name, member := range map[string]xarEntry{
+		"gzip": {name: "data.tar.gz", data: gzipped(data)},
+		"tar":  {name: "data.tar", data: data},
+	} {
+		t.Run(name, func(t *testing.T) {
+			extracted, err := extract(t, Deb{}, ar(
+				xarEntry{name: "debian-binary", data: []byte("2.0\n")},
+				xarEntry{name: "control.tar.gz", data: gzipped(control)},
+				member,
+			))
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{
+				"./":             "/",
+				"./usr/bin/":     "/",
+				"./usr/bin/tool": "tool",
+				"./usr/bin/t":    "-> tool",
+			}, extracted)
+		})
+	}
+
+	_, err := extract(t, Deb{}, ar(xarEntry{name: "debian-binary", data: []byte("2.0\n")}))
+	require.EqualError(t, err, "debian package has no data archive")
+	_, err = extract(t, Deb{}, []byte("!<arch>\nthis is not the header of a member, which is sixty bytes long"))
+	require.EqualError(t, err, "invalid debian package")
+}
+
+// rpmHeader writes an rpm header with one index entry and a data store of
+// size bytes.
+func rpmHeader(size int) []byte {
+	bs := make([]byte, 16+16+size)
+	copy(bs, "\x8e\xad\xe8\x01")
+	binary.BigEndian.PutUint32(bs[8:], 1)
+	binary.BigEndian.PutUint32(bs[12:], uint32(size))
+	return bs
+}
+
+// rpm writes an rpm package with payload after its headers.
+func rpm(payload []byte) []byte {
+	var buf bytes.Buffer
+	lead := make([]byte, 96)
+	copy(lead, "\xed\xab\xee\xdb")
+	buf.Write(lead)
+	// the signature header is padded to eight bytes
+	buf.Write(rpmHeader(5))
+	buf.Write(make([]byte, 3))
+	buf.Write(rpmHeader(13))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+func TestRpm(t *testing.T) {
+	payload := newc(
+		cpioEntry{name: "./usr/bin", mode: 0040755},
+		cpioEntry{name: "./usr/bin/tool", mode: 0100755, data: "tool"},
+		cpioEntry{name: "./usr/bin/t", mode: 0120777, data: "/usr/bin/tool"},
+	)
+	var xzipped bytes.Buffer
+	xw, err := xz.NewWriter(&xzipped)
+	require.NoError(t, err)
+	_, err = xw.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, xw.Close())
+
+	for name, payload := range map[string][]byte{
+		"raw":  payload,
+		"gzip": gzipped(payload),
+		"xz":   xzipped.Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			extracted, err := extract(t, Rpm{}, rpm(payload))
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{
+				"usr/bin":      "/",
+				"usr/bin/tool": "tool",
+				"usr/bin/t":    "-> tool",
+			}, extracted)
+		})
+	}
+
+	_, err = extract(t, Rpm{}, []byte("not an rpm, but long enough to have a lead of ninety six bytes................................"))
+	require.EqualError(t, err, "not an rpm package")
+}
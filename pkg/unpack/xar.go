@@ -0,0 +1,200 @@
+package unpack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/mholt/archives"
+	"github.com/ulikunitz/xz"
+)
+
+// Pkg extracts the payloads of a flat macOS installer package, a xar
+// archive holding a cpio payload for each component package. Scripts and
+// the distribution are left out, nothing in them is installed.
+type Pkg struct{}
+
+// xarFile is a file in the table of contents of a xar archive.
+type xarFile struct {
+	Name string `xml:"name"`
+	Type string `xml:"type"`
+	Data *struct {
+		Offset   int64 `xml:"offset"`
+		Length   int64 `xml:"length"`
+		Encoding struct {
+			Style string `xml:"style,attr"`
+		} `xml:"encoding"`
+	} `xml:"data"`
+	Files []xarFile `xml:"file"`
+}
+
+// Extract hands the files of every payload in the package to handleFile.
+// The payload of a component package is put under the component's name,
+// ie tool.pkg/usr/local/bin/tool.
+func (Pkg) Extract(ctx context.Context, archive io.Reader, handleFile archives.FileHandler) error {
+	ra, size, err := readerAt(archive)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 28)
+	if _, err := ra.ReadAt(header, 0); err != nil || string(header[:4]) != "xar!" {
+		return errors.New("not a macOS installer package")
+	}
+	headerSize := int64(binary.BigEndian.Uint16(header[4:]))
+	tocLength := int64(binary.BigEndian.Uint64(header[8:]))
+	if tocLength <= 0 || headerSize+tocLength > size {
+		return errors.New("invalid installer package")
+	}
+	zr, err := zlib.NewReader(io.NewSectionReader(ra, headerSize, tocLength))
+	if err != nil {
+		return fmt.Errorf("invalid installer package: %w", err)
+	}
+	var toc struct {
+		Files []xarFile `xml:"toc>file"`
+	}
+	// the table of contents is limited so a bomb can't exhaust memory
+	err = xml.NewDecoder(io.LimitReader(zr, 64<<20)).Decode(&toc)
+	if err != nil {
+		return fmt.Errorf("invalid installer package: %w", err)
+	}
+	heap := headerSize + tocLength
+
+	found := false
+	var walk func(dir string, files []xarFile) error
+	walk = func(dir string, files []xarFile) error {
+		for _, f := range files {
+			name := path.Join(dir, f.Name)
+			if f.Type == "directory" {
+				if err := walk(name, f.Files); err != nil {
+					return err
+				}
+				continue
+			}
+			if f.Name != "Payload" || f.Data == nil {
+				continue
+			}
+			found = true
+			if f.Data.Offset < 0 || f.Data.Length < 0 || heap+f.Data.Offset+f.Data.Length > size {
+				return fmt.Errorf("invalid installer package entry %s", name)
+			}
+			data := io.NewSectionReader(ra, heap+f.Data.Offset, f.Data.Length)
+			err := extractPayload(ctx, data, f.Data.Encoding.Style, dir, handleFile)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return nil
+	}
+	if err := walk("", toc.Files); err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("installer package has no payload")
+	}
+	return nil
+}
+
+// extractPayload decodes a Payload file stored in the xar heap with
+// encoding and extracts the cpio archive inside it.
+func extractPayload(ctx context.Context, data io.Reader, encoding, prefix string, handleFile archives.FileHandler) error {
+	var r io.Reader
+	switch encoding {
+	case "application/x-gzip":
+		// xar's gzip encoding is a zlib stream
+		zr, err := zlib.NewReader(data)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case "application/x-bzip2":
+		r = bzip2.NewReader(data)
+	case "", "application/octet-stream":
+		r = data
+	default:
+		return fmt.Errorf("unsupported encoding %s", encoding)
+	}
+
+	// the payload itself is a gzip or pbzx compressed cpio archive
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	case string(magic) == "pbzx":
+		r = &pbzxReader{r: br}
+	case strings.HasPrefix(string(magic), "BZh"):
+		r = bzip2.NewReader(br)
+	default:
+		r = br
+	}
+	return extractCpio(ctx, r, prefix, handleFile)
+}
+
+// pbzxReader decompresses the pbzx payloads of newer packages: a header,
+// then chunks that are each an xz stream or stored as they are.
+type pbzxReader struct {
+	r     io.Reader
+	chunk io.Reader
+	begun bool
+}
+
+func (p *pbzxReader) Read(bs []byte) (int, error) {
+	for {
+		if p.chunk != nil {
+			n, err := p.chunk.Read(bs)
+			if err != io.EOF {
+				return n, err
+			}
+			p.chunk = nil
+			if n > 0 {
+				return n, nil
+			}
+		}
+		if !p.begun {
+			header := make([]byte, 12)
+			if _, err := io.ReadFull(p.r, header); err != nil || string(header[:4]) != "pbzx" {
+				return 0, errors.New("invalid pbzx payload")
+			}
+			p.begun = true
+		}
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(p.r, header); err == io.EOF {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		length := int64(binary.BigEndian.Uint64(header[8:]))
+		if length <= 0 || length > 64<<20 {
+			return 0, errors.New("invalid pbzx chunk")
+		}
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(p.r, chunk); err != nil {
+			return 0, err
+		}
+		if bytes.HasPrefix(chunk, []byte{0xfd, '7', 'z', 'X', 'Z', 0}) {
+			xr, err := xz.NewReader(bytes.NewReader(chunk))
+			if err != nil {
+				return 0, err
+			}
+			p.chunk = xr
+		} else {
+			p.chunk = bytes.NewReader(chunk)
+		}
+	}
+}
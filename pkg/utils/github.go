@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"context"
+	"crhuber/kelp/pkg/types"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// GithubAPI is the base url of the github api.
+var GithubAPI = "https://api.github.com"
+
+// GetGithubRelease looks up a release by tag, or the newest one on the latest
+// or prerelease channel.
+func GetGithubRelease(ctx context.Context, client *http.Client, owner, repo, release string) (types.GithubRelease, error) {
+	var cache *ReleaseCache
+	return cache.Get(ctx, client, owner, repo, release)
+}
+
+// ReleaseCache keeps github release metadata on disk so lookups cost no API
+// calls. Releases looked up by tag never change and are used as they are.
+// The latest and prerelease channels are used for TTL and then revalidated
+// with a conditional request, which doesn't count against the rate limit
+// when nothing changed. A nil ReleaseCache caches nothing.
+type ReleaseCache struct {
+	Dir string
+	TTL time.Duration
+	// Offline answers every lookup from the cache, however old, and fails
+	// for releases that were never cached.
+	Offline bool
+}
+
+// cachedRelease is a release as stored in the cache.
+type cachedRelease struct {
+	ETag      string              `json:"etag"`
+	FetchedAt time.Time           `json:"fetchedAt"`
+	Release   types.GithubRelease `json:"release"`
+}
+
+// Get looks up a release like GetGithubRelease, using the cache when it can.
+func (c *ReleaseCache) Get(ctx context.Context, client *http.Client, owner, repo, release string) (types.GithubRelease, error) {
+	cached, ok := c.load(owner, repo, release)
+	if ok && c.fresh(cached, release) {
+		return cached.Release, nil
+	}
+	if c != nil && c.Offline {
+		return types.GithubRelease{}, fmt.Errorf("release %s of %s/%s is not cached, run kelp once while online", release, owner, repo)
+	}
+
+	etag := ""
+	if ok {
+		etag = cached.ETag
+	}
+	ghr, etag, err := fetchGithubRelease(ctx, client, owner, repo, release, etag)
+	if err != nil {
+		return types.GithubRelease{}, err
+	}
+	if ghr == nil {
+		// not modified
+		ghr = &cached.Release
+	}
+	c.store(owner, repo, release, cachedRelease{ETag: etag, FetchedAt: time.Now(), Release: *ghr})
+	return *ghr, nil
+}
+
+// Fresh reports whether a lookup of release would be answered from the cache
+// without asking GitHub.
+func (c *ReleaseCache) Fresh(owner, repo, release string) bool {
+	cached, ok := c.load(owner, repo, release)
+	return ok && c.fresh(cached, release)
+}
+
+func (c *ReleaseCache) fresh(cached cachedRelease, release string) bool {
+	if c.Offline {
+		return true
+	}
+	pinned := release != "latest" && release != "prerelease"
+	return pinned || time.Since(cached.FetchedAt) < c.TTL
+}
+
+// Put adds a release to the cache, as when it comes from a bundle.
+func (c *ReleaseCache) Put(owner, repo, release string, ghr types.GithubRelease) {
+	c.store(owner, repo, release, cachedRelease{FetchedAt: time.Now(), Release: ghr})
+}
+
+func (c *ReleaseCache) path(owner, repo, release string) string {
+	// tags may contain slashes
+	return filepath.Join(c.Dir, owner, repo, url.PathEscape(release)+".json")
+}
+
+func (c *ReleaseCache) load(owner, repo, release string) (cachedRelease, bool) {
+	if c == nil {
+		return cachedRelease{}, false
+	}
+	bs, err := os.ReadFile(c.path(owner, repo, release))
+	if err != nil {
+		return cachedRelease{}, false
+	}
+	cached := cachedRelease{}
+	if err := json.Unmarshal(bs, &cached); err != nil {
+		return cachedRelease{}, false
+	}
+	return cached, true
+}
+
+// store saves a release. The cache is only an optimisation so failing to
+// write it is not an error.
+func (c *ReleaseCache) store(owner, repo, release string, cached cachedRelease) {
+	if c == nil {
+		return
+	}
+	bs, err := json.Marshal(cached)
+	if err != nil {
+		return
+	}
+	path := c.path(owner, repo, release)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// fetchGithubRelease asks the github api for a release. When etag is given
+// and the release has not changed since, it returns a nil release.
+func fetchGithubRelease(ctx context.Context, client *http.Client, owner, repo, release, etag string) (*types.GithubRelease, string, error) {
+	var url string
+	switch release {
+	case "latest":
+		url = fmt.Sprintf("%s/repos/%s/%s/releases/%s", GithubAPI, owner, repo, release)
+	case "prerelease":
+		// the newest release of any kind is listed first
+		url = fmt.Sprintf("%s/repos/%s/%s/releases?per_page=1", GithubAPI, owner, repo)
+	default:
+		// try by tag
+		url = fmt.Sprintf("%s/repos/%s/%s/releases/tags/%s", GithubAPI, owner, repo, release)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	// make request
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if etag != "" && resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("invalid HTTP status: %v", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if release == "prerelease" {
+		var releases []types.GithubRelease
+		if err := json.Unmarshal(body, &releases); err != nil {
+			return nil, "", err
+		}
+		if len(releases) == 0 {
+			return nil, "", fmt.Errorf("no releases found for %s/%s", owner, repo)
+		}
+		return &releases[0], resp.Header.Get("ETag"), nil
+	}
+
+	ghr := types.GithubRelease{}
+	if err := json.Unmarshal(body, &ghr); err != nil {
+		return nil, "", err
+	}
+	return &ghr, resp.Header.Get("ETag"), nil
+}
+
+// GetGithubAttestations asks the github api for the attestations of the
+// artifact with a sha256 digest, as published by actions/attest-build-provenance.
+// It returns the response as it is, {"attestations": [{"bundle": ...}]}.
+func GetGithubAttestations(ctx context.Context, client *http.Client, owner, repo, digest string) ([]byte, error) {
+	url := fmt.Sprintf("%s/repos/%s/%s/attestations/sha256:%s", GithubAPI, owner, repo, digest)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s/%s has no attestations for sha256:%s", owner, repo, digest)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid HTTP status: %v", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReleaseCache(t *testing.T) {
+	requests := map[string]int{}
+	notModified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(`{"tag_name": "v1.0.0", "assets": [{"name": "tool_linux_amd64.tar.gz", "size": 42}]}`))
+	}))
+	defer server.Close()
+	defer func(api string) { GithubAPI = api }(GithubAPI)
+	GithubAPI = server.URL
+
+	ctx := context.Background()
+	cache := &ReleaseCache{Dir: t.TempDir(), TTL: time.Hour}
+
+	// tags are looked up once
+	for range 2 {
+		ghr, err := cache.Get(ctx, server.Client(), "foo", "tool", "v1.0.0")
+		require.NoError(t, err)
+		require.Equal(t, 42, ghr.Assets[0].Size)
+	}
+	require.Equal(t, 1, requests["/repos/foo/tool/releases/tags/v1.0.0"])
+	require.True(t, cache.Fresh("foo", "tool", "v1.0.0"))
+
+	// latest is used until the ttl passes
+	_, err := cache.Get(ctx, server.Client(), "foo", "tool", "latest")
+	require.NoError(t, err)
+	_, err = cache.Get(ctx, server.Client(), "foo", "tool", "latest")
+	require.NoError(t, err)
+	require.Equal(t, 1, requests["/repos/foo/tool/releases/latest"])
+
+	// and then revalidated
+	cache.TTL = 0
+	require.False(t, cache.Fresh("foo", "tool", "latest"))
+	ghr, err := cache.Get(ctx, server.Client(), "foo", "tool", "latest")
+	require.NoError(t, err)
+	require.Equal(t, "v1.0.0", ghr.TagName)
+	require.Equal(t, 2, requests["/repos/foo/tool/releases/latest"])
+	require.Equal(t, 1, notModified)
+
+	// without a cache every lookup asks github
+	_, err = GetGithubRelease(ctx, server.Client(), "foo", "tool", "v1.0.0")
+	require.NoError(t, err)
+	require.Equal(t, 2, requests["/repos/foo/tool/releases/tags/v1.0.0"])
+}
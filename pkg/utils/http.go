@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"context"
+	"crhuber/kelp/pkg/auth"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// HTTPOptions configure the client every kelp request is made with.
+type HTTPOptions struct {
+	// Proxy is the URL of a proxy for every request. The standard
+	// HTTPS_PROXY and HTTP_PROXY environment variables are used when empty.
+	Proxy string
+	// NoProxy lists hosts, domains and CIDR ranges reached without the
+	// proxy. The NO_PROXY environment variable is used when empty.
+	NoProxy []string
+	// CABundle is a PEM file of certificates trusted on top of the system
+	// ones, such as the CA of a proxy intercepting TLS.
+	CABundle string
+	// ClientCert and ClientKey are PEM files of a certificate presented to
+	// servers that ask for one. ClientKey may be left empty when the key is
+	// in the same file as the certificate.
+	ClientCert string
+	ClientKey  string
+	// Credentials are added to requests for the hosts they belong to.
+	Credentials *auth.Store
+	// Timeout bounds connecting, the TLS handshake and waiting for response
+	// headers, and aborts a response whose body stops arriving for that
+	// long. Large downloads that keep making progress are never cut off.
+	Timeout time.Duration
+}
+
+// NewHTTPClient returns a client configured by opts. Connection failures,
+// server errors and rate limits are retried with exponential backoff.
+func NewHTTPClient(opts HTTPOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	proxy := httpproxy.FromEnvironment()
+	if opts.Proxy != "" {
+		if _, err := url.Parse(opts.Proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy url %q: %w", opts.Proxy, err)
+		}
+		proxy.HTTPProxy = opts.Proxy
+		proxy.HTTPSProxy = opts.Proxy
+	}
+	if len(opts.NoProxy) > 0 {
+		proxy.NoProxy = strings.Join(opts.NoProxy, ",")
+	}
+	proxyFunc := proxy.ProxyFunc()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+
+	tlsConfig, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	var base http.RoundTripper = transport
+	if opts.Timeout > 0 {
+		dialer := &net.Dialer{Timeout: opts.Timeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = opts.Timeout
+		transport.ResponseHeaderTimeout = opts.Timeout
+		base = &idleTimeoutTransport{base: transport, timeout: opts.Timeout}
+	}
+	base = &retryTransport{base: base, retries: 3, backoff: time.Second}
+	if opts.Credentials != nil {
+		base = opts.Credentials.Transport(base)
+	}
+	return &http.Client{Transport: base}, nil
+}
+
+// newTLSConfig adds the CA bundle and client certificate of opts to the
+// default TLS settings.
+func newTLSConfig(opts HTTPOptions) (*tls.Config, error) {
+	config := &tls.Config{}
+	if opts.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca bundle %s", opts.CABundle)
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.ClientKey != "" && opts.ClientCert == "" {
+		return nil, errors.New("a client key needs a client certificate")
+	}
+	if opts.ClientCert != "" {
+		key := opts.ClientKey
+		if key == "" {
+			key = opts.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// OfflineClient returns a client that fails every request, so nothing can
+// reach the network by accident.
+func OfflineClient() *http.Client {
+	return &http.Client{Transport: offlineTransport{}}
+}
+
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("kelp is offline, not fetching %s", req.URL.Redacted())
+}
+
+// retryTransport retries requests that failed for reasons that are likely to
+// pass, waiting twice as long after each attempt.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	// backoff is the wait before the first retry
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a request body can only be sent once
+	if req.Body != nil && req.Body != http.NoBody {
+		return t.base.RoundTrip(req)
+	}
+	authenticated := req.Header.Get("Authorization") != ""
+	for attempt := 0; ; attempt++ {
+		if wait, ok := limits.reserve(req); !ok {
+			if wait > MaxRateLimitWait {
+				return nil, &RateLimitError{Host: req.URL.Host, Reset: time.Now().Add(wait), Authenticated: authenticated}
+			}
+			if err := sleep(req.Context(), wait); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if !retryable(req.Context(), err) || attempt >= t.retries {
+				return nil, err
+			}
+			wait = t.delay(attempt)
+		default:
+			limits.update(req, resp)
+			if limitWait, limited := rateLimitWait(resp); limited {
+				if limitWait > MaxRateLimitWait || attempt >= t.retries {
+					resp.Body.Close()
+					return nil, &RateLimitError{Host: req.URL.Host, Reset: time.Now().Add(limitWait), Authenticated: authenticated}
+				}
+				wait = max(limitWait, t.delay(attempt))
+			} else if retryableStatus(resp.StatusCode) && attempt < t.retries {
+				wait = t.delay(attempt)
+			} else {
+				return resp, nil
+			}
+			// drain the body so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// delay returns the exponential backoff before retry number attempt, with up
+// to a quarter added at random so parallel requests spread out.
+func (t *retryTransport) delay(attempt int) time.Duration {
+	d := t.backoff << attempt
+	return d + rand.N(d/4+1)
+}
+
+// retryable reports whether err is a network failure worth trying again.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// sleep waits for d or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// idleTimeoutTransport cancels a request once its response body has not
+// delivered any data for timeout.
+type idleTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &idleTimeoutBody{body: resp.Body, timeout: t.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(t.timeout, func() {
+		body.stalled.Store(true)
+		cancel()
+	})
+	resp.Body = body
+	return resp, nil
+}
+
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err != nil && err != io.EOF && b.stalled.Load() {
+		return n, fmt.Errorf("no data received for %s: %w", b.timeout, err)
+	}
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testClient(server *httptest.Server) *http.Client {
+	return &http.Client{Transport: &retryTransport{base: server.Client().Transport, retries: 3, backoff: time.Millisecond}}
+}
+
+func TestRetryServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	resp, err := testClient(server).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.EqualValues(t, 3, calls.Load())
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	resp, err := testClient(server).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.EqualValues(t, 4, calls.Load())
+
+	// client errors are not retried
+	calls.Store(0)
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		http.NotFound(w, nil)
+	}))
+	defer missing.Close()
+	resp, err = testClient(missing).Get(missing.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.EqualValues(t, 1, calls.Load())
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	resp, err := testClient(server).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.EqualValues(t, 2, calls.Load())
+}
+
+func TestRateLimitExhausted(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client := testClient(server)
+	_, err := client.Get(server.URL)
+	var limitErr *RateLimitError
+	require.True(t, errors.As(err, &limitErr))
+	require.False(t, limitErr.Authenticated)
+	require.ErrorContains(t, err, "resets at "+reset.Local().Format("15:04:05"))
+	require.ErrorContains(t, err, "set GITHUB_TOKEN")
+
+	// once the limit is known to be used up requests fail without being sent
+	req, err := http.NewRequest("GET", server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+	_, err = client.Do(req)
+	require.ErrorContains(t, err, "requests were authenticated")
+	require.EqualValues(t, 1, calls.Load())
+}
+
+// writePEM writes a PEM block to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return path
+}
+
+func TestHTTPOptionsTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	dir := t.TempDir()
+
+	// a client certificate for mutual tls
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "kelp"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	opts := HTTPOptions{
+		CABundle:   writePEM(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw),
+		ClientCert: writePEM(t, dir, "client.pem", "CERTIFICATE", der),
+		ClientKey:  writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDER),
+	}
+
+	client, err := NewHTTPClient(opts)
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "kelp", string(body))
+
+	// the server's certificate isn't trusted without the bundle
+	client, err = NewHTTPClient(HTTPOptions{ClientCert: opts.ClientCert, ClientKey: opts.ClientKey})
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	require.ErrorContains(t, err, "certificate")
+
+	_, err = NewHTTPClient(HTTPOptions{CABundle: opts.ClientKey})
+	require.ErrorContains(t, err, "no certificates found")
+	_, err = NewHTTPClient(HTTPOptions{ClientKey: opts.ClientKey})
+	require.ErrorContains(t, err, "needs a client certificate")
+}
+
+func TestHTTPOptionsNoProxy(t *testing.T) {
+	client, err := NewHTTPClient(HTTPOptions{Proxy: "http://proxy.corp:3128", NoProxy: []string{".internal.corp", "10.0.0.0/8"}})
+	require.NoError(t, err)
+	transport := client.Transport.(*retryTransport).base.(*http.Transport)
+	for target, want := range map[string]string{
+		"https://api.github.com/repos":     "http://proxy.corp:3128",
+		"https://mirror.internal.corp/x":   "",
+		"https://10.1.2.3/releases/v1.tgz": "",
+	} {
+		req, err := http.NewRequest("GET", target, nil)
+		require.NoError(t, err)
+		proxy, err := transport.Proxy(req)
+		require.NoError(t, err)
+		if want == "" {
+			require.Nil(t, proxy, target)
+		} else {
+			require.Equal(t, want, proxy.String(), target)
+		}
+	}
+}
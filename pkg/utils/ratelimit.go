@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxRateLimitWait is the longest kelp waits for an exhausted rate limit to
+// reset before giving up with a RateLimitError.
+var MaxRateLimitWait = time.Minute
+
+// RateLimitError is returned when a server's API rate limit is exhausted and
+// does not reset soon enough to wait for it.
+type RateLimitError struct {
+	Host  string
+	Reset time.Time
+	// Authenticated reports whether the requests carried a token.
+	Authenticated bool
+	// Needed and Remaining are set when a bulk operation needs more calls
+	// than remain.
+	Needed    int
+	Remaining int
+}
+
+func (e *RateLimitError) Error() string {
+	msg := fmt.Sprintf("%s API rate limit exceeded", e.Host)
+	if e.Needed > 0 {
+		msg = fmt.Sprintf("%d %s API calls needed but only %d remain", e.Needed, e.Host, e.Remaining)
+	}
+	if !e.Reset.IsZero() {
+		msg += fmt.Sprintf(", the limit resets at %s (in %s)", e.Reset.Local().Format("15:04:05"), time.Until(e.Reset).Round(time.Second))
+	}
+	if e.Authenticated {
+		return msg + ", requests were authenticated"
+	}
+	return msg + ", set GITHUB_TOKEN or add a token to ~/.kelp/credentials to raise the limit"
+}
+
+// rateLimit is the quota a host last reported.
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+// rateLimits tracks the quota of every host that reports one so requests
+// fail fast, or wait, once it is used up instead of being rejected.
+type rateLimits struct {
+	mu    sync.Mutex
+	hosts map[string]*rateLimit
+}
+
+var limits = &rateLimits{hosts: map[string]*rateLimit{}}
+
+// reserve takes a call from the quota of req's host. When the quota is used
+// up it returns how long to wait for it to reset.
+func (l *rateLimits) reserve(req *http.Request) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rl, ok := l.hosts[req.URL.Host]
+	if !ok || time.Now().After(rl.reset) {
+		return 0, true
+	}
+	if rl.remaining <= 0 {
+		return time.Until(rl.reset), false
+	}
+	// count calls in flight so parallel requests don't overshoot
+	rl.remaining--
+	return 0, true
+}
+
+// update records the quota reported in the X-RateLimit headers of resp.
+func (l *rateLimits) update(req *http.Request, resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hosts[req.URL.Host] = &rateLimit{remaining: remaining, reset: time.Unix(reset, 0)}
+}
+
+// rateLimitWait reports whether resp rejected a request for exceeding a rate
+// limit and how long to wait before trying again.
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	// secondary limits say how long to back off
+	if after := resp.Header.Get("Retry-After"); after != "" {
+		if seconds, err := strconv.Atoi(after); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if t, err := http.ParseTime(after); err == nil {
+			return time.Until(t), true
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err == nil {
+			return time.Until(time.Unix(reset, 0)), true
+		}
+	}
+	// a 429 without any hint is still a rate limit
+	return 0, resp.StatusCode == http.StatusTooManyRequests
+}
+
+// CheckGithubBudget makes sure calls GitHub API requests can be made before a
+// bulk operation starts, so it fails up front rather than part way through.
+// It returns nil when the quota can't be looked up.
+func CheckGithubBudget(ctx context.Context, client *http.Client, calls int) error {
+	if calls <= 1 {
+		return nil
+	}
+	// looking up the rate limit does not count against it
+	req, err := http.NewRequestWithContext(ctx, "GET", GithubAPI+"/rate_limit", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	var status struct {
+		Resources struct {
+			Core struct {
+				Limit     int   `json:"limit"`
+				Remaining int   `json:"remaining"`
+				Reset     int64 `json:"reset"`
+			} `json:"core"`
+		} `json:"resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil
+	}
+	core := status.Resources.Core
+	if core.Remaining >= calls {
+		return nil
+	}
+	return &RateLimitError{
+		Host:  req.URL.Host,
+		Reset: time.Unix(core.Reset, 0),
+		// anonymous requests get the smallest limit
+		Authenticated: core.Limit > 60,
+		Needed:        calls,
+		Remaining:     core.Remaining,
+	}
+}
@@ -1,15 +1,13 @@
 package utils
 
 import (
-	"crhuber/kelp/pkg/types"
-	"encoding/json"
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
-	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 func DirExists(dir string) bool {
@@ -30,7 +28,10 @@ func FileExists(filename string) bool {
 
 func FilePathWalkDir(root string) ([]string, error) {
 	var files []string
-	err := filepath.Walk(root, func(path string, info os.FileInfo, _ error) error {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if !info.IsDir() {
 			files = append(files, path)
 		}
@@ -42,11 +43,11 @@ func FilePathWalkDir(root string) ([]string, error) {
 func CopyFile(source, destination string) error {
 	from, err := os.Open(source)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer from.Close()
 
-	to, err := os.OpenFile(destination, os.O_RDWR|os.O_CREATE, 0744)
+	to, err := os.OpenFile(destination, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0744)
 	if err != nil {
 		return err
 	}
@@ -59,55 +60,18 @@ func CopyFile(source, destination string) error {
 	return nil
 }
 
+// StorePath returns the directory a release is installed to in a versioned
+// store rooted at storeDir.
+func StorePath(storeDir, owner, repo, release string) string {
+	// releases given as urls can't be used as a directory name
+	if strings.HasPrefix(release, "http") {
+		sum := sha256.Sum256([]byte(release))
+		release = "url-" + hex.EncodeToString(sum[:6])
+	}
+	return filepath.Join(storeDir, owner, repo, release)
+}
+
 func CommandExists(cmd string) (string, error) {
 	path, err := exec.LookPath(cmd)
 	return path, err
 }
-
-func GetGithubRelease(owner, repo, release string) (types.GithubRelease, error) {
-	var url string
-	if release == "latest" {
-		fmt.Printf("🌐 Getting releases for %s/%s:%s...\n", owner, repo, release)
-		url = fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/%s", owner, repo, release)
-
-	} else {
-		// try by tag
-		fmt.Printf("🌐 Getting releases by tag %s...\n", release)
-		url = fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/tags/%s", owner, repo, release)
-	}
-
-	// create client
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return types.GithubRelease{}, err
-	}
-
-	// set headers for github auth
-	ghToken := os.Getenv("GITHUB_TOKEN")
-	if ghToken != "" {
-		fmt.Println("Using Github token in http request")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ghToken))
-	}
-
-	// make request
-	resp, err := client.Do(req)
-	if err != nil {
-		return types.GithubRelease{}, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return types.GithubRelease{}, fmt.Errorf("invalid HTTP status: %v", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return types.GithubRelease{}, err
-	}
-	ghr := types.GithubRelease{}
-
-	if err := json.Unmarshal(body, &ghr); err != nil {
-		return types.GithubRelease{}, err
-	}
-	return ghr, nil
-}
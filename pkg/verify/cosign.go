@@ -0,0 +1,564 @@
+package verify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fulcio certificate extensions holding the OIDC issuer of the identity.
+var (
+	oidIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// verifyCosign checks a base64 .sig made with cosign sign-blob --key, or a
+// cosign or sigstore bundle.
+func (v Verifier) verifyCosign(sig Signature, bs []byte) (string, error) {
+	if strings.HasSuffix(sig.Path, ".sig") {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(bs)))
+		if err != nil {
+			return "", errors.New("invalid cosign signature")
+		}
+		return verifyWithKey(v.Trust.CosignKey, sig.Signed, raw)
+	}
+
+	b, err := parseBundle(bs)
+	if err != nil {
+		return "", err
+	}
+	if b.envelope != nil {
+		return "", errors.New("bundle holds an attestation, not a signature of a blob")
+	}
+	if b.cert == nil {
+		if v.Trust.CosignKey == "" {
+			return "", errors.New("bundle was signed with a key, configure cosignKey to check it")
+		}
+		return verifyWithKey(v.Trust.CosignKey, sig.Signed, b.signature)
+	}
+	if v.Trust.Identity == "" || v.Trust.Issuer == "" {
+		return "", errors.New("bundle is signed keyless, configure the identity and issuer to check it")
+	}
+	return v.verifyKeyless(b, sig.Signed)
+}
+
+// verifyWithKey checks sig over the file at path with a PEM public key.
+func verifyWithKey(key, path string, sig []byte) (string, error) {
+	bs, err := readKey(key)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return "", errors.New("invalid cosign public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("invalid cosign public key: %w", err)
+	}
+	err = verifyFile(pub, path, sig)
+	if err != nil {
+		return "", err
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+	return "key " + hex.EncodeToString(fingerprint[:8]), nil
+}
+
+// verifyFile checks sig over the file at path.
+func verifyFile(pub crypto.PublicKey, path string, sig []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return verifySignature(pub, f, sig)
+}
+
+// verifySignature checks sig over message the way cosign signs with each
+// kind of key.
+func verifySignature(pub crypto.PublicKey, message io.Reader, sig []byte) error {
+	digest := func(h hash.Hash) ([]byte, error) {
+		_, err := io.Copy(h, message)
+		return h.Sum(nil), err
+	}
+	var ok bool
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		var h hash.Hash
+		switch k.Curve {
+		case elliptic.P384():
+			h = sha512.New384()
+		case elliptic.P521():
+			h = sha512.New()
+		default:
+			h = sha256.New()
+		}
+		sum, err := digest(h)
+		if err != nil {
+			return err
+		}
+		ok = ecdsa.VerifyASN1(k, sum, sig)
+	case *rsa.PublicKey:
+		sum, err := digest(sha256.New())
+		if err != nil {
+			return err
+		}
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, sum, sig) == nil || rsa.VerifyPSS(k, crypto.SHA256, sum, sig, nil) == nil
+	case ed25519.PublicKey:
+		bs, err := io.ReadAll(message)
+		if err != nil {
+			return err
+		}
+		ok = ed25519.Verify(k, bs, sig)
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	if !ok {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// bundle is the part of a cosign or sigstore bundle needed to check a blob.
+type bundle struct {
+	// cert is the signing certificate of a keyless signature, nil when a
+	// key was used.
+	cert      *x509.Certificate
+	signature []byte
+	// digest is the sha256 of the blob, when the bundle records it.
+	digest []byte
+	// envelope is the signed statement of an attestation, whose signature
+	// is over the envelope rather than a blob.
+	envelope *envelope
+	entry    *tlogEntry
+}
+
+// envelope is a DSSE envelope.
+type envelope struct {
+	payloadType string
+	payload     []byte
+}
+
+// tlogEntry is the transparency log entry of a signature with the promise
+// the log made to include it.
+type tlogEntry struct {
+	// body is the base64 entry as the log signed it.
+	body           string
+	integratedTime int64
+	logIndex       int64
+	logID          string
+	set            []byte
+}
+
+type rawBytes struct {
+	RawBytes []byte `json:"rawBytes"`
+}
+
+// bundleJSON covers both the sigstore bundle of cosign --new-bundle-format
+// and the older cosign sign-blob --bundle format.
+type bundleJSON struct {
+	VerificationMaterial struct {
+		Certificate          *rawBytes `json:"certificate"`
+		X509CertificateChain *struct {
+			Certificates []rawBytes `json:"certificates"`
+		} `json:"x509CertificateChain"`
+		TlogEntries []struct {
+			LogIndex int64 `json:"logIndex,string"`
+			LogID    struct {
+				KeyID []byte `json:"keyId"`
+			} `json:"logId"`
+			IntegratedTime   int64 `json:"integratedTime,string"`
+			InclusionPromise *struct {
+				SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+			} `json:"inclusionPromise"`
+			CanonicalizedBody []byte `json:"canonicalizedBody"`
+		} `json:"tlogEntries"`
+	} `json:"verificationMaterial"`
+	MessageSignature *struct {
+		MessageDigest struct {
+			Algorithm string `json:"algorithm"`
+			Digest    []byte `json:"digest"`
+		} `json:"messageDigest"`
+		Signature []byte `json:"signature"`
+	} `json:"messageSignature"`
+	DsseEnvelope *struct {
+		Payload     []byte `json:"payload"`
+		PayloadType string `json:"payloadType"`
+		Signatures  []struct {
+			Sig []byte `json:"sig"`
+		} `json:"signatures"`
+	} `json:"dsseEnvelope"`
+
+	Base64Signature string `json:"base64Signature"`
+	Cert            string `json:"cert"`
+	RekorBundle     *struct {
+		SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+		Payload              struct {
+			Body           string `json:"body"`
+			IntegratedTime int64  `json:"integratedTime"`
+			LogIndex       int64  `json:"logIndex"`
+			LogID          string `json:"logID"`
+		} `json:"Payload"`
+	} `json:"rekorBundle"`
+}
+
+func parseBundle(bs []byte) (bundle, error) {
+	b := bundle{}
+	var raw bundleJSON
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		return b, fmt.Errorf("invalid bundle: %w", err)
+	}
+
+	// cosign's own bundle format
+	if raw.Base64Signature != "" {
+		sig, err := base64.StdEncoding.DecodeString(raw.Base64Signature)
+		if err != nil {
+			return b, errors.New("invalid bundle signature")
+		}
+		b.signature = sig
+		certPEM, err := base64.StdEncoding.DecodeString(raw.Cert)
+		if err != nil {
+			return b, errors.New("invalid bundle certificate")
+		}
+		// bundles signed with a key hold the public key instead
+		if block, _ := pem.Decode(certPEM); block != nil && block.Type == "CERTIFICATE" {
+			b.cert, err = x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return b, fmt.Errorf("invalid bundle certificate: %w", err)
+			}
+		}
+		if rb := raw.RekorBundle; rb != nil {
+			b.entry = &tlogEntry{
+				body:           rb.Payload.Body,
+				integratedTime: rb.Payload.IntegratedTime,
+				logIndex:       rb.Payload.LogIndex,
+				logID:          rb.Payload.LogID,
+				set:            rb.SignedEntryTimestamp,
+			}
+		}
+		return b, nil
+	}
+
+	switch {
+	case raw.MessageSignature != nil:
+		b.signature = raw.MessageSignature.Signature
+		if raw.MessageSignature.MessageDigest.Algorithm == "SHA2_256" {
+			b.digest = raw.MessageSignature.MessageDigest.Digest
+		}
+	case raw.DsseEnvelope != nil && len(raw.DsseEnvelope.Signatures) > 0:
+		b.envelope = &envelope{payloadType: raw.DsseEnvelope.PayloadType, payload: raw.DsseEnvelope.Payload}
+		b.signature = raw.DsseEnvelope.Signatures[0].Sig
+	default:
+		return b, errors.New("bundle does not sign a blob")
+	}
+	vm := raw.VerificationMaterial
+	var der []byte
+	if vm.Certificate != nil {
+		der = vm.Certificate.RawBytes
+	} else if vm.X509CertificateChain != nil && len(vm.X509CertificateChain.Certificates) > 0 {
+		der = vm.X509CertificateChain.Certificates[0].RawBytes
+	}
+	if der != nil {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return b, fmt.Errorf("invalid bundle certificate: %w", err)
+		}
+		b.cert = cert
+	}
+	for _, e := range vm.TlogEntries {
+		if e.InclusionPromise == nil {
+			continue
+		}
+		b.entry = &tlogEntry{
+			body:           base64.StdEncoding.EncodeToString(e.CanonicalizedBody),
+			integratedTime: e.IntegratedTime,
+			logIndex:       e.LogIndex,
+			logID:          hex.EncodeToString(e.LogID.KeyID),
+			set:            e.InclusionPromise.SignedEntryTimestamp,
+		}
+		break
+	}
+	return b, nil
+}
+
+// verifyKeyless checks a keyless signature: the certificate must chain to a
+// Fulcio CA in the trusted root at the time the transparency log recorded
+// the signature, name the expected identity and issuer, and the log must
+// have promised to include an entry for exactly this signature and blob.
+func (v Verifier) verifyKeyless(b bundle, path string) (string, error) {
+	if b.entry == nil {
+		return "", errors.New("bundle has no transparency log entry")
+	}
+	root, err := loadTrustedRoot(v.TrustedRoot)
+	if err != nil {
+		return "", err
+	}
+	err = root.verifyEntry(b.entry)
+	if err != nil {
+		return "", err
+	}
+	signedAt := time.Unix(b.entry.integratedTime, 0)
+	err = root.verifyCert(b.cert, signedAt)
+	if err != nil {
+		return "", err
+	}
+
+	identity := certIdentity(b.cert)
+	if identity != v.Trust.Identity {
+		return "", fmt.Errorf("signed by %s, not %s", identity, v.Trust.Identity)
+	}
+	issuer := certIssuer(b.cert)
+	if issuer != v.Trust.Issuer {
+		return "", fmt.Errorf("identity issued by %s, not %s", issuer, v.Trust.Issuer)
+	}
+
+	digest, err := fileDigest(path, sha256.New())
+	if err != nil {
+		return "", err
+	}
+	if b.digest != nil && !bytes.Equal(b.digest, digest) {
+		return "", errors.New("bundle is for another file")
+	}
+	err = checkEntryBody(b, digest)
+	if err != nil {
+		return "", err
+	}
+	err = verifyFile(b.cert.PublicKey, path, b.signature)
+	if err != nil {
+		return "", err
+	}
+	return identity, nil
+}
+
+type hashValue struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"value"`
+}
+
+// checkEntryBody makes sure the log entry records this signature of a blob
+// with this digest, or of this attestation, so an entry for something else
+// can't be replayed.
+func checkEntryBody(b bundle, digest []byte) error {
+	bs, err := base64.StdEncoding.DecodeString(b.entry.body)
+	if err != nil {
+		return errors.New("invalid transparency log entry")
+	}
+	var body struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			// hashedrekord
+			Data struct {
+				Hash hashValue `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content   []byte `json:"content"`
+				PublicKey struct {
+					Content []byte `json:"content"`
+				} `json:"publicKey"`
+			} `json:"signature"`
+			// dsse
+			PayloadHash hashValue `json:"payloadHash"`
+			Signatures  []struct {
+				Signature []byte `json:"signature"`
+				Verifier  []byte `json:"verifier"`
+			} `json:"signatures"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(bs, &body); err != nil {
+		return errors.New("invalid transparency log entry")
+	}
+	var recorded hashValue
+	var signature, cert []byte
+	switch {
+	case body.Kind == "hashedrekord" && b.envelope == nil:
+		recorded = body.Spec.Data.Hash
+		signature, cert = body.Spec.Signature.Content, body.Spec.Signature.PublicKey.Content
+	case body.Kind == "dsse" && b.envelope != nil && len(body.Spec.Signatures) == 1:
+		recorded = body.Spec.PayloadHash
+		signature, cert = body.Spec.Signatures[0].Signature, body.Spec.Signatures[0].Verifier
+	default:
+		return fmt.Errorf("unsupported transparency log entry %s", body.Kind)
+	}
+	if recorded.Algorithm != "sha256" || recorded.Value != hex.EncodeToString(digest) {
+		return errors.New("transparency log entry is for another file")
+	}
+	if !bytes.Equal(signature, b.signature) {
+		return errors.New("transparency log entry is for another signature")
+	}
+	block, _ := pem.Decode(cert)
+	if block == nil || !bytes.Equal(block.Bytes, b.cert.Raw) {
+		return errors.New("transparency log entry is for another certificate")
+	}
+	return nil
+}
+
+// certIdentity returns the identity a Fulcio certificate was issued to.
+func certIdentity(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// certIssuer returns the OIDC issuer recorded in a Fulcio certificate.
+func certIssuer(cert *x509.Certificate) string {
+	if issuer := certExtension(cert, oidIssuerV2); issuer != "" {
+		return issuer
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidIssuerV1) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// certExtension returns the value of a Fulcio certificate extension that
+// holds a DER string.
+func certExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			var value string
+			if _, err := asn1.Unmarshal(ext.Value, &value); err == nil {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// validity is when a key or CA in the trusted root may be used.
+type validity struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end"`
+}
+
+func (v validity) covers(t time.Time) bool {
+	return !t.Before(v.Start) && (v.End == nil || !t.After(*v.End))
+}
+
+// trustedRoot is the part of a sigstore trusted_root.json naming the
+// transparency logs and certificate authorities to trust.
+type trustedRoot struct {
+	Tlogs []struct {
+		PublicKey struct {
+			RawBytes []byte   `json:"rawBytes"`
+			ValidFor validity `json:"validFor"`
+		} `json:"publicKey"`
+		LogID struct {
+			KeyID []byte `json:"keyId"`
+		} `json:"logId"`
+	} `json:"tlogs"`
+	CertificateAuthorities []struct {
+		CertChain struct {
+			Certificates []rawBytes `json:"certificates"`
+		} `json:"certChain"`
+		ValidFor validity `json:"validFor"`
+	} `json:"certificateAuthorities"`
+}
+
+func loadTrustedRoot(path string) (*trustedRoot, error) {
+	if path == "" {
+		return nil, errors.New("keyless signatures need a sigstore trusted root, set trustedRoot")
+	}
+	bs, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("keyless signatures need a sigstore trusted root, save the trusted_root.json from sigstore's TUF repository to %s", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	root := &trustedRoot{}
+	err = json.Unmarshal(bs, root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted root %s: %w", path, err)
+	}
+	return root, nil
+}
+
+// verifyEntry checks the log's signed promise to include the entry.
+func (r *trustedRoot) verifyEntry(e *tlogEntry) error {
+	payload, err := json.Marshal(struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogID          string `json:"logID"`
+		LogIndex       int64  `json:"logIndex"`
+	}{e.body, e.integratedTime, e.logID, e.logIndex})
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(payload)
+	signedAt := time.Unix(e.integratedTime, 0)
+	for _, tlog := range r.Tlogs {
+		if hex.EncodeToString(tlog.LogID.KeyID) != e.logID {
+			continue
+		}
+		if !tlog.PublicKey.ValidFor.covers(signedAt) {
+			return fmt.Errorf("transparency log %s was not trusted at %s", e.logID, signedAt)
+		}
+		pub, err := x509.ParsePKIXPublicKey(tlog.PublicKey.RawBytes)
+		if err != nil {
+			return fmt.Errorf("invalid transparency log key: %w", err)
+		}
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok || !ecdsa.VerifyASN1(key, digest[:], e.set) {
+			return errors.New("transparency log entry timestamp does not match")
+		}
+		return nil
+	}
+	return fmt.Errorf("transparency log %s is not in the trusted root", e.logID)
+}
+
+// verifyCert checks that cert chains to a trusted CA at time t.
+func (r *trustedRoot) verifyCert(cert *x509.Certificate, t time.Time) error {
+	var err error = errors.New("trusted root has no certificate authority")
+	for _, ca := range r.CertificateAuthorities {
+		chain := ca.CertChain.Certificates
+		if len(chain) == 0 || !ca.ValidFor.covers(t) {
+			continue
+		}
+		roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+		for i, c := range chain {
+			parsed, perr := x509.ParseCertificate(c.RawBytes)
+			if perr != nil {
+				return fmt.Errorf("invalid certificate in trusted root: %w", perr)
+			}
+			if i == len(chain)-1 {
+				roots.AddCert(parsed)
+			} else {
+				intermediates.AddCert(parsed)
+			}
+		}
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   t,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate is not trusted: %w", err)
+}
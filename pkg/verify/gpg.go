@@ -0,0 +1,52 @@
+package verify
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// isOpenPGP reports whether sig is an armored or binary OpenPGP signature
+// rather than a base64 cosign one.
+func isOpenPGP(sig []byte) bool {
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN PGP")) {
+		return true
+	}
+	// binary packets have the high bit of their first byte set
+	return len(sig) > 0 && sig[0]&0x80 != 0
+}
+
+// verifyGPG checks a detached OpenPGP signature of the file at path against
+// an armored public key.
+func verifyGPG(key, path string, sig []byte) (string, error) {
+	armored, err := readKey(key)
+	if err != nil {
+		return "", err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armored))
+	if err != nil {
+		return "", fmt.Errorf("invalid gpg public key: %w", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var signer *openpgp.Entity
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN PGP")) {
+		signer, err = openpgp.CheckArmoredDetachedSignature(keyring, f, bytes.NewReader(sig), nil)
+	} else {
+		signer, err = openpgp.CheckDetachedSignature(keyring, f, bytes.NewReader(sig), nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	fingerprint := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+	if id := signer.PrimaryIdentity(); id != nil {
+		return fmt.Sprintf("%s %s", fingerprint, id.Name), nil
+	}
+	return fingerprint, nil
+}
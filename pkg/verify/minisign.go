@@ -0,0 +1,101 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignKey is a minisign public key: the algorithm, a key id and an
+// ed25519 key.
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey accepts the base64 key on its own or a minisign.pub file.
+func parseMinisignKey(text string) (minisignKey, error) {
+	k := minisignKey{}
+	if !strings.HasPrefix(strings.TrimSpace(text), "RW") {
+		bs, err := os.ReadFile(text)
+		if err != nil {
+			return k, err
+		}
+		text = string(bs)
+	}
+	line := ""
+	for _, l := range strings.Split(text, "\n") {
+		l = strings.TrimSpace(l)
+		if l != "" && !strings.HasPrefix(l, "untrusted comment:") {
+			line = l
+		}
+	}
+	bs, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(bs) != 42 || string(bs[:2]) != "Ed" {
+		return k, errors.New("invalid minisign public key")
+	}
+	copy(k.id[:], bs[2:10])
+	k.key = ed25519.PublicKey(bs[10:])
+	return k, nil
+}
+
+// keyID formats an id the way minisign prints it.
+func keyID(id [8]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+// verifyMinisign checks a .minisig signature of the file at path, including
+// the signature over its trusted comment.
+func verifyMinisign(key, path string, sig []byte) (string, error) {
+	k, err := parseMinisignKey(key)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.ReplaceAll(string(sig), "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return "", errors.New("invalid minisign signature")
+	}
+	bs, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(bs) != 74 {
+		return "", errors.New("invalid minisign signature")
+	}
+	algorithm, id, signature := string(bs[:2]), [8]byte(bs[2:10]), bs[10:]
+	if id != k.id {
+		return "", fmt.Errorf("signed by key %s, not %s", keyID(id), keyID(k.id))
+	}
+
+	var message []byte
+	switch algorithm {
+	case "ED":
+		// the file is prehashed
+		h, _ := blake2b.New512(nil)
+		message, err = fileDigest(path, h)
+	case "Ed":
+		message, err = os.ReadFile(path)
+	default:
+		return "", fmt.Errorf("unknown minisign algorithm %q", algorithm)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(k.key, message, signature) {
+		return "", errors.New("signature does not match")
+	}
+
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return "", errors.New("invalid minisign signature")
+	}
+	comment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(k.key, bytes.Join([][]byte{signature, []byte(comment)}, nil), global) {
+		return "", errors.New("trusted comment signature does not match")
+	}
+	return keyID(k.id), nil
+}
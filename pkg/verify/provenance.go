@@ -0,0 +1,174 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// GithubIssuer is the OIDC issuer of github actions workflows, which sign
+// github's attestations.
+const GithubIssuer = "https://token.actions.githubusercontent.com"
+
+// oidSourceRepository is the Fulcio certificate extension holding the url of
+// the repository the workflow ran in.
+var oidSourceRepository = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 12}
+
+// Provenance is who must have built an asset according to its GitHub build
+// provenance attestation, made with actions/attest-build-provenance.
+type Provenance struct {
+	// Repository is the owner/repo whose workflow built the asset. It
+	// defaults to the package's repository.
+	Repository string `json:"repository,omitempty" yaml:"repository,omitempty" toml:"repository,omitempty"`
+	// Workflow is the path of the workflow in the repository, ie
+	// .github/workflows/release.yml. Any workflow is accepted when empty.
+	Workflow string `json:"workflow,omitempty" yaml:"workflow,omitempty" toml:"workflow,omitempty"`
+}
+
+// statement is the in-toto statement an attestation signs.
+type statement struct {
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string `json:"predicateType"`
+}
+
+// VerifyProvenance checks the file at path against the attestations saved
+// from the github api at attestations. One of them must be a SLSA
+// provenance of the file's digest, signed keyless by a github actions
+// workflow of the trusted repository and logged in a transparency log of
+// the trusted root. It returns the identity of the workflow that built the
+// file.
+func (v Verifier) VerifyProvenance(path, attestations string) (string, error) {
+	p := v.Trust.Provenance
+	if p == nil || p.Repository == "" {
+		return "", errors.New("no repository to check the provenance against")
+	}
+	bs, err := os.ReadFile(attestations)
+	if err != nil {
+		return "", err
+	}
+	var response struct {
+		Attestations []struct {
+			Bundle json.RawMessage `json:"bundle"`
+		} `json:"attestations"`
+	}
+	if err := json.Unmarshal(bs, &response); err != nil {
+		return "", fmt.Errorf("invalid attestations: %w", err)
+	}
+	digest, err := fileDigest(path, sha256.New())
+	if err != nil {
+		return "", err
+	}
+
+	err = fmt.Errorf("%s has no build provenance attestation", filepath.Base(path))
+	for _, a := range response.Attestations {
+		b, perr := parseBundle(a.Bundle)
+		if perr != nil || b.envelope == nil {
+			continue
+		}
+		var s statement
+		if json.Unmarshal(b.envelope.payload, &s) != nil || !strings.HasPrefix(s.PredicateType, "https://slsa.dev/provenance/") {
+			continue
+		}
+		var builder string
+		builder, err = v.verifyAttestation(b, s, digest)
+		if err == nil {
+			return builder, nil
+		}
+	}
+	return "", err
+}
+
+// verifyAttestation checks a provenance attestation the way verifyKeyless
+// checks a signature, with the repository and workflow in place of the
+// identity.
+func (v Verifier) verifyAttestation(b bundle, s statement, digest []byte) (string, error) {
+	if b.cert == nil {
+		return "", errors.New("attestation is not signed keyless")
+	}
+	if b.entry == nil {
+		return "", errors.New("attestation has no transparency log entry")
+	}
+	if b.envelope.payloadType != "application/vnd.in-toto+json" {
+		return "", fmt.Errorf("unsupported attestation payload %s", b.envelope.payloadType)
+	}
+	root, err := loadTrustedRoot(v.TrustedRoot)
+	if err != nil {
+		return "", err
+	}
+	err = root.verifyEntry(b.entry)
+	if err != nil {
+		return "", err
+	}
+	err = root.verifyCert(b.cert, time.Unix(b.entry.integratedTime, 0))
+	if err != nil {
+		return "", err
+	}
+
+	issuer := v.Trust.Issuer
+	if issuer == "" {
+		issuer = GithubIssuer
+	}
+	if certIssuer(b.cert) != issuer {
+		return "", fmt.Errorf("attestation identity issued by %s, not %s", certIssuer(b.cert), issuer)
+	}
+	p := v.Trust.Provenance
+	source := certExtension(b.cert, oidSourceRepository)
+	if !sameRepository(source, p.Repository) {
+		return "", fmt.Errorf("built by %s, not %s", source, p.Repository)
+	}
+	identity := certIdentity(b.cert)
+	if p.Workflow != "" {
+		workflow := p.Workflow
+		if !strings.Contains(workflow, "/") {
+			workflow = ".github/workflows/" + workflow
+		}
+		ran, _, _ := strings.Cut(identity, "@")
+		if !sameRepository(strings.TrimSuffix(ran, "/"+workflow), p.Repository) || !strings.HasSuffix(ran, "/"+workflow) {
+			return "", fmt.Errorf("built by workflow %s, not %s", identity, workflow)
+		}
+	}
+
+	payloadDigest := sha256.Sum256(b.envelope.payload)
+	err = checkEntryBody(b, payloadDigest[:])
+	if err != nil {
+		return "", err
+	}
+	err = verifySignature(b.cert.PublicKey, bytes.NewReader(pae(b.envelope.payloadType, b.envelope.payload)), b.signature)
+	if err != nil {
+		return "", err
+	}
+	for _, subject := range s.Subject {
+		if strings.EqualFold(subject.Digest["sha256"], hex.EncodeToString(digest)) {
+			return identity, nil
+		}
+	}
+	return "", errors.New("attestation is for another file")
+}
+
+// sameRepository reports whether the repository url u is owner/repo on any
+// github host.
+func sameRepository(u, repository string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "https" {
+		return false
+	}
+	return strings.EqualFold(strings.Trim(parsed.Path, "/"), repository)
+}
+
+// pae is the DSSE pre-authentication encoding of a payload, which is what
+// an envelope's signatures sign.
+func pae(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
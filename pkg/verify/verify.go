@@ -0,0 +1,348 @@
+package verify
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Trust is what a package's release signatures must verify against. Keys
+// are given inline or as the path of a file holding them.
+type Trust struct {
+	// Minisign is a minisign public key, ie RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3.
+	Minisign string `json:"minisign,omitempty" yaml:"minisign,omitempty" toml:"minisign,omitempty"`
+	// GPG is an armored OpenPGP public key.
+	GPG string `json:"gpg,omitempty" yaml:"gpg,omitempty" toml:"gpg,omitempty"`
+	// CosignKey is a PEM public key for signatures made with cosign
+	// sign-blob --key.
+	CosignKey string `json:"cosignKey,omitempty" yaml:"cosignKey,omitempty" toml:"cosignKey,omitempty"`
+	// Identity and Issuer are the certificate identity and OIDC issuer
+	// expected of keyless cosign signatures, ie
+	// https://github.com/owner/repo/.github/workflows/release.yml@refs/tags/v1.0.0
+	// and https://token.actions.githubusercontent.com.
+	Identity string `json:"identity,omitempty" yaml:"identity,omitempty" toml:"identity,omitempty"`
+	Issuer   string `json:"issuer,omitempty" yaml:"issuer,omitempty" toml:"issuer,omitempty"`
+	// Provenance requires a GitHub build provenance attestation of the
+	// asset, made by the given repository and workflow.
+	Provenance *Provenance `json:"provenance,omitempty" yaml:"provenance,omitempty" toml:"provenance,omitempty"`
+}
+
+// Signs reports whether t has anything to check release signatures with,
+// as opposed to only asking for provenance.
+func (t Trust) Signs() bool {
+	return t.Minisign != "" || t.GPG != "" || t.CosignKey != "" || t.Identity != ""
+}
+
+// Methods a signature is checked with.
+const (
+	Minisign = "minisign"
+	GPG      = "gpg"
+	Cosign   = "cosign"
+	// Attestation is a GitHub build provenance attestation.
+	Attestation = "attestation"
+)
+
+// Verification statuses.
+const (
+	// Verified means a signature checked out against the package's trust.
+	Verified = "verified"
+	// Failed means a signature did not check out, or none could be checked.
+	Failed = "failed"
+	// Unchecked means the release is signed but the package has no trust
+	// configured to check it against.
+	Unchecked = "unchecked"
+	// Unsigned means the release has no signatures.
+	Unsigned = "unsigned"
+)
+
+// Result records the signature check of an installed release.
+type Result struct {
+	Release string `json:"release" yaml:"release"`
+	Asset   string `json:"asset" yaml:"asset"`
+	Status  string `json:"status" yaml:"status"`
+	Method  string `json:"method,omitempty" yaml:"method,omitempty"`
+	// Signer identifies the key or identity that made the signature.
+	Signer string `json:"signer,omitempty" yaml:"signer,omitempty"`
+	// Signature is the file holding the signature that was checked.
+	Signature string `json:"signature,omitempty" yaml:"signature,omitempty"`
+	// Builder is the workflow that built the asset according to its
+	// provenance attestation.
+	Builder   string    `json:"builder,omitempty" yaml:"builder,omitempty"`
+	Error     string    `json:"error,omitempty" yaml:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt" yaml:"checkedAt"`
+}
+
+// String summarises the result, ie verified (minisign, RWQ...).
+func (r Result) String() string {
+	s := r.Status
+	switch {
+	case r.Status == Failed && r.Error != "":
+		return fmt.Sprintf("%s: %s", r.Status, r.Error)
+	case r.Signer != "":
+		s = fmt.Sprintf("%s (%s, %s)", r.Status, r.Method, r.Signer)
+	case r.Method != "":
+		s = fmt.Sprintf("%s (%s)", r.Status, r.Method)
+	}
+	if r.Builder != "" {
+		s += ", built by " + r.Builder
+	}
+	return s
+}
+
+// Signature is a signature file and the file it signs.
+type Signature struct {
+	// Path is the signature file.
+	Path string
+	// Signed is the file the signature covers, either the asset itself or a
+	// checksum file listing it.
+	Signed string
+}
+
+// signatureExtensions are the suffixes of signature files, most specific
+// first.
+var signatureExtensions = []string{".minisig", ".sigstore.json", ".sigstore", ".bundle", ".asc", ".sig"}
+
+// Find returns the signatures among a release's assets that cover the asset
+// called name, either directly or through a signed checksum file. Path and
+// Signed hold asset names. Signatures of the asset itself come first.
+func Find(assets []string, name string) []Signature {
+	present := map[string]bool{}
+	for _, a := range assets {
+		present[a] = true
+	}
+	signed := []string{name}
+	for _, a := range assets {
+		if a != name && isChecksumFile(a) {
+			signed = append(signed, a)
+		}
+	}
+	sigs := []Signature{}
+	for _, s := range signed {
+		for _, ext := range signatureExtensions {
+			if present[s+ext] {
+				sigs = append(sigs, Signature{Path: s + ext, Signed: s})
+			}
+		}
+	}
+	return sigs
+}
+
+// isChecksumFile reports whether name looks like a list of checksums such as
+// checksums.txt or SHA256SUMS.
+func isChecksumFile(name string) bool {
+	for _, ext := range signatureExtensions {
+		if strings.HasSuffix(name, ext) {
+			return false
+		}
+	}
+	lower := strings.ToLower(name)
+	return strings.Contains(lower, "checksum") || strings.Contains(lower, "sha256sum") || strings.Contains(lower, "sha512sum")
+}
+
+// method returns how the signature file called name is checked with t, or
+// "" when t has nothing to check it against.
+func (t Trust) method(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".minisig") && t.Minisign != "":
+		return Minisign
+	case strings.HasSuffix(name, ".asc") && t.GPG != "":
+		return GPG
+	case strings.HasSuffix(name, ".sig") && t.GPG != "" && t.CosignKey != "":
+		// both sign .sig files, cosign's are base64 text
+		return GPG + "|" + Cosign
+	case strings.HasSuffix(name, ".sig") && t.GPG != "":
+		return GPG
+	case strings.HasSuffix(name, ".sig") && t.CosignKey != "":
+		return Cosign
+	case (strings.HasSuffix(name, ".sigstore.json") || strings.HasSuffix(name, ".sigstore") || strings.HasSuffix(name, ".bundle")) && (t.CosignKey != "" || t.Identity != ""):
+		return Cosign
+	}
+	return ""
+}
+
+// Accepts reports whether the signature file called name can be checked
+// with t.
+func (t Trust) Accepts(name string) bool {
+	return t.method(name) != ""
+}
+
+// Verifier checks release assets against a package's trust.
+type Verifier struct {
+	Trust Trust
+	// TrustedRoot is the path of a sigstore trusted_root.json that keyless
+	// cosign signatures must chain to.
+	TrustedRoot string
+}
+
+// Verify checks the file at path with the first of sigs that t can check,
+// following a signed checksum file to the file's digest. It fails when a
+// signature doesn't match or there is none to check.
+func (v Verifier) Verify(path string, sigs []Signature) (Result, error) {
+	result := Result{Asset: filepath.Base(path), Status: Failed, CheckedAt: time.Now().UTC()}
+	fail := func(err error) (Result, error) {
+		result.Error = err.Error()
+		return result, err
+	}
+	for _, sig := range sigs {
+		method := v.Trust.method(sig.Path)
+		if method == "" {
+			continue
+		}
+		result.Signature = filepath.Base(sig.Path)
+		signer, method, err := v.check(method, sig)
+		result.Method = method
+		if err != nil {
+			return fail(fmt.Errorf("%s signature %s: %w", method, result.Signature, err))
+		}
+		if filepath.Base(sig.Signed) != result.Asset {
+			err = matchChecksum(sig.Signed, path)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		result.Signer = signer
+		result.Status = Verified
+		return result, nil
+	}
+	if len(sigs) == 0 {
+		return fail(fmt.Errorf("%s has no signature", result.Asset))
+	}
+	names := []string{}
+	for _, sig := range sigs {
+		names = append(names, filepath.Base(sig.Path))
+	}
+	return fail(fmt.Errorf("none of the signatures of %s (%s) can be checked with the configured trust", result.Asset, strings.Join(names, ", ")))
+}
+
+func (v Verifier) check(method string, sig Signature) (string, string, error) {
+	bs, err := os.ReadFile(sig.Path)
+	if err != nil {
+		return "", method, err
+	}
+	if method == GPG+"|"+Cosign {
+		method = Cosign
+		if isOpenPGP(bs) {
+			method = GPG
+		}
+	}
+	var signer string
+	switch method {
+	case Minisign:
+		signer, err = verifyMinisign(v.Trust.Minisign, sig.Signed, bs)
+	case GPG:
+		signer, err = verifyGPG(v.Trust.GPG, sig.Signed, bs)
+	case Cosign:
+		signer, err = v.verifyCosign(sig, bs)
+	}
+	return signer, method, err
+}
+
+// readKey returns key, or the contents of the file it names.
+func readKey(key string) ([]byte, error) {
+	trimmed := strings.TrimSpace(key)
+	if strings.HasPrefix(trimmed, "-----BEGIN") {
+		return []byte(trimmed), nil
+	}
+	return os.ReadFile(key)
+}
+
+// fileDigest hashes the file at path with h.
+func fileDigest(path string, h hash.Hash) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// matchChecksum checks the digest of the file at path against its entry in
+// the checksum file at list.
+func matchChecksum(list, path string) error {
+	f, err := os.Open(list)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	name := filepath.Base(path)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// sha256sum marks binary mode files with a *
+		if len(fields) != 2 || filepath.Base(strings.TrimPrefix(fields[1], "*")) != name {
+			continue
+		}
+		var h hash.Hash
+		switch len(fields[0]) {
+		case sha256.Size * 2:
+			h = sha256.New()
+		case sha512.Size * 2:
+			h = sha512.New()
+		default:
+			return fmt.Errorf("%s: unknown checksum for %s", filepath.Base(list), name)
+		}
+		sum, err := fileDigest(path, h)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(hex.EncodeToString(sum), fields[0]) {
+			return fmt.Errorf("checksum of %s does not match the signed %s", name, filepath.Base(list))
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s is not listed in the signed %s", name, filepath.Base(list))
+}
+
+// recordPath returns where the result for a release is kept in dir.
+func recordPath(dir, owner, repo, release string) string {
+	return filepath.Join(dir, owner, repo, url.PathEscape(release)+".json")
+}
+
+// Save records the result of checking a release in dir.
+func Save(dir, owner, repo, release string, r Result) error {
+	path := recordPath(dir, owner, repo, release)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load returns the recorded result of checking a release. The error wraps
+// fs.ErrNotExist when the release was never checked.
+func Load(dir, owner, repo, release string) (Result, error) {
+	r := Result{}
+	bs, err := os.ReadFile(recordPath(dir, owner, repo, release))
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(bs, &r)
+	if err != nil {
+		return r, errors.New("invalid verification record, reinstall the package")
+	}
+	return r, nil
+}
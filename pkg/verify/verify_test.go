@@ -0,0 +1,446 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+func writeFile(t *testing.T, dir, name string, bs []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, bs, 0644))
+	return path
+}
+
+func TestFind(t *testing.T) {
+	assets := []string{
+		"tool_linux_amd64.tar.gz",
+		"tool_linux_amd64.tar.gz.minisig",
+		"tool_darwin_arm64.tar.gz",
+		"tool_darwin_arm64.tar.gz.sig",
+		"checksums.txt",
+		"checksums.txt.sigstore.json",
+		"checksums.txt.pem",
+	}
+	require.Equal(t, []Signature{
+		{Path: "tool_linux_amd64.tar.gz.minisig", Signed: "tool_linux_amd64.tar.gz"},
+		{Path: "checksums.txt.sigstore.json", Signed: "checksums.txt"},
+	}, Find(assets, "tool_linux_amd64.tar.gz"))
+	require.Empty(t, Find([]string{"tool"}, "tool"))
+
+	trust := Trust{Minisign: "RW..."}
+	require.True(t, trust.Accepts("tool.minisig"))
+	require.False(t, trust.Accepts("tool.sig"))
+}
+
+// minisignFixture returns a minisign public key and a signer of files.
+func minisignFixture(t *testing.T) (string, func(path string) []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	id := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	key := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id...), pub...))
+	return key, func(path string) []byte {
+		bs, err := os.ReadFile(path)
+		require.NoError(t, err)
+		digest := blake2b.Sum512(bs)
+		sig := append(append([]byte("ED"), id...), ed25519.Sign(priv, digest[:])...)
+		comment := "timestamp:1700000000"
+		global := ed25519.Sign(priv, append(append([]byte{}, sig[10:]...), comment...))
+		return []byte(fmt.Sprintf("untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+			base64.StdEncoding.EncodeToString(sig), comment, base64.StdEncoding.EncodeToString(global)))
+	}
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	dir := t.TempDir()
+	asset := writeFile(t, dir, "tool.tar.gz", []byte("release"))
+	key, sign := minisignFixture(t)
+	sig := writeFile(t, dir, "tool.tar.gz.minisig", sign(asset))
+
+	v := Verifier{Trust: Trust{Minisign: key}}
+	r, err := v.Verify(asset, []Signature{{Path: sig, Signed: asset}})
+	require.NoError(t, err)
+	require.Equal(t, Verified, r.Status)
+	require.Equal(t, Minisign, r.Method)
+	require.Equal(t, "0807060504030201", r.Signer)
+
+	writeFile(t, dir, "tool.tar.gz", []byte("tampered"))
+	r, err = v.Verify(asset, []Signature{{Path: sig, Signed: asset}})
+	require.ErrorContains(t, err, "signature does not match")
+	require.Equal(t, Failed, r.Status)
+
+	otherKey, _ := minisignFixture(t)
+	v.Trust.Minisign = otherKey
+	writeFile(t, dir, "tool.tar.gz", []byte("release"))
+	_, err = v.Verify(asset, []Signature{{Path: sig, Signed: asset}})
+	require.ErrorContains(t, err, "signature does not match")
+
+	// a key configured for another method finds nothing to check
+	v.Trust = Trust{CosignKey: "cosign.pub"}
+	_, err = v.Verify(asset, []Signature{{Path: sig, Signed: asset}})
+	require.ErrorContains(t, err, "can be checked with the configured trust")
+}
+
+func TestVerifyGPG(t *testing.T) {
+	dir := t.TempDir()
+	asset := writeFile(t, dir, "tool.tar.gz", []byte("release"))
+	entity, err := openpgp.NewEntity("Release Bot", "", "bot@example.com", nil)
+	require.NoError(t, err)
+
+	var key, sig bytes.Buffer
+	w, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+	require.NoError(t, openpgp.ArmoredDetachSign(&sig, entity, bytes.NewReader([]byte("release")), nil))
+	keyPath := writeFile(t, dir, "key.asc", key.Bytes())
+	sigPath := writeFile(t, dir, "tool.tar.gz.asc", sig.Bytes())
+
+	v := Verifier{Trust: Trust{GPG: keyPath}}
+	r, err := v.Verify(asset, []Signature{{Path: sigPath, Signed: asset}})
+	require.NoError(t, err)
+	require.Equal(t, GPG, r.Method)
+	require.Contains(t, r.Signer, "Release Bot <bot@example.com>")
+
+	// an inline key works the same
+	v.Trust.GPG = key.String()
+	writeFile(t, dir, "tool.tar.gz", []byte("tampered"))
+	_, err = v.Verify(asset, []Signature{{Path: sigPath, Signed: asset}})
+	require.Error(t, err)
+}
+
+func TestVerifyCosignKeyAndChecksums(t *testing.T) {
+	dir := t.TempDir()
+	asset := writeFile(t, dir, "tool.tar.gz", []byte("release"))
+	sum := sha256.Sum256([]byte("release"))
+	checksums := writeFile(t, dir, "checksums.txt", []byte(fmt.Sprintf("%x  tool.tar.gz\n%x  other.zip\n", sum, sum)))
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	key := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	listed, err := os.ReadFile(checksums)
+	require.NoError(t, err)
+	digest := sha256.Sum256(listed)
+	signature, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+	require.NoError(t, err)
+	sig := writeFile(t, dir, "checksums.txt.sig", []byte(base64.StdEncoding.EncodeToString(signature)))
+
+	v := Verifier{Trust: Trust{CosignKey: key}}
+	r, err := v.Verify(asset, []Signature{{Path: sig, Signed: checksums}})
+	require.NoError(t, err)
+	require.Equal(t, Cosign, r.Method)
+	require.Equal(t, "checksums.txt.sig", r.Signature)
+
+	writeFile(t, dir, "tool.tar.gz", []byte("tampered"))
+	_, err = v.Verify(asset, []Signature{{Path: sig, Signed: checksums}})
+	require.ErrorContains(t, err, "checksum of tool.tar.gz does not match")
+
+	unlisted := writeFile(t, dir, "unlisted.zip", []byte("release"))
+	_, err = v.Verify(unlisted, []Signature{{Path: sig, Signed: checksums}})
+	require.ErrorContains(t, err, "not listed")
+
+	_, err = v.Verify(asset, nil)
+	require.ErrorContains(t, err, "has no signature")
+}
+
+// sigstoreFixture is a fake Fulcio CA and Rekor log with a trusted root
+// naming them.
+type sigstoreFixture struct {
+	root     string
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	rekorKey *ecdsa.PrivateKey
+	logID    []byte
+}
+
+func newSigstoreFixture(t *testing.T, dir string) *sigstoreFixture {
+	f := &sigstoreFixture{}
+	var err error
+	f.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &f.caKey.PublicKey, f.caKey)
+	require.NoError(t, err)
+	f.ca, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	f.rekorKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rekorDER, err := x509.MarshalPKIXPublicKey(&f.rekorKey.PublicKey)
+	require.NoError(t, err)
+	id := sha256.Sum256(rekorDER)
+	f.logID = id[:]
+
+	root, err := json.Marshal(map[string]any{
+		"tlogs": []any{map[string]any{
+			"publicKey": map[string]any{"rawBytes": rekorDER, "validFor": map[string]any{"start": "2021-01-01T00:00:00Z"}},
+			"logId":     map[string]any{"keyId": f.logID},
+		}},
+		"certificateAuthorities": []any{map[string]any{
+			"certChain": map[string]any{"certificates": []any{map[string]any{"rawBytes": der}}},
+			"validFor":  map[string]any{"start": "2021-01-01T00:00:00Z"},
+		}},
+	})
+	require.NoError(t, err)
+	f.root = writeFile(t, dir, "trusted_root.json", root)
+	return f
+}
+
+// certify issues a Fulcio certificate to identity, returning its key.
+func (f *sigstoreFixture) certify(t *testing.T, identity, issuer string, extensions ...pkix.Extension) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	issuerExt, err := asn1.Marshal(issuer)
+	require.NoError(t, err)
+	uri, err := url.Parse(identity)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(10 * time.Minute),
+		URIs:            []*url.URL{uri},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: append([]pkix.Extension{{Id: oidIssuerV2, Value: issuerExt}}, extensions...),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.ca, &key.PublicKey, f.caKey)
+	require.NoError(t, err)
+	return key, der
+}
+
+// log records an entry in the log, returning it as a bundle holds it.
+func (f *sigstoreFixture) log(t *testing.T, kind string, spec map[string]any) map[string]any {
+	body, err := json.Marshal(map[string]any{"apiVersion": "0.0.1", "kind": kind, "spec": spec})
+	require.NoError(t, err)
+	integrated := time.Now().Unix()
+	payload, err := json.Marshal(map[string]any{
+		"body":           base64.StdEncoding.EncodeToString(body),
+		"integratedTime": integrated,
+		"logID":          hex.EncodeToString(f.logID),
+		"logIndex":       42,
+	})
+	require.NoError(t, err)
+	payloadDigest := sha256.Sum256(payload)
+	set, err := ecdsa.SignASN1(rand.Reader, f.rekorKey, payloadDigest[:])
+	require.NoError(t, err)
+	return map[string]any{
+		"logIndex":          "42",
+		"logId":             map[string]any{"keyId": f.logID},
+		"kindVersion":       map[string]any{"kind": kind, "version": "0.0.1"},
+		"integratedTime":    fmt.Sprint(integrated),
+		"inclusionPromise":  map[string]any{"signedEntryTimestamp": set},
+		"canonicalizedBody": body,
+	}
+}
+
+// sign makes a sigstore bundle for the file at path, signed keyless by
+// identity.
+func (f *sigstoreFixture) sign(t *testing.T, path, identity, issuer string) []byte {
+	key, der := f.certify(t, identity, issuer)
+	bs, err := os.ReadFile(path)
+	require.NoError(t, err)
+	digest := sha256.Sum256(bs)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+
+	entry := f.log(t, "hashedrekord", map[string]any{
+		"data": map[string]any{"hash": map[string]any{"algorithm": "sha256", "value": hex.EncodeToString(digest[:])}},
+		"signature": map[string]any{
+			"content":   signature,
+			"publicKey": map[string]any{"content": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})},
+		},
+	})
+	bundle, err := json.Marshal(map[string]any{
+		"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+		"verificationMaterial": map[string]any{
+			"certificate": map[string]any{"rawBytes": der},
+			"tlogEntries": []any{entry},
+		},
+		"messageSignature": map[string]any{
+			"messageDigest": map[string]any{"algorithm": "SHA2_256", "digest": digest[:]},
+			"signature":     signature,
+		},
+	})
+	require.NoError(t, err)
+	return bundle
+}
+
+// attest makes the github api's answer for the attestations of the file at
+// path: a SLSA provenance signed by a workflow of the source repository.
+func (f *sigstoreFixture) attest(t *testing.T, path, source, workflow string) []byte {
+	sourceExt, err := asn1.MarshalWithParams(source, "utf8")
+	require.NoError(t, err)
+	key, der := f.certify(t, workflow, GithubIssuer, pkix.Extension{Id: oidSourceRepository, Value: sourceExt})
+
+	bs, err := os.ReadFile(path)
+	require.NoError(t, err)
+	digest := sha256.Sum256(bs)
+	payload, err := json.Marshal(map[string]any{
+		"_type":         "https://in-toto.io/Statement/v1",
+		"subject":       []any{map[string]any{"name": filepath.Base(path), "digest": map[string]any{"sha256": hex.EncodeToString(digest[:])}}},
+		"predicateType": "https://slsa.dev/provenance/v1",
+		"predicate":     map[string]any{"buildDefinition": map[string]any{"buildType": "https://actions.github.io/buildtypes/workflow/v1"}},
+	})
+	require.NoError(t, err)
+	payloadType := "application/vnd.in-toto+json"
+	paeDigest := sha256.Sum256(pae(payloadType, payload))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, paeDigest[:])
+	require.NoError(t, err)
+	payloadDigest := sha256.Sum256(payload)
+
+	entry := f.log(t, "dsse", map[string]any{
+		"payloadHash": map[string]any{"algorithm": "sha256", "value": hex.EncodeToString(payloadDigest[:])},
+		"signatures": []any{map[string]any{
+			"signature": signature,
+			"verifier":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		}},
+	})
+	response, err := json.Marshal(map[string]any{
+		"attestations": []any{map[string]any{
+			"repository_id": 1,
+			"bundle": map[string]any{
+				"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+				"verificationMaterial": map[string]any{
+					"certificate": map[string]any{"rawBytes": der},
+					"tlogEntries": []any{entry},
+				},
+				"dsseEnvelope": map[string]any{
+					"payload":     payload,
+					"payloadType": payloadType,
+					"signatures":  []any{map[string]any{"sig": signature}},
+				},
+			},
+		}},
+	})
+	require.NoError(t, err)
+	return response
+}
+
+func TestVerifyKeyless(t *testing.T) {
+	dir := t.TempDir()
+	asset := writeFile(t, dir, "tool.tar.gz", []byte("release"))
+	f := newSigstoreFixture(t, dir)
+	identity := "https://github.com/foo/tool/.github/workflows/release.yml@refs/tags/v1.0.0"
+	issuer := "https://token.actions.githubusercontent.com"
+	sig := writeFile(t, dir, "tool.tar.gz.sigstore.json", f.sign(t, asset, identity, issuer))
+	sigs := []Signature{{Path: sig, Signed: asset}}
+
+	v := Verifier{Trust: Trust{Identity: identity, Issuer: issuer}, TrustedRoot: f.root}
+	r, err := v.Verify(asset, sigs)
+	require.NoError(t, err)
+	require.Equal(t, identity, r.Signer)
+
+	// someone else's workflow
+	v.Trust.Identity = "https://github.com/evil/tool/.github/workflows/release.yml@refs/tags/v1.0.0"
+	_, err = v.Verify(asset, sigs)
+	require.ErrorContains(t, err, "not https://github.com/evil")
+	v.Trust.Identity = identity
+
+	v.Trust.Issuer = "https://accounts.google.com"
+	_, err = v.Verify(asset, sigs)
+	require.ErrorContains(t, err, "identity issued by")
+	v.Trust.Issuer = issuer
+
+	// a CA that isn't in the trusted root
+	other := newSigstoreFixture(t, t.TempDir())
+	v.TrustedRoot = other.root
+	_, err = v.Verify(asset, sigs)
+	require.ErrorContains(t, err, "not in the trusted root")
+
+	v.TrustedRoot = filepath.Join(dir, "missing.json")
+	_, err = v.Verify(asset, sigs)
+	require.ErrorContains(t, err, "need a sigstore trusted root")
+	v.TrustedRoot = f.root
+
+	writeFile(t, dir, "tool.tar.gz", []byte("tampered"))
+	_, err = v.Verify(asset, sigs)
+	require.ErrorContains(t, err, "bundle is for another file")
+}
+
+func TestVerifyProvenance(t *testing.T) {
+	dir := t.TempDir()
+	asset := writeFile(t, dir, "tool.tar.gz", []byte("release"))
+	f := newSigstoreFixture(t, dir)
+	workflow := "https://github.com/foo/tool/.github/workflows/release.yml@refs/tags/v1.0.0"
+	attestations := writeFile(t, dir, "tool.tar.gz.attestations.json", f.attest(t, asset, "https://github.com/foo/tool", workflow))
+
+	v := Verifier{Trust: Trust{Provenance: &Provenance{Repository: "foo/tool", Workflow: "release.yml"}}, TrustedRoot: f.root}
+	builder, err := v.VerifyProvenance(asset, attestations)
+	require.NoError(t, err)
+	require.Equal(t, workflow, builder)
+
+	// built elsewhere
+	v.Trust.Provenance = &Provenance{Repository: "evil/tool"}
+	_, err = v.VerifyProvenance(asset, attestations)
+	require.ErrorContains(t, err, "built by https://github.com/foo/tool, not evil/tool")
+
+	v.Trust.Provenance = &Provenance{Repository: "foo/tool", Workflow: ".github/workflows/nightly.yml"}
+	_, err = v.VerifyProvenance(asset, attestations)
+	require.ErrorContains(t, err, "not .github/workflows/nightly.yml")
+	v.Trust.Provenance.Workflow = ""
+
+	// a fork's workflow can't claim to be the repository's
+	forked := writeFile(t, dir, "forked.json", f.attest(t, asset, "https://github.com/evil/tool", "https://github.com/evil/tool/.github/workflows/release.yml@refs/heads/main"))
+	_, err = v.VerifyProvenance(asset, forked)
+	require.ErrorContains(t, err, "not foo/tool")
+
+	other := newSigstoreFixture(t, t.TempDir())
+	v.TrustedRoot = other.root
+	_, err = v.VerifyProvenance(asset, attestations)
+	require.ErrorContains(t, err, "not in the trusted root")
+	v.TrustedRoot = f.root
+
+	writeFile(t, dir, "tool.tar.gz", []byte("tampered"))
+	_, err = v.VerifyProvenance(asset, attestations)
+	require.ErrorContains(t, err, "attestation is for another file")
+}
+
+func TestRecords(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Load(dir, "foo", "tool", "latest")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	r := Result{Release: "v1.0", Asset: "tool.tar.gz", Status: Verified, Method: Minisign, Signer: "0807060504030201"}
+	require.NoError(t, Save(dir, "foo", "tool", "latest", r))
+	loaded, err := Load(dir, "foo", "tool", "latest")
+	require.NoError(t, err)
+	require.Equal(t, r, loaded)
+	require.Equal(t, "verified (minisign, 0807060504030201)", loaded.String())
+
+	r = Result{Status: Verified, Method: Attestation, Builder: "https://github.com/foo/tool/.github/workflows/release.yml@refs/tags/v1.0"}
+	require.Equal(t, "verified (attestation), built by https://github.com/foo/tool/.github/workflows/release.yml@refs/tags/v1.0", r.String())
+}